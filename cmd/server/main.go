@@ -3,8 +3,8 @@ package main
 import (
 	"html/template"
 	"log"
-	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -13,11 +13,18 @@ import (
 
 	"github.com/Ponloe/cinemesh-core/internal/admin"
 	"github.com/Ponloe/cinemesh-core/internal/api"
+	"github.com/Ponloe/cinemesh-core/internal/audit"
 	"github.com/Ponloe/cinemesh-core/internal/auth"
 	"github.com/Ponloe/cinemesh-core/internal/database"
 	"github.com/Ponloe/cinemesh-core/internal/forum"
+	"github.com/Ponloe/cinemesh-core/internal/mail"
+	"github.com/Ponloe/cinemesh-core/internal/media"
 	"github.com/Ponloe/cinemesh-core/internal/movies"
+	"github.com/Ponloe/cinemesh-core/internal/oidc"
+	"github.com/Ponloe/cinemesh-core/internal/privacy"
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
 	"github.com/Ponloe/cinemesh-core/internal/streaming"
+	"github.com/Ponloe/cinemesh-core/internal/throttle"
 	"github.com/Ponloe/cinemesh-core/internal/users"
 )
 
@@ -50,6 +57,23 @@ func main() {
 
 	if err := database.Migrate(
 		&users.User{},
+		&users.Restriction{},
+		&rbac.Permission{},
+		&rbac.Role{},
+		&auth.RefreshToken{},
+		&auth.Session{},
+		&auth.PasswordResetToken{},
+		&throttle.Counter{},
+		&throttle.Window{},
+		&auth.TOTPCredential{},
+		&auth.RecoveryCode{},
+		&auth.APIKey{},
+		&privacy.Job{},
+		&privacy.JobStep{},
+		&audit.Entry{},
+		&oidc.Client{},
+		&oidc.AuthorizationCode{},
+		&oidc.Consent{},
 		&movies.Movie{},
 		&movies.Genre{},
 		&movies.MovieGenre{},
@@ -59,15 +83,66 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err := users.BackfillEmailVerification(); err != nil {
+		log.Fatalf("failed to backfill email verification: %v", err)
+	}
+
+	if err := audit.InitializeAuditLog(); err != nil {
+		log.Fatalf("failed to set up audit log: %v", err)
+	}
+
+	if err := movies.InitializeSearch(); err != nil {
+		log.Fatalf("failed to set up movie search: %v", err)
+	}
+
+	if err := rbac.Seed(); err != nil {
+		log.Fatalf("failed to seed roles: %v", err)
+	}
+
+	if err := users.InitializeBreachedList(); err != nil {
+		log.Fatalf("failed to open breached password list: %v", err)
+	}
+
+	if err := auth.InitializeSigningKeys(); err != nil {
+		log.Fatalf("failed to load JWT signing keys: %v", err)
+	}
+
+	throttle.InitializeCleanup()
+	mail.InitializeMailer()
+	users.OnRegistered = auth.SendVerificationEmail
+	users.OnEmailChanged = auth.SendVerificationEmail
+	users.RevokeSessions = auth.RevokeUserRefreshTokens
+	users.DeleteAccount = privacy.DeleteAccount
 	admin.InitializeTMDb()
 	forum.InitializeForumClient()
 	streaming.InitializeStreamingClient()
+	privacy.InitializeJobs()
 
 	// ============================================
 	// GIN SERVER
 	// ============================================
 	r := gin.Default()
 
+	// ============================================
+	// TRUSTED PROXIES
+	// ============================================
+	// X-Forwarded-For is only believed from these addresses; everyone else is
+	// identified by the connection's address. Login throttling, sessions, the
+	// audit log and API key tracking all key on the client IP.
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	if len(proxies) == 0 {
+		log.Println("WARNING: TRUSTED_PROXIES not set - behind a reverse proxy every client shares the proxy's IP, " +
+			"so one client can exhaust the per-IP login lockout and anonymous API limit for everyone")
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// ============================================
 	// CORS
 	// ============================================
@@ -82,7 +157,7 @@ func main() {
 			"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS",
 		},
 		AllowHeaders: []string{
-			"Origin", "Content-Type", "Authorization", "Accept",
+			"Origin", "Content-Type", "Authorization", "Accept", "X-API-Key",
 		},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -99,14 +174,34 @@ func main() {
 	})
 
 	r.LoadHTMLGlob("../../internal/admin/templates/*")
+	r.HTMLRender = auth.CSRFHTMLRender{HTMLRender: r.HTMLRender}
+
+	// Uploaded files (avatars)
+	r.Static("/uploads", media.UploadDir())
 
 	// ============================================
 	// HEALTH CHECK
 	// ============================================
 	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
+		failures, _ := audit.Failures()
+		c.JSON(200, gin.H{"status": "ok", "audit_failures": failures})
 	})
 
+	// Public signing keys for offline token verification
+	r.GET("/.well-known/jwks.json", auth.JWKSHandler)
+
+	// ============================================
+	// OPENID CONNECT
+	// ============================================
+	r.GET("/.well-known/openid-configuration", oidc.DiscoveryHandler)
+	r.GET("/oauth/authorize", oidc.AuthorizeHandler)
+	r.POST("/oauth/authorize", oidc.AuthorizeLoginHandler)
+	r.POST("/oauth/token", oidc.TokenHandler)
+	r.GET("/oauth/userinfo", auth.RequireClientToken(), oidc.UserInfoHandler)
+	r.POST("/oauth/userinfo", auth.RequireClientToken(), oidc.UserInfoHandler)
+	r.GET("/oauth/logout", oidc.EndSessionHandler)
+	r.POST("/oauth/logout", oidc.EndSessionConfirmHandler)
+
 	// ============================================
 	// HOME PAGE (API DOCS)
 	// ============================================
@@ -115,7 +210,7 @@ func main() {
 	// ============================================
 	// PUBLIC API ROUTES
 	// ============================================
-	publicAPI := r.Group("/api/public")
+	publicAPI := r.Group("/api/public", auth.OptionalAPIKey(auth.ScopeCatalogRead))
 	{
 
 		// API Docs
@@ -130,7 +225,7 @@ func main() {
 		// Reservations (require auth)
 		authGroup := publicAPI.Group("", auth.RequireAuth())
 		{
-			authGroup.POST("/reservations", api.CreateReservationHandler)
+			authGroup.POST("/reservations", auth.RequireVerifiedEmail(), api.CreateReservationHandler)
 			authGroup.GET("/showtimes/:showtime_id/reserved-seats", api.GetShowtimeReservedSeatsHandler)
 			authGroup.GET("/me/reservations", api.GetUserReservationsHandler)
 		}
@@ -145,6 +240,7 @@ func main() {
 
 		// Search & Stats
 		publicAPI.GET("/search", api.SearchPublicHandler)
+		publicAPI.GET("/autocomplete", api.AutocompleteHandler)
 		publicAPI.GET("/stats", api.GetStatsPublicHandler)
 
 		// Forum (proxy)
@@ -163,87 +259,191 @@ func main() {
 	// AUTH ROUTES
 	// ============================================
 	r.POST("/login", auth.LoginHandler)
+	r.POST("/token/refresh", auth.RefreshHandler)
+	r.POST("/login/2fa", auth.LoginSecondFactorHandler)
+	r.POST("/logout", auth.LogoutHandler)
+	r.POST("/auth/introspect", auth.RequireAPIKey(auth.ScopeTokensIntrospect), auth.IntrospectHandler)
+	r.POST("/password/forgot", auth.ForgotPasswordHandler)
+	r.GET("/password/reset", auth.ResetPasswordFormHandler)
+	r.POST("/password/reset", auth.ResetPasswordHandler)
+	r.GET("/email/verify", auth.VerifyEmailHandler)
+	r.POST("/email/verify", auth.VerifyEmailHandler)
+	r.POST("/email/verify/resend", auth.RequireAuth(), auth.ResendVerificationHandler)
 	r.POST("/users", users.CreateUserHandler)
 	r.GET("/users/:id", users.GetUserHandler)
 
 	// Protected route
 	r.GET("/me", auth.RequireAuth(), auth.MeHandler)
 
+	// Self-service profile
+	me := r.Group("/me", auth.RequireAuth())
+	{
+		me.PATCH("", auth.DenyImpersonation(), auth.UpdateMeHandler)
+		me.POST("/password", auth.DenyImpersonation(), auth.ChangePasswordHandler)
+		me.POST("/avatar", auth.DenyImpersonation(), auth.UploadAvatarHandler)
+		me.DELETE("/avatar", auth.DenyImpersonation(), auth.DeleteAvatarHandler)
+		me.GET("/sessions", auth.ListSessionsHandler)
+		me.DELETE("/sessions/:id", auth.DenyImpersonation(), auth.RevokeSessionHandler)
+		me.GET("/export", auth.DenyImpersonation(), privacy.ExportHandler)
+		me.DELETE("", auth.DenyImpersonation(), privacy.DeleteAccountHandler)
+		me.GET("/jobs", privacy.ListJobsHandler)
+		me.GET("/jobs/:id/download", privacy.DownloadExportHandler)
+	}
+	r.GET("/privacy/jobs/:token", privacy.JobStatusHandler)
+
+	// Two-factor authentication
+	twoFactor := r.Group("/me/2fa", auth.RequireAuth(), auth.DenyImpersonation())
+	{
+		twoFactor.GET("", auth.TwoFactorStatusHandler)
+		twoFactor.POST("/setup", auth.TwoFactorSetupHandler)
+		twoFactor.POST("/confirm", auth.TwoFactorConfirmHandler)
+		twoFactor.POST("/recovery-codes", auth.TwoFactorRecoveryCodesHandler)
+		twoFactor.POST("/disable", auth.TwoFactorDisableHandler)
+	}
+
 	// ============================================
 	// ADMIN ROUTES
 	// ============================================
 	r.GET("/admin/login", admin.LoginFormHandler)
 	r.POST("/admin/login", admin.LoginPostHandler)
+	r.POST("/admin/login/2fa", admin.LoginSecondFactorHandler)
+
+	// Reachable before 2FA is set up so admins can enroll or sign out
+	adminSession := r.Group("/admin", auth.RequireAuth(), auth.RequireAdmin(), auth.RequireCSRF())
+	{
+		adminSession.POST("/logout", admin.LogoutHandler)
+
+		adminSecurity := adminSession.Group("/security")
+		{
+			adminSecurity.GET("/2fa", admin.TwoFactorPageHandler)
+			adminSecurity.POST("/2fa/setup", admin.TwoFactorSetupHandler)
+			adminSecurity.POST("/2fa/confirm", admin.TwoFactorConfirmHandler)
+			adminSecurity.POST("/2fa/recovery-codes", admin.TwoFactorRecoveryCodesHandler)
+			adminSecurity.POST("/2fa/disable", admin.TwoFactorDisableHandler)
+		}
+	}
 
-	adminGroup := r.Group("/admin", auth.RequireAuth(), auth.RequireAdmin())
+	adminGroup := r.Group("/admin", auth.RequireAuth(), auth.RequireAdmin(), auth.RequireAdminTwoFactor(), auth.RequireCSRF())
 	{
 
 		adminGroup.GET("/", admin.DashboardHandler)
 
 		// Users
-		adminGroup.GET("/users", users.ListUsersHandler)
-		adminGroup.GET("/users/new", users.NewUserFormHandler)
-		adminGroup.POST("/users", users.CreateUserAdminHandler)
-		adminGroup.GET("/users/:id/edit", users.EditUserFormHandler)
-		adminGroup.POST("/users/:id", users.UpdateUserHandler)
-		adminGroup.POST("/users/:id/delete", users.DeleteUserHandler)
-
-		// Movies
-		adminGroup.GET("/movies", movies.ListMoviesAdminHandler)
-		adminGroup.GET("/movies/new", movies.NewMovieFormHandler)
-		adminGroup.POST("/movies", movies.CreateMovieAdminHandler)
-		adminGroup.GET("/movies/:id/edit", movies.EditMovieFormHandler)
-		adminGroup.POST("/movies/:id", movies.UpdateMovieHandler)
-		adminGroup.POST("/movies/:id/delete", movies.DeleteMovieHandler)
-
-		// TMDb Integration
-		adminGroup.GET("/tmdb/search", admin.TMDbSearchPageHandler)
-		adminGroup.GET("/tmdb/api/search", admin.TMDbSearchHandler)
-		adminGroup.POST("/tmdb/import", admin.ImportFromTMDbHandler)
-		adminGroup.GET("/tmdb/prefill", admin.PrefillFromTMDbHandler)
-
-		// Cast
-		adminGroup.GET("/movies/:id/cast", movies.ManageCastHandler)
-		adminGroup.POST("/movies/:id/cast", movies.AddCastMemberHandler)
-		adminGroup.POST("/movies/:id/cast/:person_id/:role/delete", movies.RemoveCastMemberHandler)
+		usersRead := adminGroup.Group("", auth.RequirePermission(rbac.UsersRead))
+		{
+			usersRead.GET("/users", users.ListUsersHandler)
+			usersRead.GET("/api/users", users.ListUsersJSONHandler)
+			usersRead.GET("/users/export", users.ExportUsersHandler)
+			usersRead.GET("/users/:id/sessions", admin.UserSessionsHandler)
+		}
+		usersWrite := adminGroup.Group("", auth.RequirePermission(rbac.UsersWrite))
+		{
+			usersWrite.GET("/users/new", users.NewUserFormHandler)
+			usersWrite.GET("/users/import", admin.ImportUsersFormHandler)
+			usersWrite.POST("/users/import", admin.ImportUsersHandler)
+			usersWrite.POST("/users", users.CreateUserAdminHandler)
+			usersWrite.GET("/users/:id/edit", users.EditUserFormHandler)
+			usersWrite.POST("/users/:id", users.UpdateUserHandler)
+			usersWrite.POST("/users/:id/delete", users.DeleteUserHandler)
+			usersWrite.POST("/users/lockouts/:id/clear", users.ClearLockoutHandler)
+			usersWrite.POST("/users/:id/sessions/:sid/revoke", admin.RevokeUserSessionHandler)
+			usersWrite.POST("/users/:id/sessions/revoke-all", admin.RevokeAllUserSessionsHandler)
+			usersWrite.POST("/users/:id/restrict", admin.RestrictUserHandler)
+			usersWrite.POST("/users/:id/restrict/lift", admin.LiftRestrictionHandler)
+			usersWrite.POST("/users/bulk/role", users.BulkRoleHandler)
+			usersWrite.POST("/users/bulk/delete", users.BulkDeleteHandler)
+			usersWrite.POST("/users/bulk/ban", admin.BulkBanHandler)
+		}
+		adminGroup.POST("/users/:id/impersonate", auth.RequirePermission(rbac.UsersImpersonate), admin.ImpersonateUserHandler)
 
-		// People
-		adminGroup.GET("/people", movies.ListPeopleAdminHandler)
+		// Catalog: movies, TMDb, cast, people
+		catalog := adminGroup.Group("", auth.RequirePermission(rbac.MoviesWrite))
+		{
+			catalog.GET("/movies", movies.ListMoviesAdminHandler)
+			catalog.GET("/movies/new", movies.NewMovieFormHandler)
+			catalog.POST("/movies", movies.CreateMovieAdminHandler)
+			catalog.GET("/movies/:id/edit", movies.EditMovieFormHandler)
+			catalog.POST("/movies/:id", movies.UpdateMovieHandler)
+			catalog.POST("/movies/:id/delete", movies.DeleteMovieHandler)
+
+			// TMDb Integration
+			catalog.GET("/tmdb/search", admin.TMDbSearchPageHandler)
+			catalog.GET("/tmdb/api/search", admin.TMDbSearchHandler)
+			catalog.POST("/tmdb/import", admin.ImportFromTMDbHandler)
+			catalog.GET("/tmdb/prefill", admin.PrefillFromTMDbHandler)
+
+			// Cast
+			catalog.GET("/movies/:id/cast", movies.ManageCastHandler)
+			catalog.POST("/movies/:id/cast", movies.AddCastMemberHandler)
+			catalog.POST("/movies/:id/cast/:person_id/:role/delete", movies.RemoveCastMemberHandler)
+
+			// People
+			catalog.GET("/people", movies.ListPeopleAdminHandler)
+		}
 
 		// Genres
-		adminGroup.GET("/genres", movies.ListGenresAdminHandler)
-		adminGroup.GET("/genres/new", movies.NewGenreFormHandler)
-		adminGroup.POST("/genres", movies.CreateGenreAdminHandler)
-		adminGroup.GET("/genres/:id/edit", movies.EditGenreFormHandler)
-		adminGroup.POST("/genres/:id", movies.UpdateGenreHandler)
-		adminGroup.POST("/genres/:id/delete", movies.DeleteGenreHandler)
-
-		// Forum -
-		adminGroup.GET("/forum", forum.ListTopicsHandler)
-		adminGroup.GET("/forum/topics/new", forum.NewTopicFormHandler)
-		adminGroup.POST("/forum/topics", forum.CreateTopicHandler)
-		adminGroup.GET("/forum/topics/:slug/edit", forum.EditTopicFormHandler)
-		adminGroup.POST("/forum/topics/:slug/update", forum.UpdateTopicHandler)
-		adminGroup.POST("/forum/topics/:slug/delete", forum.DeleteTopicHandler)
-		adminGroup.GET("/forum/topics/:slug", forum.ListThreadsHandler)
-		adminGroup.GET("/forum/threads/:thread_slug", forum.ViewThreadHandler)
-
-		// Forum Moderation
-		adminGroup.POST("/forum/replies/:reply_id/delete", forum.DeleteReplyHandler)
-		adminGroup.POST("/forum/threads/:thread_id/pin", forum.PinThreadHandler)
-		adminGroup.DELETE("/forum/threads/:thread_slug", forum.DeleteThreadHandler)
+		genres := adminGroup.Group("", auth.RequirePermission(rbac.GenresWrite))
+		{
+			genres.GET("/genres", movies.ListGenresAdminHandler)
+			genres.GET("/genres/new", movies.NewGenreFormHandler)
+			genres.POST("/genres", movies.CreateGenreAdminHandler)
+			genres.GET("/genres/:id/edit", movies.EditGenreFormHandler)
+			genres.POST("/genres/:id", movies.UpdateGenreHandler)
+			genres.POST("/genres/:id/delete", movies.DeleteGenreHandler)
+		}
+
+		// Forum & moderation
+		forumMod := adminGroup.Group("", auth.RequirePermission(rbac.ForumModerate))
+		{
+			forumMod.GET("/forum", forum.ListTopicsHandler)
+			forumMod.GET("/forum/topics/new", forum.NewTopicFormHandler)
+			forumMod.POST("/forum/topics", forum.CreateTopicHandler)
+			forumMod.GET("/forum/topics/:slug/edit", forum.EditTopicFormHandler)
+			forumMod.POST("/forum/topics/:slug/update", forum.UpdateTopicHandler)
+			forumMod.POST("/forum/topics/:slug/delete", forum.DeleteTopicHandler)
+			forumMod.GET("/forum/topics/:slug", forum.ListThreadsHandler)
+			forumMod.GET("/forum/threads/:thread_slug", forum.ViewThreadHandler)
+
+			forumMod.POST("/forum/replies/:reply_id/delete", forum.DeleteReplyHandler)
+			forumMod.POST("/forum/threads/:thread_id/pin", forum.PinThreadHandler)
+			forumMod.DELETE("/forum/threads/:thread_slug", forum.DeleteThreadHandler)
+		}
 
 		// Tickets
-		adminGroup.GET("/tickets", admin.TicketsPageHandler)
-	}
+		adminGroup.GET("/tickets", auth.RequirePermission(rbac.TicketsRead), admin.TicketsPageHandler)
 
-	// ============================================
-	// ADMIN LOGOUT
-	// ============================================
-	r.POST("/admin/logout", func(c *gin.Context) {
-		c.SetCookie("token", "", -1, "/", "", false, true)
-		c.Redirect(http.StatusFound, "/admin/login")
-	})
+		// OIDC Clients
+		oauthClients := adminGroup.Group("/oauth/clients", auth.RequirePermission(rbac.OAuthManage))
+		{
+			oauthClients.GET("", oidc.ListClientsHandler)
+			oauthClients.POST("", oidc.CreateClientHandler)
+			oauthClients.POST("/:id/delete", oidc.DeleteClientHandler)
+		}
+
+		// API Keys
+		apiKeys := adminGroup.Group("/api-keys", auth.RequirePermission(rbac.APIKeysManage))
+		{
+			apiKeys.GET("", admin.ListAPIKeysHandler)
+			apiKeys.POST("", admin.CreateAPIKeyHandler)
+			apiKeys.POST("/:id/revoke", admin.RevokeAPIKeyHandler)
+		}
+
+		// Roles
+		roles := adminGroup.Group("/roles", auth.RequirePermission(rbac.RolesManage))
+		{
+			roles.GET("", rbac.ListRolesHandler)
+			roles.POST("", rbac.CreateRoleHandler)
+			roles.POST("/:id", rbac.UpdateRoleHandler)
+			roles.POST("/:id/delete", rbac.DeleteRoleHandler)
+		}
+
+		// Audit log
+		auditLog := adminGroup.Group("/audit", auth.RequirePermission(rbac.AuditRead))
+		{
+			auditLog.GET("", audit.ListAuditHandler)
+			auditLog.GET("/export", audit.ExportAuditHandler)
+		}
+	}
 
 	// ============================================
 	// SERVER START
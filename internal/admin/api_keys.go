@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/gin-gonic/gin"
+)
+
+func renderAPIKeys(c *gin.Context, status int, extra gin.H) {
+	var keys []auth.APIKey
+	if err := database.DB.Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	data := gin.H{
+		"title":  "API Keys",
+		"keys":   keys,
+		"scopes": auth.APIKeyScopes,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	c.HTML(status, "api_keys.html", data)
+}
+
+func ListAPIKeysHandler(c *gin.Context) {
+	renderAPIKeys(c, http.StatusOK, nil)
+}
+
+// CreateAPIKeyHandler issues a key. The raw key is shown exactly once.
+func CreateAPIKeyHandler(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		renderAPIKeys(c, http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+
+	var expiresAt *time.Time
+	if days, err := strconv.Atoi(c.PostForm("expires_in_days")); err == nil && days > 0 {
+		t := time.Now().AddDate(0, 0, days)
+		expiresAt = &t
+	}
+	rateLimit, _ := strconv.Atoi(c.PostForm("rate_limit"))
+	if rateLimit < 0 {
+		rateLimit = 0
+	}
+
+	key, raw, err := auth.CreateAPIKey(name, c.PostFormArray("scopes"), expiresAt, rateLimit, c.GetUint("user_id"))
+	if err != nil {
+		renderAPIKeys(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "apikey.create", "api_key", key.ID, nil, key)
+
+	renderAPIKeys(c, http.StatusOK, gin.H{"newKey": key, "newSecret": raw})
+}
+
+func RevokeAPIKeyHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "invalid id"})
+		return
+	}
+
+	if err := auth.RevokeAPIKey(uint(id)); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "apikey.revoke", "api_key", id, nil, nil)
+	c.Redirect(http.StatusFound, "/admin/api-keys")
+}
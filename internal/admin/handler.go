@@ -2,6 +2,7 @@ package admin
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,13 +10,13 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/Ponloe/cinemesh-core/internal/audit"
 	"github.com/Ponloe/cinemesh-core/internal/auth"
 	"github.com/Ponloe/cinemesh-core/internal/database"
 	"github.com/Ponloe/cinemesh-core/internal/movies"
 	"github.com/Ponloe/cinemesh-core/internal/tmdb"
 	"github.com/Ponloe/cinemesh-core/internal/users"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -115,27 +116,90 @@ func LoginPostHandler(c *gin.Context) {
 		return
 	}
 
-	var u users.User
-	if err := database.DB.First(&u, "email = ?", email).Error; err != nil {
+	u, err := auth.Authenticate(email, password, c.ClientIP())
+	if err != nil {
+		var lockout *auth.LockoutError
+		if errors.As(err, &lockout) {
+			c.Header("Retry-After", strconv.Itoa(int(lockout.RetryAfter.Seconds())+1))
+			c.HTML(http.StatusTooManyRequests, "login.html", gin.H{"error": "Too many failed attempts, try again later", "title": "Admin Login"})
+			return
+		}
+		var restricted *auth.RestrictedError
+		if errors.As(err, &restricted) {
+			c.HTML(http.StatusForbidden, "login.html", gin.H{"error": "Your " + restricted.Error(), "title": "Admin Login"})
+			return
+		}
 		c.HTML(http.StatusUnauthorized, "login.html", gin.H{"error": "Invalid credentials", "title": "Admin Login"})
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
-		c.HTML(http.StatusUnauthorized, "login.html", gin.H{"error": "Invalid credentials", "title": "Admin Login"})
+	mfa, err := auth.TOTPEnabled(u.ID)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"error": "Failed to sign in", "title": "Admin Login"})
+		return
+	}
+	if mfa {
+		mfaToken, err := auth.NewMFAPendingToken(u)
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "login.html", gin.H{"error": "Failed to generate token", "title": "Admin Login"})
+			return
+		}
+		c.HTML(http.StatusOK, "login_2fa.html", gin.H{"title": "Admin Login", "action": "/admin/login/2fa", "mfaToken": mfaToken})
+		return
+	}
+
+	completeLogin(c, u)
+}
+
+// LoginSecondFactorHandler checks the authenticator code of a login started
+// in LoginPostHandler.
+func LoginSecondFactorHandler(c *gin.Context) {
+	mfaToken := c.PostForm("mfa_token")
+
+	u, err := auth.CompleteSecondFactor(mfaToken, c.PostForm("code"), c.ClientIP())
+	if err != nil {
+		var lockout *auth.LockoutError
+		var restricted *auth.RestrictedError
+		switch {
+		case errors.As(err, &restricted):
+			c.HTML(http.StatusForbidden, "login.html", gin.H{"error": "Your " + restricted.Error(), "title": "Admin Login"})
+		case errors.Is(err, auth.ErrInvalidMFAToken):
+			c.HTML(http.StatusUnauthorized, "login.html", gin.H{"error": err.Error(), "title": "Admin Login"})
+		case errors.As(err, &lockout):
+			c.Header("Retry-After", strconv.Itoa(int(lockout.RetryAfter.Seconds())+1))
+			c.HTML(http.StatusTooManyRequests, "login.html", gin.H{"error": "Too many failed attempts, try again later", "title": "Admin Login"})
+		case errors.Is(err, auth.ErrInvalidSecondFactor):
+			c.HTML(http.StatusUnauthorized, "login_2fa.html", gin.H{"error": "Invalid code", "title": "Admin Login", "action": "/admin/login/2fa", "mfaToken": mfaToken})
+		default:
+			c.HTML(http.StatusInternalServerError, "login.html", gin.H{"error": "Failed to verify code", "title": "Admin Login"})
+		}
 		return
 	}
 
-	token, err := auth.GenerateToken(&u)
+	completeLogin(c, u)
+}
+
+func completeLogin(c *gin.Context, u *users.User) {
+	token, refresh, err := auth.IssueTokenPair(u, auth.ClientInfoFrom(c))
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "login.html", gin.H{"error": "Failed to generate token", "title": "Admin Login"})
 		return
 	}
 
-	c.SetCookie("token", token, 86400, "/", "", false, true) // 24 hours
+	auth.SetAuthCookies(c, token, refresh)
 	c.Redirect(http.StatusFound, "/admin")
 }
 
+func LogoutHandler(c *gin.Context) {
+	if refresh, _ := c.Cookie(auth.RefreshCookieName); refresh != "" {
+		if err := auth.RevokeRefreshToken(refresh); err != nil {
+			log.Printf("failed to revoke refresh token on logout: %v", err)
+		}
+	}
+	auth.ClearAuthCookies(c)
+	c.Redirect(http.StatusFound, "/admin/login")
+}
+
 func TMDbSearchHandler(c *gin.Context) {
 	query := c.Query("q")
 	log.Printf("TMDb search requested for query: %s", query)
@@ -288,6 +352,10 @@ func ImportFromTMDbHandler(c *gin.Context) {
 
 	database.DB.Preload("Genres").Preload("Cast.Person").First(movie, movie.ID)
 
+	snapshot := *movie
+	snapshot.Cast = nil
+	audit.Record(c, "movie.import", "movie", movie.ID, nil, gin.H{"tmdb_id": req.TMDbID, "movie": snapshot, "cast_count": len(movie.Cast)})
+
 	log.Printf("✅ Movie import completed successfully: %s (ID: %d)", movie.Title, movie.ID)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "movie imported successfully with cast",
@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// ImpersonateUserHandler mints a short-lived token that acts as the user, for
+// reproducing what they see in the frontends. The page shows it once.
+func ImpersonateUserHandler(c *gin.Context) {
+	u, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+
+	token, expiresAt, err := auth.Impersonate(u, c.GetUint("user_id"), c.GetString("user_email"), c.GetString("session_id"))
+	if err != nil {
+		var restricted *auth.RestrictedError
+		if errors.Is(err, auth.ErrImpersonateSelf) || errors.Is(err, auth.ErrImpersonateAdmin) || errors.As(err, &restricted) {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": err.Error()})
+			return
+		}
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "user.impersonate", "user", u.ID, nil, gin.H{"expires_at": expiresAt})
+
+	c.HTML(http.StatusOK, "impersonate.html", gin.H{
+		"title":     "Impersonate",
+		"user":      u,
+		"token":     token,
+		"expiresAt": expiresAt,
+		"actor":     c.GetString("user_email"),
+	})
+}
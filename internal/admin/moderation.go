@@ -0,0 +1,170 @@
+package admin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/forum"
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+)
+
+// restrictionExpiry reads the optional "until" field of the restrict form
+// (an <input type="datetime-local">, server local time).
+func restrictionExpiry(c *gin.Context) (*time.Time, error) {
+	v := strings.TrimSpace(c.PostForm("until"))
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04", v, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry date")
+	}
+	return &t, nil
+}
+
+// checkRestrictable reports why the signed-in admin may not place or lift a
+// restriction on u: their own account, or a role they could not assign.
+func checkRestrictable(c *gin.Context, u *users.User) error {
+	if u.ID == c.GetUint("user_id") {
+		return fmt.Errorf("you cannot restrict your own account")
+	}
+	allowed, err := rbac.CanAssign(c.GetStringSlice("permissions"), u.Role)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("you cannot restrict accounts with the %s role", u.Role)
+	}
+	return nil
+}
+
+// restrictUser suspends or bans a user. Bans also sign the user out
+// everywhere; suspended sessions are refused until the suspension ends.
+func restrictUser(c *gin.Context, u *users.User, kind, reason string, until *time.Time) (*users.Restriction, error) {
+	if err := checkRestrictable(c, u); err != nil {
+		return nil, err
+	}
+
+	r, err := users.Restrict(u.ID, kind, reason, until, c.GetUint("user_id"))
+	if err != nil {
+		return nil, err
+	}
+	if kind == users.RestrictionBanned {
+		if err := auth.RevokeUserRefreshTokens(u.ID); err != nil {
+			log.Printf("moderation: failed to revoke sessions of user %d: %v", u.ID, err)
+		}
+	}
+	action := "user.suspend"
+	if kind == users.RestrictionBanned {
+		action = "user.ban"
+	}
+	audit.Record(c, action, "user", u.ID, nil, r)
+	return r, nil
+}
+
+// RestrictUserHandler suspends or bans a user from the edit page.
+func RestrictUserHandler(c *gin.Context) {
+	u, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	until, err := restrictionExpiry(c)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := restrictUser(c, u, c.PostForm("kind"), strings.TrimSpace(c.PostForm("reason")), until); err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin/users/"+strconv.FormatUint(uint64(u.ID), 10)+"/edit")
+}
+
+// LiftRestrictionHandler ends a user's suspension or ban. Only admins who
+// could have placed it may lift it.
+func LiftRestrictionHandler(c *gin.Context) {
+	u, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+	if err := checkRestrictable(c, u); err != nil {
+		c.HTML(http.StatusForbidden, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	before, err := users.ActiveRestriction(u.ID)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	if err := users.LiftRestriction(u.ID, c.GetUint("user_id")); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	if before != nil {
+		audit.Record(c, "user.restriction.lift", "user", u.ID, before, nil)
+	}
+	c.Redirect(http.StatusFound, "/admin/users/"+strconv.FormatUint(uint64(u.ID), 10)+"/edit")
+}
+
+// BulkBanHandler bans the selected users and soft-deletes their forum
+// threads. Failures are collected so one bad user does not stop the rest.
+func BulkBanHandler(c *gin.Context) {
+	reason := strings.TrimSpace(c.PostForm("reason"))
+	if reason == "" {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "a reason is required"})
+		return
+	}
+	ids := c.PostFormArray("user_ids")
+	if len(ids) == 0 {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "no users selected"})
+		return
+	}
+
+	// Core's own credentials, so a long run doesn't outlive the admin's token
+	fc, err := forum.ServiceClient()
+	if err != nil {
+		c.HTML(http.StatusServiceUnavailable, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	var failures []string
+	for _, idStr := range ids {
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			failures = append(failures, idStr+": invalid id")
+			continue
+		}
+		var u users.User
+		if err := database.DB.First(&u, uint(id)).Error; err != nil {
+			failures = append(failures, idStr+": user not found")
+			continue
+		}
+
+		if _, err := restrictUser(c, &u, users.RestrictionBanned, reason, nil); err != nil {
+			failures = append(failures, u.Email+": "+err.Error())
+			continue
+		}
+		removed, err := fc.SoftDeleteUserThreads(strconv.FormatUint(uint64(u.ID), 10))
+		audit.Record(c, "user.ban.remove_content", "user", u.ID, nil, gin.H{"threads_removed": removed})
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: banned, but removing forum threads failed after %d: %v", u.Email, removed, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": "Some users could not be processed: " + strings.Join(failures, "; ")})
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin/users")
+}
@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+)
+
+// renderTwoFactor shows the 2FA page of the signed-in admin; extra values
+// (setup secret, fresh recovery codes, errors) are merged in.
+func renderTwoFactor(c *gin.Context, status int, extra gin.H) {
+	uid := c.GetUint("user_id")
+	enabled, err := auth.TOTPEnabled(uid)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	data := gin.H{
+		"title":             "Two-factor authentication",
+		"enabled":           enabled,
+		"required":          auth.AdminTwoFactorRequired(),
+		"recoveryRemaining": auth.RemainingRecoveryCodes(uid),
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	c.HTML(status, "security_2fa.html", data)
+}
+
+func TwoFactorPageHandler(c *gin.Context) {
+	renderTwoFactor(c, http.StatusOK, nil)
+}
+
+func TwoFactorSetupHandler(c *gin.Context) {
+	var u users.User
+	if err := database.DB.First(&u, c.GetUint("user_id")).Error; err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "user not found"})
+		return
+	}
+
+	secret, uri, err := auth.BeginTOTPEnrollment(&u)
+	if err != nil {
+		renderTwoFactor(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "user.2fa.setup", "user", u.ID, nil, nil)
+
+	renderTwoFactor(c, http.StatusOK, gin.H{"secret": secret, "provisioningURI": uri})
+}
+
+// TwoFactorConfirmHandler enables 2FA, signs out every other session and
+// starts a new one for this browser.
+func TwoFactorConfirmHandler(c *gin.Context) {
+	uid := c.GetUint("user_id")
+
+	codes, err := auth.ConfirmTOTPEnrollment(uid, c.PostForm("code"))
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidSecondFactor) {
+			// Show the pending secret again so the admin can retry
+			var u users.User
+			if database.DB.First(&u, uid).Error == nil {
+				if secret, uri, ok := auth.PendingTOTPEnrollment(&u); ok {
+					renderTwoFactor(c, http.StatusBadRequest, gin.H{"error": "Invalid code, please try again", "secret": secret, "provisioningURI": uri})
+					return
+				}
+			}
+		}
+		renderTwoFactor(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "user.2fa.enable", "user", uid, nil, gin.H{"recovery_codes": len(codes)})
+
+	var u users.User
+	if err := database.DB.First(&u, uid).Error; err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "user not found"})
+		return
+	}
+	if err := auth.RevokeUserRefreshTokens(uid); err != nil {
+		log.Printf("2fa: failed to revoke sessions of user %d: %v", uid, err)
+	}
+	token, refresh, err := auth.IssueTokenPair(&u, auth.ClientInfoFrom(c))
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": "failed to generate token"})
+		return
+	}
+	auth.SetAuthCookies(c, token, refresh)
+
+	renderTwoFactor(c, http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+func TwoFactorRecoveryCodesHandler(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	codes, err := auth.RegenerateRecoveryCodes(uid, c.PostForm("code"), c.ClientIP())
+	if err != nil {
+		renderTwoFactor(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "user.2fa.recovery_codes", "user", uid, nil, gin.H{"recovery_codes": len(codes)})
+	renderTwoFactor(c, http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+func TwoFactorDisableHandler(c *gin.Context) {
+	var u users.User
+	if err := database.DB.First(&u, c.GetUint("user_id")).Error; err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "user not found"})
+		return
+	}
+
+	if err := auth.DisableTOTP(&u, c.PostForm("password"), c.PostForm("code"), c.ClientIP()); err != nil {
+		renderTwoFactor(c, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "user.2fa.disable", "user", u.ID, nil, nil)
+	c.Redirect(http.StatusFound, "/admin/security/2fa")
+}
@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func sessionUser(c *gin.Context) (*users.User, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "invalid id"})
+		return nil, false
+	}
+
+	var u users.User
+	if err := database.DB.First(&u, uint(id)).Error; err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "user not found"})
+		return nil, false
+	}
+	return &u, true
+}
+
+// UserSessionsHandler lists the devices a user is signed in on.
+func UserSessionsHandler(c *gin.Context) {
+	u, ok := sessionUser(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := auth.ActiveSessions(u.ID)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	c.HTML(http.StatusOK, "user_sessions.html", gin.H{
+		"title":    "Sessions",
+		"user":     u,
+		"sessions": sessions,
+	})
+}
+
+// RevokeUserSessionHandler signs one of the user's devices out. Like
+// editing, it is limited to accounts whose role the admin could assign.
+func RevokeUserSessionHandler(c *gin.Context) {
+	u, ok := sessionUser(c)
+	if !ok || !users.CanManageRole(c, u.Role) {
+		return
+	}
+	sid, err := strconv.ParseUint(c.Param("sid"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "invalid session id"})
+		return
+	}
+
+	if err := auth.RevokeSession(u.ID, uint(sid)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "session not found"})
+			return
+		}
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "session.revoke", "user", u.ID, nil, gin.H{"session_id": sid})
+	c.Redirect(http.StatusFound, "/admin/users/"+strconv.FormatUint(uint64(u.ID), 10)+"/sessions")
+}
+
+// RevokeAllUserSessionsHandler signs the user out everywhere, under the
+// same role check as RevokeUserSessionHandler.
+func RevokeAllUserSessionsHandler(c *gin.Context) {
+	u, ok := sessionUser(c)
+	if !ok || !users.CanManageRole(c, u.Role) {
+		return
+	}
+
+	if err := auth.RevokeUserRefreshTokens(u.ID); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "session.revoke_all", "user", u.ID, nil, nil)
+	c.Redirect(http.StatusFound, "/admin/users/"+strconv.FormatUint(uint64(u.ID), 10)+"/sessions")
+}
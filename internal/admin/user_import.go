@@ -0,0 +1,285 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxImportFileSize = 5 << 20
+	maxImportRows     = 5000
+)
+
+// importRow is one CSV line and what is wrong with it.
+type importRow struct {
+	Line     int
+	Username string
+	Email    string
+	Role     string
+	Errors   []string
+}
+
+// importReport is the validation result shown after an upload.
+type importReport struct {
+	Rows    []importRow
+	Valid   int
+	Invalid int
+}
+
+// unusablePassword is not a valid hash and never verifies, so imported
+// accounts can only sign in after following their invitation.
+const unusablePassword = "!"
+
+func renderImport(c *gin.Context, status int, extra gin.H) {
+	data := gin.H{"title": "Import users"}
+	for k, v := range extra {
+		data[k] = v
+	}
+	c.HTML(status, "user_import.html", data)
+}
+
+func ImportUsersFormHandler(c *gin.Context) {
+	renderImport(c, http.StatusOK, gin.H{"dryRun": true, "invite": true})
+}
+
+// ImportUsersHandler validates an uploaded CSV (columns username, email and
+// optionally role; other columns such as those of the export are ignored).
+// Nothing is created on a dry run or when any row is invalid. Imported
+// accounts get an invitation email instead of a password.
+func ImportUsersHandler(c *gin.Context) {
+	dryRun := c.PostForm("dry_run") != ""
+	invite := c.PostForm("invite") != ""
+	form := gin.H{"dryRun": dryRun, "invite": invite}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		form["error"] = "Choose a CSV file to upload"
+		renderImport(c, http.StatusBadRequest, form)
+		return
+	}
+	if file.Size > maxImportFileSize {
+		form["error"] = "The file is larger than 5 MB"
+		renderImport(c, http.StatusBadRequest, form)
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	rows, err := parseImportCSV(f)
+	if err != nil {
+		form["error"] = err.Error()
+		renderImport(c, http.StatusBadRequest, form)
+		return
+	}
+	report, err := validateImport(rows, c.GetStringSlice("permissions"))
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	form["report"] = report
+
+	if dryRun || report.Invalid > 0 {
+		status := http.StatusOK
+		if report.Invalid > 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		renderImport(c, status, form)
+		return
+	}
+
+	created := make([]users.User, 0, len(report.Rows))
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		for _, r := range report.Rows {
+			u := users.User{Username: r.Username, Email: r.Email, Role: r.Role, PasswordHash: unusablePassword}
+			if err := tx.Create(&u).Error; err != nil {
+				return fmt.Errorf("line %d: %w", r.Line, err)
+			}
+			created = append(created, u)
+		}
+		return nil
+	})
+	if err != nil {
+		form["error"] = "Import failed, nothing was created: " + err.Error()
+		renderImport(c, http.StatusInternalServerError, form)
+		return
+	}
+	for i := range created {
+		audit.Record(c, "user.import", "user", created[i].ID, nil, created[i])
+	}
+
+	if invite {
+		go func() {
+			for i := range created {
+				if err := auth.SendInvitation(&created[i]); err != nil {
+					log.Printf("user import: failed to invite user %d: %v", created[i].ID, err)
+				}
+			}
+		}()
+	}
+
+	form["imported"] = len(created)
+	renderImport(c, http.StatusOK, form)
+}
+
+// parseImportCSV reads the rows of an import file, locating the columns by
+// their header.
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // Excel's UTF-8 BOM
+
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("the file is empty")
+		}
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	cols := map[string]int{}
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, required := range []string{"username", "email"} {
+		if _, ok := cols[required]; !ok {
+			return nil, fmt.Errorf("missing %q column", required)
+		}
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(rec) {
+			// Our own export guards cells against formula injection
+			return audit.CSVValue(strings.TrimSpace(rec[i]))
+		}
+		return ""
+	}
+
+	var rows []importRow
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		if len(rows) == maxImportRows {
+			return nil, fmt.Errorf("at most %d users can be imported at once", maxImportRows)
+		}
+		rows = append(rows, importRow{
+			Line:     line,
+			Username: field(rec, "username"),
+			Email:    strings.ToLower(field(rec, "email")),
+			Role:     field(rec, "role"),
+		})
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("the file has no users")
+	}
+	return rows, nil
+}
+
+// validateImport checks every row and counts the valid ones: required
+// fields, email syntax, known roles the importing admin may assign (perms),
+// and duplicates within the file or against existing accounts.
+func validateImport(rows []importRow, perms []string) (*importReport, error) {
+	var emails, usernames []string
+	for _, r := range rows {
+		emails = append(emails, r.Email)
+		usernames = append(usernames, r.Username)
+	}
+	var existingEmails, existingUsernames []string
+	if err := database.DB.Model(&users.User{}).Where("LOWER(email) IN ?", emails).Pluck("LOWER(email)", &existingEmails).Error; err != nil {
+		return nil, err
+	}
+	if err := database.DB.Model(&users.User{}).Where("username IN ?", usernames).Pluck("username", &existingUsernames).Error; err != nil {
+		return nil, err
+	}
+	taken := func(list []string) map[string]bool {
+		m := make(map[string]bool, len(list))
+		for _, s := range list {
+			m[s] = true
+		}
+		return m
+	}
+	takenEmails, takenUsernames := taken(existingEmails), taken(existingUsernames)
+
+	roles := map[string]bool{}
+	assignable := map[string]bool{}
+	for _, name := range rbac.RoleNames() {
+		roles[name] = true
+		ok, err := rbac.CanAssign(perms, name)
+		if err != nil {
+			return nil, err
+		}
+		assignable[name] = ok
+	}
+
+	report := &importReport{}
+	seenEmails, seenUsernames := map[string]int{}, map[string]int{}
+	for _, r := range rows {
+		if r.Role == "" {
+			r.Role = rbac.RoleUser
+		}
+
+		switch {
+		case r.Username == "":
+			r.Errors = append(r.Errors, "username is required")
+		case len(r.Username) < 3 || len(r.Username) > 50:
+			r.Errors = append(r.Errors, "username must be 3 to 50 characters")
+		case takenUsernames[r.Username]:
+			r.Errors = append(r.Errors, "username already exists")
+		case seenUsernames[r.Username] != 0:
+			r.Errors = append(r.Errors, fmt.Sprintf("duplicate username (line %d)", seenUsernames[r.Username]))
+		}
+		if !users.ValidEmail(r.Email) {
+			r.Errors = append(r.Errors, "invalid email")
+		} else if takenEmails[r.Email] {
+			r.Errors = append(r.Errors, "email already exists")
+		} else if seenEmails[r.Email] != 0 {
+			r.Errors = append(r.Errors, fmt.Sprintf("duplicate email (line %d)", seenEmails[r.Email]))
+		}
+		if !roles[r.Role] {
+			r.Errors = append(r.Errors, fmt.Sprintf("unknown role %q", r.Role))
+		} else if !assignable[r.Role] {
+			r.Errors = append(r.Errors, fmt.Sprintf("you cannot assign role %q", r.Role))
+		}
+
+		if seenEmails[r.Email] == 0 {
+			seenEmails[r.Email] = r.Line
+		}
+		if seenUsernames[r.Username] == 0 {
+			seenUsernames[r.Username] = r.Line
+		}
+		if len(r.Errors) == 0 {
+			report.Valid++
+		} else {
+			report.Invalid++
+		}
+		report.Rows = append(report.Rows, r)
+	}
+	return report, nil
+}
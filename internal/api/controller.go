@@ -3,6 +3,7 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/url"
@@ -19,56 +20,89 @@ import (
 // MOVIES
 // ================================
 
+// ListMoviesPublicHandler lists movies with the filters and sort options of
+// parseMovieFilters, one cursor page at a time: without a cursor it returns
+// the first page, plus facet counts for the filter sidebar, and every page
+// returns the next_cursor to continue with.
 func ListMoviesPublicHandler(c *gin.Context) {
+	if rejectOffsetPaging(c) {
+		return
+	}
 
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
-	search := c.Query("search")
-	genre := c.Query("genre")
+	filters, err := parseMovieFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	if page < 1 {
-		page = 1
+	cursor := c.Query("cursor")
+	res, empty, err := movieCursorPage(c, filters, cursor)
+	if err != nil {
+		if errors.Is(err, errInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	if limit < 1 || limit > 100 {
-		limit = 20
+	// Facets and suggestions come with the first page only
+	if cursor != "" {
+		c.JSON(http.StatusOK, res)
+		return
 	}
 
-	offset := (page - 1) * limit
+	if res["facets"], err = movieFacets(filters); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if search := fuzzyText(c.Query("search")); empty && search != "" {
+		suggestions, err := didYouMean(search, 3)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		res["did_you_mean"] = suggestions
+	}
 
-	query := database.DB.Preload("Genres").Preload("Cast.Person")
+	c.JSON(http.StatusOK, res)
+}
 
-	if search != "" {
-		query = query.Where("title ILIKE ?", "%"+search+"%")
-	}
+// movieCursorPage loads the page after cursor (the first page when it is
+// empty) without counting.
+func movieCursorPage(c *gin.Context, filters *movieFilters, cursor string) (gin.H, bool, error) {
+	limit := cursorLimit(c)
 
-	if genre != "" {
-		query = query.Joins("JOIN movie_genres ON movie_genres.movie_id = movies.id").
-			Joins("JOIN genres ON genres.id = movie_genres.genre_id").
-			Where("LOWER(genres.name) = LOWER(?)", genre)
+	query := filters.apply(database.DB.Preload("Genres").Preload("Cast.Person"), "")
+	if cursor != "" {
+		value, id, err := filters.decodeSortValue(cursor)
+		if err != nil {
+			return nil, false, err
+		}
+		query = filters.sort.after(query, value, id)
 	}
 
-	var total int64
-	query.Model(&movies.Movie{}).Count(&total)
-
 	var movieList []movies.Movie
 	if err := query.
-		Offset(offset).
-		Limit(limit).
-		Order("created_at DESC").
+		Limit(limit + 1).
+		Clauses(filters.sort.orderBy()).
 		Find(&movieList).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, false, err
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": movieList,
-		"pagination": gin.H{
-			"page":       page,
-			"limit":      limit,
-			"total":      total,
-			"totalPages": (total + int64(limit) - 1) / int64(limit),
-		},
-	})
+	next := ""
+	if len(movieList) > limit {
+		movieList = movieList[:limit]
+		last := &movieList[limit-1]
+		value, err := filters.sortValue(last)
+		if err != nil {
+			return nil, false, err
+		}
+		if next, err = encodeCursor(filters.sort, value, last.ID); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return gin.H{"data": movieList, "pagination": cursorPagination(limit, next)}, len(movieList) == 0, nil
 }
 
 func GetMoviePublicHandler(c *gin.Context) {
@@ -343,15 +377,44 @@ func GetUserReservationsHandler(c *gin.Context) {
 // GENRES
 // ================================
 
+// ListGenresPublicHandler lists genres by name, a page at a time.
 func ListGenresPublicHandler(c *gin.Context) {
+	if rejectOffsetPaging(c) {
+		return
+	}
+
+	cursor := c.Query("cursor")
+	limit := cursorLimit(c)
+	k := nameKeyset("genres")
+	query := database.DB.Model(&movies.Genre{})
+	if cursor != "" {
+		var name string
+		id, err := decodeCursor(cursor, k, &name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		query = k.after(query, name, id)
+	}
 
 	var genreList []movies.Genre
-	if err := database.DB.Order("name ASC").Find(&genreList).Error; err != nil {
+	if err := query.Clauses(k.orderBy()).Limit(limit + 1).Find(&genreList).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": genreList})
+	next := ""
+	if len(genreList) > limit {
+		genreList = genreList[:limit]
+		last := genreList[limit-1]
+		var err error
+		if next, err = encodeCursor(k, last.Name, last.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": genreList, "pagination": cursorPagination(limit, next)})
 }
 
 func GetGenrePublicHandler(c *gin.Context) {
@@ -379,15 +442,44 @@ func GetGenrePublicHandler(c *gin.Context) {
 // PEOPLE
 // ================================
 
+// ListPeoplePublicHandler lists people by name, a page at a time.
 func ListPeoplePublicHandler(c *gin.Context) {
+	if rejectOffsetPaging(c) {
+		return
+	}
+
+	cursor := c.Query("cursor")
+	limit := cursorLimit(c)
+	k := nameKeyset("people")
+	query := database.DB.Model(&movies.Person{})
+	if cursor != "" {
+		var name string
+		id, err := decodeCursor(cursor, k, &name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		query = k.after(query, name, id)
+	}
 
 	var people []movies.Person
-	if err := database.DB.Order("name ASC").Find(&people).Error; err != nil {
+	if err := query.Clauses(k.orderBy()).Limit(limit + 1).Find(&people).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": people})
+	next := ""
+	if len(people) > limit {
+		people = people[:limit]
+		last := people[limit-1]
+		var err error
+		if next, err = encodeCursor(k, last.Name, last.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": people, "pagination": cursorPagination(limit, next)})
 }
 
 func GetPersonPublicHandler(c *gin.Context) {
@@ -411,33 +503,6 @@ func GetPersonPublicHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"data": person})
 }
 
-// ================================
-// SEARCH
-// ================================
-
-func SearchPublicHandler(c *gin.Context) {
-
-	query := c.Query("q")
-	if query == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "query parameter required"})
-		return
-	}
-
-	searchPattern := "%" + query + "%"
-
-	var movieResults []movies.Movie
-	if err := database.DB.
-		Preload("Genres").
-		Where("title ILIKE ?", searchPattern).
-		Limit(10).
-		Find(&movieResults).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"data": movieResults})
-}
-
 // ================================
 // STATS
 // ================================
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ================================
+// CURSOR PAGINATION
+// ================================
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// keyset is an ORDER BY that can be paged with a cursor: a sort expression
+// followed by the row id, both in the same direction, so every row has a
+// distinct position even when sort values tie.
+type keyset struct {
+	name     string // identifies the order in cursors, e.g. "rating:desc"
+	expr     clause.Expr
+	id       string
+	desc     bool
+	nullable bool // NULLs sort last
+}
+
+func (k keyset) dir() string {
+	if k.desc {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (k keyset) orderBy() clause.OrderBy {
+	nulls := ""
+	if k.nullable {
+		nulls = " NULLS LAST"
+	}
+	return clause.OrderBy{Expression: clause.Expr{
+		SQL:  "? " + k.dir() + nulls + ", " + k.id + " " + k.dir(),
+		Vars: []interface{}{k.expr},
+	}}
+}
+
+// after restricts db to the rows that come after the row with sort value
+// value (nil for NULL) and id.
+func (k keyset) after(db *gorm.DB, value interface{}, id uint) *gorm.DB {
+	op := ">"
+	if k.desc {
+		op = "<"
+	}
+	switch {
+	case value == nil:
+		return db.Where("? IS NULL AND "+k.id+" "+op+" ?", k.expr, id)
+	case k.nullable:
+		return db.Where("((?, "+k.id+") "+op+" (?, ?) OR ? IS NULL)", k.expr, value, id, k.expr)
+	default:
+		return db.Where("(?, "+k.id+") "+op+" (?, ?)", k.expr, value, id)
+	}
+}
+
+// cursorToken is the position of the last row of a page. Clients get it as
+// an opaque base64 string.
+type cursorToken struct {
+	Order string          `json:"o"`
+	Value json.RawMessage `json:"v"`
+	ID    uint            `json:"id"`
+}
+
+func encodeCursor(k keyset, value interface{}, id uint) (string, error) {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(cursorToken{Order: k.name, Value: v, ID: id})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor reads a cursor and its sort value into value, a pointer. A
+// cursor only works with the order it was issued for.
+func decodeCursor(raw string, k keyset, value interface{}) (uint, error) {
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	var tok cursorToken
+	if err := json.Unmarshal(b, &tok); err != nil || tok.Order != k.name || tok.ID == 0 {
+		return 0, errInvalidCursor
+	}
+	if err := json.Unmarshal(tok.Value, value); err != nil {
+		return 0, errInvalidCursor
+	}
+	return tok.ID, nil
+}
+
+// nameKeyset orders people or genres by name.
+func nameKeyset(table string) keyset {
+	return keyset{name: "name:asc", expr: clause.Expr{SQL: table + ".name"}, id: table + ".id"}
+}
+
+// rejectOffsetPaging answers 400 to callers still sending the page parameter
+// of the offset pagination the public lists used to have. Ignoring it would
+// hand them the first page over and over. It returns true when it answered.
+func rejectOffsetPaging(c *gin.Context) bool {
+	if _, ok := c.GetQuery("page"); !ok {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": "page is no longer supported: lists are paginated with cursor, pass pagination.next_cursor of the previous response",
+	})
+	return true
+}
+
+// cursorLimit reads the page size of a cursor-paginated list.
+func cursorLimit(c *gin.Context) int {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	return limit
+}
+
+// cursorPagination describes a page; next is empty on the last page.
+func cursorPagination(limit int, next string) gin.H {
+	p := gin.H{"limit": limit, "next_cursor": nil, "has_more": next != ""}
+	if next != "" {
+		p["next_cursor"] = next
+	}
+	return p
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	released := time.Date(2008, 7, 18, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value interface{}
+		into  func() interface{} // pointer the cursor is decoded into
+		want  interface{}
+	}{
+		{"name", "The Dark Knight", func() interface{} { return new(string) }, "The Dark Knight"},
+		{"empty name", "", func() interface{} { return new(string) }, ""},
+		{"rating", 8.5, func() interface{} { return new(float64) }, 8.5},
+		{"release date", released, func() interface{} { return new(*time.Time) }, &released},
+		{"missing release date", nil, func() interface{} { return new(*time.Time) }, (*time.Time)(nil)},
+	}
+	k := nameKeyset("movies")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := encodeCursor(k, tt.value, 42)
+			if err != nil {
+				t.Fatal(err)
+			}
+			into := tt.into()
+			id, err := decodeCursor(raw, k, into)
+			if err != nil {
+				t.Fatalf("decodeCursor(%q) error = %v", raw, err)
+			}
+			if id != 42 {
+				t.Errorf("id = %d, want 42", id)
+			}
+			if got := reflect.ValueOf(into).Elem().Interface(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("value = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	k := nameKeyset("people")
+	valid, err := encodeCursor(k, "Nolan", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherOrder, err := encodeCursor(keyset{name: "rating:desc"}, 8.5, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noID, err := encodeCursor(k, "Nolan", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"o":"name:asc","v":"a","id":1}`))},
+		{"not JSON", enc("name:asc")},
+		{"other order", otherOrder},
+		{"no id", noID},
+		{"wrong value type", enc(`{"o":"name:asc","v":12,"id":1}`)},
+		{"truncated", valid[:len(valid)-4]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var name string
+			if _, err := decodeCursor(tt.raw, k, &name); err != errInvalidCursor {
+				t.Errorf("decodeCursor(%q) error = %v, want %v", tt.raw, err, errInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestRejectOffsetPaging(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		query      string
+		wantReject bool
+	}{
+		{"", false},
+		{"cursor=abc&limit=10", false},
+		{"page=2", true},
+		{"page=", true},
+		{"limit=10&page=1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/public/movies?"+tt.query, nil)
+			if got := rejectOffsetPaging(c); got != tt.wantReject {
+				t.Fatalf("rejectOffsetPaging() = %v, want %v", got, tt.wantReject)
+			}
+			if tt.wantReject && w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+	}
+}
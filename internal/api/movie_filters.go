@@ -0,0 +1,336 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/movies"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Filter dimensions. A facet is counted with every filter except its own,
+// so picking a genre doesn't hide the other genres from the sidebar.
+const (
+	facetGenres  = "genres"
+	facetDecades = "decades"
+	facetRatings = "ratings"
+	facetMPAA    = "mpaa"
+)
+
+// movieFilters are the filters of the public movie list.
+type movieFilters struct {
+	search     clause.Expr
+	hasSearch  bool
+	genres     []string // lower-case names
+	matchAll   bool
+	yearFrom   int
+	yearTo     int
+	runtimeMin int
+	runtimeMax int
+	minRating  float64
+	mpaa       []string // upper-case
+	personID   uint
+	personRole string
+	sort       keyset
+}
+
+// movieSorts are the sort options with their default direction.
+var movieSorts = map[string]struct {
+	column   string
+	desc     bool
+	nullable bool
+}{
+	"created_at":   {"movies.created_at", true, false},
+	"rating":       {"movies.average_rating", true, false},
+	"release_date": {"movies.release_date", true, true},
+	"title":        {"movies.title", false, false},
+	"popularity":   {"movies.popularity", true, false},
+}
+
+// csvParam splits a comma-separated query parameter.
+func csvParam(c *gin.Context, name string) []string {
+	var values []string
+	for _, v := range strings.Split(c.Query(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// intParam reads an optional non-negative integer parameter.
+func intParam(c *gin.Context, name string) (int, error) {
+	v := c.Query(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return n, nil
+}
+
+// parseMovieFilters reads the list filters and sort order from the query
+// string. Genres are matched by name, any of them by default or all of them
+// with genre_match=all.
+func parseMovieFilters(c *gin.Context) (*movieFilters, error) {
+	f := &movieFilters{}
+	f.search, f.hasSearch = movies.ParseSearch(c.Query("search"), movies.SearchEnglish)
+
+	// Deduplicated, since genre_match=all compares against their count
+	seen := map[string]bool{}
+	for _, g := range append(csvParam(c, "genres"), csvParam(c, "genre")...) {
+		if g = strings.ToLower(g); !seen[g] {
+			seen[g] = true
+			f.genres = append(f.genres, g)
+		}
+	}
+	switch c.DefaultQuery("genre_match", "any") {
+	case "any":
+	case "all":
+		f.matchAll = true
+	default:
+		return nil, fmt.Errorf("genre_match must be any or all")
+	}
+
+	var err error
+	for name, dst := range map[string]*int{
+		"year_from":   &f.yearFrom,
+		"year_to":     &f.yearTo,
+		"runtime_min": &f.runtimeMin,
+		"runtime_max": &f.runtimeMax,
+	} {
+		if *dst, err = intParam(c, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if v := c.Query("min_rating"); v != "" {
+		if f.minRating, err = strconv.ParseFloat(v, 64); err != nil || f.minRating < 0 {
+			return nil, fmt.Errorf("invalid min_rating")
+		}
+	}
+	for _, r := range csvParam(c, "mpaa") {
+		f.mpaa = append(f.mpaa, strings.ToUpper(r))
+	}
+
+	if v := c.Query("person"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid person")
+		}
+		f.personID = uint(id)
+		f.personRole = c.Query("role")
+	}
+
+	if f.sort, err = movieSort(c, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// movieSort builds the ORDER BY. Searches default to relevance, everything
+// else to the newest additions first. Ties are broken by id.
+func movieSort(c *gin.Context, f *movieFilters) (keyset, error) {
+	sort := c.Query("sort")
+	if sort == "" || sort == "relevance" {
+		if f.hasSearch {
+			return keyset{
+				name: "relevance:desc",
+				expr: clause.Expr{SQL: "ts_rank(movies.search_vector, ?)", Vars: []interface{}{f.search}},
+				id:   "movies.id",
+				desc: true,
+			}, nil
+		}
+		sort = "created_at"
+	}
+
+	s, ok := movieSorts[sort]
+	if !ok {
+		return keyset{}, fmt.Errorf("sort must be one of relevance, rating, release_date, title, popularity")
+	}
+	k := keyset{expr: clause.Expr{SQL: s.column}, id: "movies.id", desc: s.desc, nullable: s.nullable}
+	switch c.Query("order") {
+	case "asc":
+		k.desc = false
+	case "desc":
+		k.desc = true
+	}
+	k.name = sort + ":" + strings.ToLower(k.dir())
+	return k, nil
+}
+
+// sortValue is m's value of the sort column, for its cursor.
+func (f *movieFilters) sortValue(m *movies.Movie) (interface{}, error) {
+	switch sort, _, _ := strings.Cut(f.sort.name, ":"); sort {
+	case "relevance":
+		var rank float64
+		err := database.DB.Raw("SELECT ts_rank(search_vector, ?) FROM movies WHERE id = ?", f.search, m.ID).Scan(&rank).Error
+		return rank, err
+	case "rating":
+		return m.AverageRating, nil
+	case "release_date":
+		if m.ReleaseDate == nil {
+			return nil, nil
+		}
+		return *m.ReleaseDate, nil
+	case "title":
+		return m.Title, nil
+	case "popularity":
+		return m.Popularity, nil
+	default:
+		return m.CreatedAt, nil
+	}
+}
+
+// decodeSortValue reads the sort value of a movie cursor.
+func (f *movieFilters) decodeSortValue(cursor string) (interface{}, uint, error) {
+	switch sort, _, _ := strings.Cut(f.sort.name, ":"); sort {
+	case "title":
+		var v string
+		id, err := decodeCursor(cursor, f.sort, &v)
+		return v, id, err
+	case "relevance", "rating", "popularity":
+		var v float64
+		id, err := decodeCursor(cursor, f.sort, &v)
+		return v, id, err
+	default:
+		var v *time.Time
+		id, err := decodeCursor(cursor, f.sort, &v)
+		if v == nil {
+			if !f.sort.nullable && err == nil {
+				err = errInvalidCursor
+			}
+			return nil, id, err
+		}
+		return *v, id, err
+	}
+}
+
+// apply adds every filter except the except dimension to db, a query on
+// movies.
+func (f *movieFilters) apply(db *gorm.DB, except string) *gorm.DB {
+	if f.hasSearch {
+		db = db.Where("movies.search_vector @@ ?", f.search)
+	}
+	if len(f.genres) > 0 && except != facetGenres {
+		genreMatches := "SELECT COUNT(DISTINCT LOWER(g.name)) FROM movie_genres mg JOIN genres g ON g.id = mg.genre_id " +
+			"WHERE mg.movie_id = movies.id AND LOWER(g.name) IN ?"
+		if f.matchAll {
+			db = db.Where("("+genreMatches+") = ?", f.genres, len(f.genres))
+		} else {
+			db = db.Where("("+genreMatches+") > 0", f.genres)
+		}
+	}
+	if except != facetDecades {
+		if f.yearFrom > 0 {
+			db = db.Where("movies.release_date >= ?", time.Date(f.yearFrom, 1, 1, 0, 0, 0, 0, time.UTC))
+		}
+		if f.yearTo > 0 {
+			db = db.Where("movies.release_date < ?", time.Date(f.yearTo+1, 1, 1, 0, 0, 0, 0, time.UTC))
+		}
+	}
+	if f.runtimeMin > 0 {
+		db = db.Where("movies.duration_minutes >= ?", f.runtimeMin)
+	}
+	if f.runtimeMax > 0 {
+		db = db.Where("movies.duration_minutes <= ?", f.runtimeMax)
+	}
+	if f.minRating > 0 && except != facetRatings {
+		db = db.Where("movies.average_rating >= ?", f.minRating)
+	}
+	if len(f.mpaa) > 0 && except != facetMPAA {
+		db = db.Where("UPPER(movies.mpaa_rating) IN ?", f.mpaa)
+	}
+	if f.personID != 0 {
+		if f.personRole != "" {
+			db = db.Where("EXISTS (SELECT 1 FROM movie_people mp WHERE mp.movie_id = movies.id AND mp.person_id = ? AND LOWER(mp.role) = LOWER(?))",
+				f.personID, f.personRole)
+		} else {
+			db = db.Where("EXISTS (SELECT 1 FROM movie_people mp WHERE mp.movie_id = movies.id AND mp.person_id = ?)", f.personID)
+		}
+	}
+	return db
+}
+
+// ================================
+// FACETS
+// ================================
+
+type genreFacet struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type decadeFacet struct {
+	Decade int   `json:"decade"`
+	Count  int64 `json:"count"`
+}
+
+// ratingFacet counts movies rated from Rating up to the next whole number.
+type ratingFacet struct {
+	Rating int   `json:"rating"`
+	Count  int64 `json:"count"`
+}
+
+type mpaaFacet struct {
+	Rating string `json:"rating"`
+	Count  int64  `json:"count"`
+}
+
+// movieFacets counts the filtered movies per genre, release decade, average
+// rating (whole stars) and MPAA rating.
+func movieFacets(f *movieFilters) (gin.H, error) {
+	filtered := func(except string) *gorm.DB {
+		return f.apply(database.DB.Model(&movies.Movie{}), except)
+	}
+
+	genres := []genreFacet{}
+	if err := database.DB.Table("genres").
+		Select("genres.id, genres.name, COUNT(*) AS count").
+		Joins("JOIN movie_genres ON movie_genres.genre_id = genres.id").
+		Where("movie_genres.movie_id IN (?)", filtered(facetGenres).Select("movies.id")).
+		Group("genres.id, genres.name").
+		Order("count DESC, genres.name").
+		Scan(&genres).Error; err != nil {
+		return nil, err
+	}
+
+	decades := []decadeFacet{}
+	if err := filtered(facetDecades).
+		Select("(EXTRACT(YEAR FROM movies.release_date)::int / 10 * 10) AS decade, COUNT(*) AS count").
+		Where("movies.release_date IS NOT NULL").
+		Group("decade").
+		Order("decade DESC").
+		Scan(&decades).Error; err != nil {
+		return nil, err
+	}
+
+	ratings := []ratingFacet{}
+	if err := filtered(facetRatings).
+		Select("FLOOR(movies.average_rating)::int AS rating, COUNT(*) AS count").
+		Group("rating").
+		Order("rating DESC").
+		Scan(&ratings).Error; err != nil {
+		return nil, err
+	}
+
+	mpaa := []mpaaFacet{}
+	if err := filtered(facetMPAA).
+		Select("UPPER(movies.mpaa_rating) AS rating, COUNT(*) AS count").
+		Where("movies.mpaa_rating <> ''").
+		Group("UPPER(movies.mpaa_rating)").
+		Order("count DESC, rating").
+		Scan(&mpaa).Error; err != nil {
+		return nil, err
+	}
+
+	return gin.H{"genres": genres, "decades": decades, "ratings": ratings, "mpaa": mpaa}, nil
+}
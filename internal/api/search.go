@@ -0,0 +1,345 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/movies"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ================================
+// SEARCH
+// ================================
+
+// movieHighlight holds HTML snippets with the matched words in <mark>.
+type movieHighlight struct {
+	Title    string `json:"title"`
+	Synopsis string `json:"synopsis"`
+}
+
+type movieHit struct {
+	movies.Movie
+	Rank      float64        `json:"rank"`
+	Highlight movieHighlight `json:"highlight"`
+}
+
+// movieRow is a ranked match before the movie itself is loaded.
+type movieRow struct {
+	ID               uint
+	Rank             float64
+	TitleHeadline    string
+	SynopsisHeadline string
+}
+
+// searchMovies returns the best limit movies for a ParseSearch expression,
+// ranked by ts_rank. Snippets are only built for the returned rows.
+func searchMovies(query clause.Expr, limit int) ([]movieHit, error) {
+	var rows []movieRow
+	if err := database.DB.Raw(`
+SELECT id, rank,
+	ts_headline('english_unaccent', title, query, ?) AS title_headline,
+	ts_headline('english_unaccent', coalesce(synopsis, ''), query, ?) AS synopsis_headline
+FROM (
+	SELECT movies.id, movies.title, movies.synopsis, q.query, ts_rank(movies.search_vector, q.query) AS rank
+	FROM movies, (SELECT ? AS query) q
+	WHERE movies.search_vector @@ q.query
+	ORDER BY rank DESC, movies.id
+	LIMIT ?
+) hits
+ORDER BY rank DESC, id`,
+		movies.TitleHeadlineOptions, movies.SnippetHeadlineOptions, query, limit).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return loadMovieHits(rows)
+}
+
+// loadMovieHits loads the movies of rows, keeping their order.
+func loadMovieHits(rows []movieRow) ([]movieHit, error) {
+	if len(rows) == 0 {
+		return []movieHit{}, nil
+	}
+
+	ids := make([]uint, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+	var list []movies.Movie
+	if err := database.DB.Preload("Genres").Where("id IN ?", ids).Find(&list).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]movies.Movie, len(list))
+	for _, m := range list {
+		byID[m.ID] = m
+	}
+
+	hits := make([]movieHit, 0, len(rows))
+	for _, r := range rows {
+		m, ok := byID[r.ID]
+		if !ok {
+			continue // deleted in between
+		}
+		hits = append(hits, movieHit{
+			Movie: m,
+			Rank:  r.Rank,
+			Highlight: movieHighlight{
+				Title:    movies.Highlight(r.TitleHeadline),
+				Synopsis: movies.Highlight(r.SynopsisHeadline),
+			},
+		})
+	}
+	return hits, nil
+}
+
+// nameHit is a person or genre matched by name.
+type nameHit struct {
+	ID        uint    `json:"id"`
+	Name      string  `json:"name"`
+	ImageURL  string  `json:"profile_image_url,omitempty"`
+	Rank      float64 `json:"rank"`
+	Highlight string  `json:"highlight"`
+}
+
+// searchNames ranks the rows of table (people or genres) whose name matches
+// a SearchSimple query.
+func searchNames(table string, query clause.Expr, limit int) ([]nameHit, error) {
+	image, live := "''", "TRUE"
+	if table == "people" {
+		image, live = "profile_image_url", "deleted_at IS NULL"
+	}
+
+	hits := []nameHit{}
+	err := database.DB.Raw(`
+SELECT id, name, `+image+` AS image_url, ts_rank(to_tsvector('simple_unaccent', name), q.query) AS rank,
+	ts_headline('simple_unaccent', name, q.query, ?) AS highlight
+FROM `+table+`, (SELECT ? AS query) q
+WHERE to_tsvector('simple_unaccent', name) @@ q.query AND `+live+`
+ORDER BY rank DESC, length(name), id
+LIMIT ?`,
+		movies.TitleHeadlineOptions, query, limit).
+		Scan(&hits).Error
+	for i := range hits {
+		hits[i].Highlight = movies.Highlight(hits[i].Highlight)
+	}
+	return hits, err
+}
+
+// SearchPublicHandler runs a full-text search over titles, cast and crew
+// names and synopses. See movies.ParseSearch for the query syntax. With
+// mode=all it answers with movies, people and genres grouped, each ranked
+// and capped at limit.
+//
+// When nothing matches exactly, titles and names spelled similarly are
+// returned instead ("fuzzy": true) together with "did_you_mean" suggestions.
+func SearchPublicHandler(c *gin.Context) {
+
+	q := c.Query("q")
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query parameter required"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit < 1 || limit > 50 {
+		limit = 10
+	}
+	grouped := c.Query("mode") == "all"
+
+	hits, people, genres := []movieHit{}, []nameHit{}, []nameHit{}
+	var err error
+	if expr, ok := movies.ParseSearch(q, movies.SearchEnglish); ok {
+		if hits, err = searchMovies(expr, limit); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	// Names are matched without stemming
+	if nameExpr, ok := movies.ParseSearch(q, movies.SearchSimple); ok && grouped {
+		if people, err = searchNames("people", nameExpr, limit); err == nil {
+			genres, err = searchNames("genres", nameExpr, limit)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	res := gin.H{"fuzzy": false}
+	text := fuzzyText(q)
+	if len(hits) == 0 && len(people) == 0 && len(genres) == 0 && text != "" {
+		hits, err = fuzzyMovies(text, limit)
+		if err == nil && grouped {
+			people, err = fuzzyPeople(text, limit)
+		}
+		var suggestions []string
+		if err == nil {
+			suggestions, err = didYouMean(text, 3)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		res["fuzzy"] = len(hits) > 0 || len(people) > 0
+		res["did_you_mean"] = suggestions
+	}
+
+	if grouped {
+		res["data"] = gin.H{"movies": hits, "people": people, "genres": genres}
+	} else {
+		res["data"] = hits
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// ================================
+// FUZZY MATCHING
+// ================================
+
+// similarityThreshold is the pg_trgm word similarity (0-1) a title or name
+// needs to count as a fuzzy match (SEARCH_SIMILARITY_THRESHOLD).
+func similarityThreshold() float64 {
+	if v := os.Getenv("SEARCH_SIMILARITY_THRESHOLD"); v != "" {
+		if t, err := strconv.ParseFloat(v, 64); err == nil && t > 0 && t <= 1 {
+			return t
+		}
+	}
+	return 0.5
+}
+
+// withSimilarity runs fn in a transaction where the trigram <% operator
+// uses similarityThreshold, so the trigram indexes still apply.
+func withSimilarity(fn func(tx *gorm.DB) error) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT set_config('pg_trgm.word_similarity_threshold', ?, true)",
+			strconv.FormatFloat(similarityThreshold(), 'f', -1, 64)).Error; err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// fuzzyText strips the search syntax from q.
+func fuzzyText(q string) string {
+	return strings.Join(strings.Fields(strings.NewReplacer(`"`, " ", "*", " ").Replace(q)), " ")
+}
+
+// fuzzyMovies returns the movies whose title is spelled like text, most
+// similar first.
+func fuzzyMovies(text string, limit int) ([]movieHit, error) {
+	var rows []movieRow
+	err := withSimilarity(func(tx *gorm.DB) error {
+		return tx.Raw(`
+SELECT id, word_similarity(q.text, search_normalize(title)) AS rank, title AS title_headline
+FROM movies, (SELECT search_normalize(?) AS text) q
+WHERE q.text <% search_normalize(title)
+ORDER BY rank DESC, length(title), id
+LIMIT ?`, text, limit).Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loadMovieHits(rows)
+}
+
+// fuzzyPeople returns the people whose name is spelled like text.
+func fuzzyPeople(text string, limit int) ([]nameHit, error) {
+	hits := []nameHit{}
+	err := withSimilarity(func(tx *gorm.DB) error {
+		return tx.Raw(`
+SELECT id, name, profile_image_url AS image_url, word_similarity(q.text, search_normalize(name)) AS rank, name AS highlight
+FROM people, (SELECT search_normalize(?) AS text) q
+WHERE q.text <% search_normalize(name) AND deleted_at IS NULL
+ORDER BY rank DESC, length(name), id
+LIMIT ?`, text, limit).Scan(&hits).Error
+	})
+	for i := range hits {
+		hits[i].Highlight = movies.Highlight(hits[i].Highlight)
+	}
+	return hits, err
+}
+
+// didYouMean suggests up to n titles or names close to text.
+func didYouMean(text string, n int) ([]string, error) {
+	suggestions := []string{}
+	err := withSimilarity(func(tx *gorm.DB) error {
+		return tx.Raw(`
+WITH q AS (SELECT search_normalize(?) AS text)
+SELECT label FROM (
+	SELECT m.title AS label, word_similarity(q.text, search_normalize(m.title)) AS score
+	FROM movies m, q WHERE q.text <% search_normalize(m.title)
+	UNION ALL
+	SELECT p.name, word_similarity(q.text, search_normalize(p.name))
+	FROM people p, q WHERE q.text <% search_normalize(p.name) AND p.deleted_at IS NULL
+) s
+GROUP BY label
+ORDER BY max(score) DESC, length(label)
+LIMIT ?`, text, n).Scan(&suggestions).Error
+	})
+	return suggestions, err
+}
+
+// ================================
+// AUTOCOMPLETE
+// ================================
+
+// suggestion is one autocomplete entry. Type is "movie", "person" or "genre".
+type suggestion struct {
+	ID        uint    `json:"id"`
+	Type      string  `json:"type"`
+	Label     string  `json:"label"`
+	Thumbnail string  `json:"thumbnail,omitempty"`
+	Rank      float64 `json:"-"`
+}
+
+// AutocompleteHandler suggests movies, people and genres whose title or name
+// starts with the words typed so far, in a single indexed query. Short
+// answers are cacheable for a minute.
+func AutocompleteHandler(c *gin.Context) {
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "8"))
+	if limit < 1 || limit > 20 {
+		limit = 8
+	}
+
+	expr, ok := movies.ParsePrefix(c.Query("q"))
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"data": []suggestion{}})
+		return
+	}
+
+	results := []suggestion{}
+	if err := database.DB.Raw(`
+WITH q AS (SELECT ? AS query)
+SELECT * FROM (
+	(SELECT m.id, 'movie' AS type, m.title AS label, m.poster_url AS thumbnail,
+		ts_rank(to_tsvector('simple_unaccent', m.title), q.query) AS rank
+	FROM movies m, q WHERE to_tsvector('simple_unaccent', m.title) @@ q.query
+	ORDER BY rank DESC LIMIT ?)
+	UNION ALL
+	(SELECT p.id, 'person', p.name, p.profile_image_url,
+		ts_rank(to_tsvector('simple_unaccent', p.name), q.query) AS rank
+	FROM people p, q WHERE to_tsvector('simple_unaccent', p.name) @@ q.query AND p.deleted_at IS NULL
+	ORDER BY rank DESC LIMIT ?)
+	UNION ALL
+	(SELECT g.id, 'genre', g.name, '',
+		ts_rank(to_tsvector('simple_unaccent', g.name), q.query) AS rank
+	FROM genres g, q WHERE to_tsvector('simple_unaccent', g.name) @@ q.query
+	ORDER BY rank DESC LIMIT ?)
+) s
+ORDER BY rank DESC, length(label), label
+LIMIT ?`,
+		expr, limit, limit, limit, limit).
+		Scan(&results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=60")
+	c.JSON(http.StatusOK, gin.H{"data": results})
+}
@@ -0,0 +1,177 @@
+package audit
+
+import (
+	"encoding/csv"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const pageSize = 50
+
+// filterKeys are the query parameters understood by the audit page and the
+// CSV export.
+var filterKeys = []string{"q", "actor", "action", "entity_type", "entity_id", "from", "to"}
+
+// filteredQuery applies the audit page filters. from/to are dates
+// (YYYY-MM-DD), to is inclusive.
+func filteredQuery(c *gin.Context) *gorm.DB {
+	q := database.DB.Model(&Entry{})
+
+	if s := strings.TrimSpace(c.Query("q")); s != "" {
+		like := "%" + s + "%"
+		q = q.Where("action ILIKE ? OR entity_type ILIKE ? OR entity_id ILIKE ? OR actor_id IN (?) OR diff::text ILIKE ?",
+			like, like, like, usersByEmail(like), like)
+	}
+	if actor := strings.TrimSpace(c.Query("actor")); actor != "" {
+		if id, err := strconv.ParseUint(actor, 10, 64); err == nil {
+			q = q.Where("actor_id = ?", id)
+		} else {
+			q = q.Where("actor_id IN (?)", usersByEmail("%"+actor+"%"))
+		}
+	}
+	if action := strings.TrimSpace(c.Query("action")); action != "" {
+		q = q.Where("action LIKE ?", action+"%")
+	}
+	if entityType := c.Query("entity_type"); entityType != "" {
+		q = q.Where("entity_type = ?", entityType)
+	}
+	if entityID := strings.TrimSpace(c.Query("entity_id")); entityID != "" {
+		q = q.Where("entity_id = ?", entityID)
+	}
+	if from, err := time.ParseInLocation("2006-01-02", c.Query("from"), time.Local); err == nil {
+		q = q.Where("created_at >= ?", from)
+	}
+	if to, err := time.ParseInLocation("2006-01-02", c.Query("to"), time.Local); err == nil {
+		q = q.Where("created_at < ?", to.AddDate(0, 0, 1))
+	}
+	return q
+}
+
+// usersByEmail selects the ids of the users whose email matches pattern.
+func usersByEmail(pattern string) *gorm.DB {
+	return database.DB.Table("users").Select("id").Where("email ILIKE ?", pattern)
+}
+
+// withActorEmail adds the actor's current email to the selected entries.
+// Actors whose account is gone are shown by id.
+func withActorEmail(q *gorm.DB) *gorm.DB {
+	return q.Select("audit_log.*, (SELECT email FROM users WHERE users.id = audit_log.actor_id) AS actor_email")
+}
+
+// filterQueryString keeps the active filters for pagination and export links.
+// It is already encoded, so it is marked safe for href attributes.
+func filterQueryString(c *gin.Context) template.URL {
+	v := url.Values{}
+	for _, k := range filterKeys {
+		if s := c.Query(k); s != "" {
+			v.Set(k, s)
+		}
+	}
+	return template.URL(v.Encode())
+}
+
+// ListAuditHandler renders the searchable audit log.
+func ListAuditHandler(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+
+	var total int64
+	if err := filteredQuery(c).Count(&total).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	var entries []Entry
+	if err := withActorEmail(filteredQuery(c)).Order("id DESC").Limit(pageSize).Offset((page - 1) * pageSize).
+		Find(&entries).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	var entityTypes []string
+	database.DB.Model(&Entry{}).Distinct().Order("entity_type").Pluck("entity_type", &entityTypes)
+
+	filters := gin.H{}
+	for _, k := range filterKeys {
+		filters[k] = c.Query(k)
+	}
+
+	failed, lastFailed := Failures()
+
+	c.HTML(http.StatusOK, "audit.html", gin.H{
+		"title":       "Audit Log",
+		"entries":     entries,
+		"entityTypes": entityTypes,
+		"filters":     filters,
+		"query":       filterQueryString(c),
+		"total":       total,
+		"page":        page,
+		"hasPrev":     page > 1,
+		"hasNext":     int64(page*pageSize) < total,
+		"failures":    failed,
+		"lastFailure": lastFailed,
+	})
+}
+
+// ExportAuditHandler streams the filtered audit log as CSV.
+func ExportAuditHandler(c *gin.Context) {
+	rows, err := withActorEmail(filteredQuery(c)).Order("id ASC").Rows()
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", "attachment; filename=audit-"+time.Now().Format("20060102-150405")+".csv")
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "created_at", "actor_id", "actor_email", "action", "entity_type", "entity_id", "ip", "diff", "before", "after"})
+	for rows.Next() {
+		var e Entry
+		if err := database.DB.ScanRows(rows, &e); err != nil {
+			break
+		}
+		w.Write([]string{
+			strconv.FormatUint(uint64(e.ID), 10),
+			e.CreatedAt.Format(time.RFC3339),
+			strconv.FormatUint(uint64(e.ActorID), 10),
+			CSVCell(e.ActorEmail),
+			e.Action,
+			e.EntityType,
+			CSVCell(e.EntityID),
+			e.IP,
+			e.Diff,
+			e.Before,
+			e.After,
+		})
+	}
+	w.Flush()
+}
+
+// CSVCell stops spreadsheet apps from evaluating user-supplied values as
+// formulas.
+func CSVCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// CSVValue undoes CSVCell, so exported files can be read back in.
+func CSVValue(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune("=+-@", rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
@@ -0,0 +1,253 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var ErrAppendOnly = errors.New("audit log entries cannot be changed")
+
+var (
+	failures    atomic.Int64
+	lastFailure atomic.Int64 // unix seconds
+)
+
+// Failures returns how many entries could not be written since startup and
+// when the last one failed (zero if none did).
+func Failures() (int64, time.Time) {
+	n := failures.Load()
+	if n == 0 {
+		return 0, time.Time{}
+	}
+	return n, time.Unix(lastFailure.Load(), 0)
+}
+
+// Entry is one mutating admin action. Entries are append-only: the model
+// refuses updates and deletes, and so does a trigger on the table. Since they
+// outlive erased accounts, people are recorded by id only; IP is kept
+// verbatim for investigating incidents.
+type Entry struct {
+	ID      uint `gorm:"primaryKey"`
+	ActorID uint `gorm:"index"`
+	// ActorEmail is the actor's current email, looked up by withActorEmail
+	// and never stored
+	ActorEmail string    `gorm:"->;-:migration"`
+	Action     string    `gorm:"size:50;not null;index"`
+	EntityType string    `gorm:"size:50;not null;index:idx_audit_entity"`
+	EntityID   string    `gorm:"size:100;index:idx_audit_entity"`
+	Before     string    `gorm:"type:jsonb"`
+	After      string    `gorm:"type:jsonb"`
+	Diff       string    `gorm:"type:jsonb"`
+	IP         string    `gorm:"size:64"`
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+func (Entry) TableName() string {
+	return "audit_log"
+}
+
+func (e *Entry) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAppendOnly
+}
+
+func (e *Entry) BeforeDelete(tx *gorm.DB) error {
+	return ErrAppendOnly
+}
+
+// Change is the before and after value of one field.
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// redacted fields are replaced with a fingerprint, so the log shows that
+// they changed but not their value.
+var redacted = map[string]bool{
+	"PasswordHash":  true,
+	"password_hash": true,
+	"SecretHash":    true,
+	"KeyHash":       true,
+	"TokenHash":     true,
+}
+
+// fingerprintKey keys the HMAC behind fingerprints (AUDIT_FINGERPRINT_KEY).
+// A plain hash could be reversed with a list of known usernames or
+// addresses; without the key these can't be. Since the key is configured,
+// the same value keeps the same fingerprint across restarts and instances,
+// so a change can be followed from one entry to the next.
+var fingerprintKey []byte
+
+// minFingerprintKeyLen is the shortest AUDIT_FINGERPRINT_KEY accepted.
+const minFingerprintKeyLen = 32
+
+func loadFingerprintKey() error {
+	key := os.Getenv("AUDIT_FINGERPRINT_KEY")
+	if len(key) < minFingerprintKeyLen {
+		return fmt.Errorf("AUDIT_FINGERPRINT_KEY must be set to at least %d random characters", minFingerprintKeyLen)
+	}
+	fingerprintKey = []byte(key)
+	return nil
+}
+
+// personal fields identify a person. Like secrets they are stored as a
+// fingerprint, so the log keeps no one's name or address. The client IP of
+// each action is still stored as is, see Entry.
+var personal = map[string]bool{
+	"Username":   true,
+	"username":   true,
+	"Email":      true,
+	"email":      true,
+	"AvatarURL":  true,
+	"avatar_url": true,
+}
+
+// InitializeAuditLog loads the fingerprint key and installs the trigger that keeps audit_log append-only
+// even for queries that bypass the model. It also drops the actor_email
+// column of earlier versions, which kept admins' addresses after erasure.
+func InitializeAuditLog() error {
+	if err := loadFingerprintKey(); err != nil {
+		return err
+	}
+	return database.DB.Exec(`
+ALTER TABLE audit_log DROP COLUMN IF EXISTS actor_email;
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only
+	BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+`).Error
+}
+
+// Record appends an entry for an admin action. before and after are the
+// entity as it was and as it is now (nil for creates and deletes); only the
+// fields that differ go into the diff. The actor comes from RequireAuth; for
+// impersonated requests it is the admin, not the user.
+//
+// Failures are never returned, so auditing can't break the action. They are
+// logged with an ALERT prefix and counted, see Failures.
+func Record(c *gin.Context, action, entityType string, entityID interface{}, before, after interface{}) {
+	beforeMap, err := toMap(before)
+	if err != nil {
+		log.Printf("audit: %s: encode before: %v", action, err)
+	}
+	afterMap, err := toMap(after)
+	if err != nil {
+		log.Printf("audit: %s: encode after: %v", action, err)
+	}
+
+	diff := Diff(beforeMap, afterMap)
+	if before != nil && after != nil && len(diff) == 0 {
+		return
+	}
+
+	actorID, actorEmail := c.GetUint("user_id"), c.GetString("user_email")
+	if id := c.GetUint("impersonator_id"); id != 0 {
+		actorID, actorEmail = id, c.GetString("impersonator_email")
+	}
+
+	entry := Entry{
+		ActorID:    actorID,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   fmt.Sprint(entityID),
+		Before:     jsonOrNull(beforeMap),
+		After:      jsonOrNull(afterMap),
+		Diff:       jsonOrNull(diff),
+		IP:         c.ClientIP(),
+	}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		n := failures.Add(1)
+		lastFailure.Store(time.Now().Unix())
+		log.Printf("ALERT audit: failed to record %s on %s %v by %s (%d failures since startup): %v",
+			action, entityType, entityID, actorEmail, n, err)
+	}
+}
+
+// ignoredInDiff are bookkeeping fields that change on every save.
+var ignoredInDiff = map[string]bool{
+	"UpdatedAt":  true,
+	"updated_at": true,
+}
+
+// Diff compares two snapshots field by field.
+func Diff(before, after map[string]interface{}) map[string]Change {
+	diff := map[string]Change{}
+	for k, v := range before {
+		if ignoredInDiff[k] {
+			continue
+		}
+		if w, ok := after[k]; !ok || !reflect.DeepEqual(v, w) {
+			diff[k] = Change{Before: v, After: after[k]}
+		}
+	}
+	for k, w := range after {
+		if _, ok := before[k]; !ok && !ignoredInDiff[k] {
+			diff[k] = Change{After: w}
+		}
+	}
+	return diff
+}
+
+// toMap turns a snapshot into its JSON object form, without redacted or
+// personal fields.
+func toMap(v interface{}) (map[string]interface{}, error) {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	for k, v := range m {
+		if redacted[k] || personal[k] || strings.HasSuffix(k, "Secret") {
+			m[k] = fingerprint(v)
+		}
+	}
+	return m, nil
+}
+
+func fingerprint(v interface{}) string {
+	s, _ := v.(string)
+	if s == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(s))
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+func jsonOrNull(v interface{}) string {
+	if reflect.ValueOf(v).Len() == 0 {
+		return "null"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "null"
+	}
+	return string(data)
+}
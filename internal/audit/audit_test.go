@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestToMapHidesPersonalFields(t *testing.T) {
+	type user struct {
+		ID           uint
+		Username     string
+		Email        string
+		AvatarURL    string
+		Role         string
+		PasswordHash string
+	}
+	m, err := toMap(user{ID: 3, Username: "ana", Email: "ana@example.com", AvatarURL: "/uploads/a.png", Role: "admin", PasswordHash: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"Username", "Email", "AvatarURL", "PasswordHash"} {
+		if s, _ := m[k].(string); !strings.HasPrefix(s, "redacted:") {
+			t.Errorf("%s = %v, want a fingerprint", k, m[k])
+		}
+	}
+	if m["Role"] != "admin" || m["ID"] != float64(3) {
+		t.Errorf("other fields changed: %v", m)
+	}
+
+	// A changed address still shows up in the diff
+	other, _ := toMap(user{ID: 3, Username: "ana", Email: "ana@example.org", AvatarURL: "/uploads/a.png", Role: "admin", PasswordHash: "x"})
+	diff := Diff(m, other)
+	if _, ok := diff["Email"]; !ok || len(diff) != 1 {
+		t.Errorf("Diff() = %v, want only Email", diff)
+	}
+}
+
+func TestFingerprintIsKeyed(t *testing.T) {
+	t.Setenv("AUDIT_FINGERPRINT_KEY", strings.Repeat("k", minFingerprintKeyLen))
+	if err := loadFingerprintKey(); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("ana@example.com"))
+	got := fingerprint("ana@example.com")
+	if got == "redacted:"+hex.EncodeToString(sum[:4]) {
+		t.Errorf("fingerprint() = %s, an unkeyed hash of the value", got)
+	}
+	if again := fingerprint("ana@example.com"); again != got {
+		t.Errorf("fingerprint() = %s then %s, want the same value", got, again)
+	}
+	if fingerprint("") != "" {
+		t.Error("fingerprint(\"\") should stay empty")
+	}
+}
+
+func TestCSVCellRoundTrip(t *testing.T) {
+	tests := []struct {
+		in, cell string
+	}{
+		{"neo", "neo"},
+		{"", ""},
+		{"-neo", "'-neo"},
+		{"+x@y.com", "'+x@y.com"},
+		{"=SUM(A1)", "'=SUM(A1)"},
+		{"@home", "'@home"},
+		{"'quoted", "'quoted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := CSVCell(tt.in); got != tt.cell {
+				t.Errorf("CSVCell(%q) = %q, want %q", tt.in, got, tt.cell)
+			}
+			if got := CSVValue(tt.cell); got != tt.in {
+				t.Errorf("CSVValue(%q) = %q, want %q", tt.cell, got, tt.in)
+			}
+		})
+	}
+}
+
+func TestLoadFingerprintKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"unset", "", true},
+		{"too short", "secret", true},
+		{"long enough", strings.Repeat("k", minFingerprintKeyLen), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AUDIT_FINGERPRINT_KEY", tt.key)
+			if err := loadFingerprintKey(); (err != nil) != tt.wantErr {
+				t.Errorf("loadFingerprintKey() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
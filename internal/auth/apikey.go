@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/throttle"
+	"gorm.io/gorm"
+)
+
+// apiKeyPrefix makes keys recognizable in configs and secret scanners.
+const apiKeyPrefix = "cmk_"
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrAPIKeyExpired = errors.New("API key expired")
+	ErrAPIKeyRevoked = errors.New("API key revoked")
+)
+
+// API key scopes.
+const (
+	ScopeCatalogRead      = "catalog:read"
+	ScopeTokensIntrospect = "tokens:introspect"
+)
+
+// APIKeyScopes are the scopes an admin can grant to a key.
+var APIKeyScopes = []struct {
+	Name        string
+	Description string
+}{
+	{ScopeCatalogRead, "Use the public catalog API (movies, genres, people, search)"},
+	{ScopeTokensIntrospect, "Introspect user access tokens"},
+}
+
+// APIKey is an admin-issued credential for services and partners. Only the
+// SHA-256 digest is stored; Prefix is kept so admins can tell keys apart.
+type APIKey struct {
+	ID          uint   `gorm:"primaryKey"`
+	Name        string `gorm:"size:100;not null"`
+	Prefix      string `gorm:"size:16;not null"`
+	KeyHash     string `gorm:"size:64;uniqueIndex;not null"`
+	Scopes      string `gorm:"type:text"`
+	RateLimit   int    `gorm:"not null;default:0"` // requests per minute, 0 = unlimited
+	CreatedByID uint
+	ExpiresAt   *time.Time
+	LastUsedAt  *time.Time
+	LastUsedIP  string `gorm:"size:64"`
+	RevokedAt   *time.Time
+	CreatedAt   time.Time
+}
+
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) Expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+func (k *APIKey) Active() bool {
+	return k.RevokedAt == nil && !k.Expired()
+}
+
+// CreateAPIKey stores a new key and returns it together with the raw secret,
+// which is shown once and never stored.
+func CreateAPIKey(name string, scopes []string, expiresAt *time.Time, rateLimit int, createdBy uint) (*APIKey, string, error) {
+	for _, s := range scopes {
+		if !validScope(s) {
+			return nil, "", fmt.Errorf("unknown scope %q", s)
+		}
+	}
+
+	token, _, err := NewOpaqueToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("generate key: %w", err)
+	}
+	raw := apiKeyPrefix + token
+
+	key := APIKey{
+		Name:        name,
+		Prefix:      raw[:len(apiKeyPrefix)+6],
+		KeyHash:     HashOpaqueToken(raw),
+		Scopes:      strings.Join(scopes, " "),
+		RateLimit:   rateLimit,
+		CreatedByID: createdBy,
+		ExpiresAt:   expiresAt,
+	}
+	if err := database.DB.Create(&key).Error; err != nil {
+		return nil, "", fmt.Errorf("store key: %w", err)
+	}
+	return &key, raw, nil
+}
+
+// RevokeAPIKey disables a key immediately.
+func RevokeAPIKey(id uint) error {
+	return database.DB.Model(&APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now()).Error
+}
+
+// LookupAPIKey resolves a raw key and records its use.
+func LookupAPIKey(raw, clientIP string) (*APIKey, error) {
+	if !strings.HasPrefix(raw, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	var key APIKey
+	if err := database.DB.Where("key_hash = ?", HashOpaqueToken(raw)).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrAPIKeyRevoked
+	}
+	if key.Expired() {
+		return nil, ErrAPIKeyExpired
+	}
+
+	// Only write last-used once a minute per key
+	now := time.Now()
+	database.DB.Model(&APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", key.ID, now.Add(-time.Minute)).
+		Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": clientIP})
+
+	return &key, nil
+}
+
+func validScope(scope string) bool {
+	for _, s := range APIKeyScopes {
+		if s.Name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ================================
+// RATE LIMIT
+// ================================
+
+// allowAPIKeyRequest counts a request against the key's per-minute limit
+// and returns how long to wait when it is over. The counters are shared by
+// every Core instance.
+func allowAPIKeyRequest(key *APIKey) (bool, time.Duration, error) {
+	if key.RateLimit <= 0 {
+		return true, 0, nil
+	}
+	return throttle.Allow(fmt.Sprintf("apikey:%d", key.ID), key.RateLimit, time.Minute)
+}
+
+// anonymousLimiter applies ANONYMOUS_RATE_LIMIT (requests per minute and
+// client IP, 120 by default) to callers without an API key. It is kept in
+// memory so anonymous traffic never waits on the database; each instance
+// enforces the limit on its own.
+var anonymousLimiter = sync.OnceValue(func() *throttle.LocalLimiter {
+	return throttle.NewLocalLimiter(envInt("ANONYMOUS_RATE_LIMIT", 120))
+})
+
+func allowAnonymousRequest(clientIP string) (bool, time.Duration) {
+	return anonymousLimiter().Allow("anon:" + throttle.IPKey(clientIP))
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AccessCookieName  = "token"
+	RefreshCookieName = "refresh_token"
+)
+
+// secureCookies reports whether session cookies get the Secure attribute:
+// COOKIE_SECURE when set, otherwise whenever BASE_URL is https.
+func secureCookies() bool {
+	if v := os.Getenv("COOKIE_SECURE"); v != "" {
+		return v == "true"
+	}
+	return strings.HasPrefix(Issuer(), "https://")
+}
+
+// SetAuthCookies stores an access/refresh pair for browser sessions such as
+// the admin panel. SameSite=Lax keeps them off cross-site POSTs while still
+// allowing top-level navigations such as the OIDC authorize redirect.
+func SetAuthCookies(c *gin.Context, access, refresh string) {
+	setAccessCookie(c, access)
+	c.SetCookie(RefreshCookieName, refresh, int(refreshTokenTTL().Seconds()), "/", "", secureCookies(), true)
+}
+
+// setAccessCookie replaces the access cookie of a browser session, keeping
+// its refresh cookie.
+func setAccessCookie(c *gin.Context, access string) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(AccessCookieName, access, int(AccessTokenTTL().Seconds()), "/", "", secureCookies(), true)
+	followSessionCSRF(c, access)
+}
+
+// ClearAuthCookies removes both session cookies.
+func ClearAuthCookies(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(AccessCookieName, "", -1, "/", "", secureCookies(), true)
+	c.SetCookie(RefreshCookieName, "", -1, "/", "", secureCookies(), true)
+}
+
+// CookieSession returns the access token and claims of a browser session.
+// An expired or missing access cookie is renewed from the refresh cookie. An
+// empty token means the request carries no session at all.
+func CookieSession(c *gin.Context) (string, *Claims, error) {
+	tokenStr, _ := c.Cookie(AccessCookieName)
+
+	var claims *Claims
+	var err error
+	if tokenStr != "" {
+		claims, err = ParseSessionToken(tokenStr, c.ClientIP())
+		if err == nil {
+			return tokenStr, claims, nil
+		}
+	}
+
+	if refreshed, rc, rerr := refreshFromCookie(c); refreshed != "" || rerr != nil {
+		return refreshed, rc, rerr
+	}
+	return tokenStr, claims, err
+}
+
+// refreshFromCookie renews an expired cookie session using the refresh cookie.
+// It returns an empty token when there is nothing to refresh.
+func refreshFromCookie(c *gin.Context) (string, *Claims, error) {
+	raw, _ := c.Cookie(RefreshCookieName)
+	if raw == "" {
+		return "", nil, nil
+	}
+
+	u, newRefresh, sessionID, err := RotateRefreshToken(raw, ClientInfoFrom(c))
+	if err != nil {
+		ClearAuthCookies(c)
+		return "", nil, err
+	}
+
+	access, err := GenerateToken(u, sessionID)
+	if err != nil {
+		return "", nil, err
+	}
+	claims, err := ParseToken(access)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if newRefresh == "" {
+		// A parallel request already set the successor
+		setAccessCookie(c, access)
+	} else {
+		SetAuthCookies(c, access, newRefresh)
+	}
+	return access, claims, nil
+}
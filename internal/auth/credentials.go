@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/throttle"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// LockoutError is returned while an account or client IP is locked out
+// after too many failed logins.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// RestrictedError is returned for accounts that are suspended or banned.
+type RestrictedError struct {
+	Restriction *users.Restriction
+}
+
+func (e *RestrictedError) Error() string {
+	return e.Restriction.Message()
+}
+
+// JSON is the error body sent to API clients.
+func (e *RestrictedError) JSON() gin.H {
+	body := gin.H{"error": e.Error(), "status": e.Restriction.Kind, "reason": e.Restriction.Reason}
+	if e.Restriction.ExpiresAt != nil {
+		body["until"] = e.Restriction.ExpiresAt
+	}
+	return body
+}
+
+// CheckRestriction returns a *RestrictedError while the user is suspended
+// or banned.
+func CheckRestriction(userID uint) error {
+	r, err := users.ActiveRestriction(userID)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		return &RestrictedError{Restriction: r}
+	}
+	return nil
+}
+
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+func loginPolicy(maxFailuresEnv string, defMax int) throttle.Policy {
+	return throttle.Policy{
+		MaxFailures: envInt(maxFailuresEnv, defMax),
+		BaseLockout: time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 1)) * time.Minute,
+		MaxLockout:  time.Duration(envInt("LOGIN_LOCKOUT_MAX_MINUTES", 60)) * time.Minute,
+		Window:      15 * time.Minute,
+	}
+}
+
+// allowRequest counts a request against key and answers 429 once more than
+// limit were made within window. It is meant for endpoints that send mail or
+// hash a password before anyone is authenticated.
+func allowRequest(c *gin.Context, key string, limit int, window time.Duration) bool {
+	ok, wait, err := throttle.Allow(key, limit, window)
+	if err != nil {
+		log.Printf("rate limit: failed to count %s: %v", key, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to check rate limit"})
+		return false
+	}
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests, try again later"})
+		return false
+	}
+	return true
+}
+
+// loginCounter is one of the throttle keys a login attempt counts against.
+type loginCounter struct {
+	key     string
+	policy  throttle.Policy
+	counter *throttle.Counter
+}
+
+// Authenticate checks an email/password pair and returns the matching user.
+// Every login entry point goes through here. Attempts are counted per
+// account and per client IP before the password is checked; either one can
+// lock further attempts out.
+func Authenticate(email, password, clientIP string) (*users.User, error) {
+	counters := []*loginCounter{
+		{key: throttle.AccountKey(email), policy: loginPolicy("LOGIN_MAX_FAILURES", 5)},
+		{key: throttle.IPKey(clientIP), policy: loginPolicy("LOGIN_MAX_FAILURES_PER_IP", 20)},
+	}
+	for i, ct := range counters {
+		counter, wait, err := throttle.Attempt(ct.key, ct.policy)
+		if err == nil && wait > 0 {
+			log.Printf("login lockout: rejected attempt for %s from %s (%s locked)", email, clientIP, ct.key)
+			err = &LockoutError{RetryAfter: wait}
+		}
+		if err != nil {
+			releaseAttempts(counters[:i])
+			return nil, err
+		}
+		ct.counter = counter
+	}
+
+	var u users.User
+	if err := database.DB.First(&u, "email = ?", email).Error; err != nil {
+		// Spend the same time as for a real account, so timing doesn't
+		// tell which addresses are registered
+		users.VerifyPassword(dummyPasswordHash(), password)
+		return nil, loginFailed(counters, email, clientIP)
+	}
+
+	if !users.VerifyPassword(u.PasswordHash, password) {
+		return nil, loginFailed(counters, email, clientIP)
+	}
+	if users.NeedsRehash(u.PasswordHash) {
+		rehash(&u, password)
+	}
+
+	if err := throttle.Reset(counters[0].key); err != nil {
+		log.Printf("login throttle: failed to reset %s: %v", counters[0].key, err)
+	}
+	releaseAttempts(counters[1:])
+	// Checked after the password so the status is not revealed to guessers
+	if err := CheckRestriction(u.ID); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func releaseAttempts(counters []*loginCounter) {
+	for _, ct := range counters {
+		if err := throttle.Release(ct.key, ct.policy); err != nil {
+			log.Printf("login throttle: failed to release %s: %v", ct.key, err)
+		}
+	}
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash is verified against for unknown accounts. It uses the
+// current algorithm and cost, so it takes as long as a real check.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		h, err := users.HashPassword("cinemesh-unknown-account")
+		if err != nil {
+			log.Printf("login: failed to compute dummy hash: %v", err)
+			return
+		}
+		dummyHash = h
+	})
+	return dummyHash
+}
+
+// rehash upgrades a verified password to the current hash algorithm and
+// cost. A failure only means the upgrade is retried on the next login.
+func rehash(u *users.User, password string) {
+	hash, err := users.HashPassword(password)
+	if err == nil {
+		err = database.DB.Model(u).Update("password_hash", hash).Error
+	}
+	if err != nil {
+		log.Printf("password rehash: failed for user %d: %v", u.ID, err)
+	}
+}
+
+// loginFailed logs the lockouts the failed attempt triggered and returns
+// the error to report; the attempt itself was counted by Authenticate. The
+// attempt that triggers a lockout still reports invalid credentials.
+func loginFailed(counters []*loginCounter, email, clientIP string) error {
+	for _, ct := range counters {
+		if ct.counter.Locked() {
+			log.Printf("login lockout: %s locked until %s after %d failures (email=%s ip=%s)",
+				ct.key, ct.counter.LockedUntil.Format(time.RFC3339), ct.counter.Failures, email, clientIP)
+		}
+	}
+	return ErrInvalidCredentials
+}
+
+// Issuer is the iss value of every token Core signs.
+func Issuer() string {
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	return baseURL
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+const (
+	// CSRFFormField and CSRFHeader carry the token on unsafe requests.
+	CSRFFormField = "_csrf"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+// sessionCSRFToken returns the CSRF token of a session, creating it for
+// sessions that predate CSRF protection.
+func sessionCSRFToken(familyID string) (string, error) {
+	var s Session
+	if err := database.DB.Where("family_id = ?", familyID).First(&s).Error; err != nil {
+		return "", err
+	}
+	if s.CSRFToken != "" {
+		return s.CSRFToken, nil
+	}
+
+	token, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	if err := database.DB.Model(&s).Update("csrf_token", token).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// csrfWriter carries the request's token to CSRFHTMLRender.
+type csrfWriter struct {
+	gin.ResponseWriter
+	token string
+}
+
+// RequireCSRF protects cookie-authenticated routes. Unsafe requests must
+// echo the session's token in the _csrf form field or the X-CSRF-Token
+// header. Requests authenticated with an Authorization header are exempt,
+// since browsers never attach one on their own. Must run after RequireAuth.
+func RequireCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := sessionCSRFToken(c.GetString("session_id"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing session"})
+			return
+		}
+
+		switch {
+		case c.Request.Method == http.MethodGet, c.Request.Method == http.MethodHead, c.Request.Method == http.MethodOptions:
+		case strings.HasPrefix(c.GetHeader("Authorization"), "Bearer "):
+		default:
+			sent := c.GetHeader(CSRFHeader)
+			if sent == "" {
+				sent = c.PostForm(CSRFFormField)
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid CSRF token"})
+				return
+			}
+		}
+
+		c.Set("csrf_token", token)
+		c.Writer = &csrfWriter{ResponseWriter: c.Writer, token: token}
+		c.Next()
+	}
+}
+
+// followSessionCSRF switches the token rendered for this request to the one
+// of a session that was just started, e.g. after 2FA enrollment rotated the
+// admin's session.
+func followSessionCSRF(c *gin.Context, access string) {
+	cw, ok := c.Writer.(*csrfWriter)
+	if !ok {
+		return
+	}
+	claims, err := ParseToken(access)
+	if err != nil {
+		return
+	}
+	if token, err := sessionCSRFToken(claims.SessionID); err == nil {
+		cw.token = token
+		c.Set("csrf_token", token)
+	}
+}
+
+// CSRFHTMLRender wraps the engine's HTML renderer so that every template
+// rendered behind RequireCSRF can use {{$.csrfToken}} without each handler
+// passing it along.
+type CSRFHTMLRender struct {
+	render.HTMLRender
+}
+
+func (r CSRFHTMLRender) Instance(name string, data any) render.Render {
+	return csrfHTML{inner: r.HTMLRender.Instance(name, data), data: data}
+}
+
+type csrfHTML struct {
+	inner render.Render
+	data  any
+}
+
+func (h csrfHTML) WriteContentType(w http.ResponseWriter) {
+	h.inner.WriteContentType(w)
+}
+
+func (h csrfHTML) Render(w http.ResponseWriter) error {
+	if cw, ok := w.(*csrfWriter); ok {
+		switch data := h.data.(type) {
+		case gin.H:
+			data["csrfToken"] = cw.token
+		case map[string]any:
+			data["csrfToken"] = cw.token
+		}
+	}
+	return h.inner.Render(w)
+}
+
+// loginCSRFCookie holds the double-submit token of login forms, which are
+// shown before there is a session to keep a token in.
+const loginCSRFCookie = "login_csrf"
+
+// LoginCSRFToken returns the token a login form must echo in its _csrf
+// field, setting the cookie that carries it when the browser has none yet.
+func LoginCSRFToken(c *gin.Context) string {
+	if token := c.GetString("login_csrf"); token != "" {
+		return token
+	}
+	token, _ := c.Cookie(loginCSRFCookie)
+	if token == "" {
+		var err error
+		if token, err = newCSRFToken(); err != nil {
+			return ""
+		}
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(loginCSRFCookie, token, 0, "/", "", secureCookies(), true)
+	}
+	c.Set("login_csrf", token)
+	return token
+}
+
+// CheckLoginCSRF reports whether a login form post echoes the token of its
+// cookie. A cross-site page can neither read nor set that cookie, so it
+// can't sign the browser in to an account of its choosing.
+func CheckLoginCSRF(c *gin.Context) bool {
+	token, _ := c.Cookie(loginCSRFCookie)
+	sent := c.PostForm(CSRFFormField)
+	return token != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
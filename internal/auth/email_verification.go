@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/mail"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidVerificationToken = errors.New("invalid or expired verification link")
+
+// emailVerificationType keeps verification links from being usable as any
+// other kind of token.
+const emailVerificationType = "email-verify+jwt"
+
+// Verification links are signed rather than stored. The address is part of
+// the claims, so a link stops working once the account's email changes.
+type emailVerificationClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+func emailVerificationTTL() time.Duration {
+	hours := 24
+	if v := os.Getenv("EMAIL_VERIFICATION_TTL_HOURS"); v != "" {
+		if h, err := strconv.Atoi(v); err == nil && h > 0 {
+			hours = h
+		}
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// EmailVerificationRequired reports whether unverified accounts are kept
+// out of routes guarded by RequireVerifiedEmail.
+func EmailVerificationRequired() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+func emailVerificationURL(token string) string {
+	base := os.Getenv("EMAIL_VERIFICATION_URL")
+	if base == "" {
+		base = Issuer() + "/email/verify"
+	}
+	return appendQueryParam(base, "token", token)
+}
+
+func newEmailVerificationToken(u *users.User) (string, error) {
+	now := time.Now()
+	claims := emailVerificationClaims{
+		Email: u.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer(),
+			Subject:   strconv.FormatUint(uint64(u.ID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(emailVerificationTTL())),
+		},
+	}
+	return signClaims(claims, emailVerificationType)
+}
+
+// SendVerificationEmail mails a verification link to the user's address.
+// It is hooked into self-registration and admin email changes via
+// users.OnRegistered and users.OnEmailChanged.
+func SendVerificationEmail(u *users.User) {
+	token, err := newEmailVerificationToken(u)
+	if err != nil {
+		log.Printf("email verification: failed to sign link for user %d: %v", u.ID, err)
+		return
+	}
+
+	msg := mail.Message{
+		To:      u.Email,
+		Subject: "Confirm your Cinemesh email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm that this is your email address by opening the link below:\n\n%s\n\n"+
+				"The link is valid for %d hours. If you didn't create a Cinemesh account, you can ignore this email.\n",
+			u.Username, emailVerificationURL(token), int(emailVerificationTTL().Hours())),
+	}
+	go func() {
+		if err := mail.Send(msg); err != nil {
+			log.Printf("email verification: failed to mail user %d: %v", u.ID, err)
+		}
+	}()
+}
+
+// VerifyEmail checks a verification link and marks the address as verified.
+func VerifyEmail(tokenStr string) (*users.User, error) {
+	claims := &emailVerificationClaims{}
+	if err := parseTyped(tokenStr, emailVerificationType, claims); err != nil {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	id, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	var u users.User
+	if err := database.DB.First(&u, uint(id)).Error; err != nil || u.Email != claims.Email {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	if u.EmailVerifiedAt == nil {
+		now := time.Now()
+		if err := database.DB.Model(&u).Update("email_verified_at", now).Error; err != nil {
+			return nil, err
+		}
+		u.EmailVerifiedAt = &now
+	}
+	return &u, nil
+}
+
+// ================================
+// HANDLERS
+// ================================
+
+// VerifyEmailHandler handles the link from the verification email.
+func VerifyEmailHandler(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		var dto struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&dto); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+			return
+		}
+		token = dto.Token
+	}
+
+	u, err := VerifyEmail(token)
+	if err != nil {
+		if errors.Is(err, ErrInvalidVerificationToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "email verified", "email": u.Email})
+}
+
+// ResendVerificationHandler mails a fresh link to the signed-in user.
+func ResendVerificationHandler(c *gin.Context) {
+	var u users.User
+	if err := database.DB.First(&u, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if u.EmailVerifiedAt != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email already verified"})
+		return
+	}
+	if !allowRequest(c, "verify:"+strconv.FormatUint(uint64(u.ID), 10), envInt("VERIFY_RESEND_MAX_PER_HOUR", 3), time.Hour) {
+		return
+	}
+
+	SendVerificationEmail(&u)
+	c.JSON(http.StatusOK, gin.H{"message": "verification email sent"})
+}
@@ -1,25 +1,54 @@
 package auth
 
 import (
+	"errors"
+	"log"
+	"strconv"
 	"strings"
 
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
+	"github.com/Ponloe/cinemesh-core/internal/users"
 	"github.com/gin-gonic/gin"
 )
 
+// RequireAuth authenticates the user from a Bearer token or the session
+// cookies. An X-API-Key sent along is checked, rate-limited and tracked too,
+// unless OptionalAPIKey already did so.
 func RequireAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if _, done := c.Get("api_key"); !done {
+			if raw := c.GetHeader("X-API-Key"); raw != "" && !authenticateAPIKey(c, raw, false) {
+				return
+			}
+		}
+
 		var tokenStr string
+		var claims *Claims
+		var err error
 		h := c.GetHeader("Authorization")
 		if strings.HasPrefix(h, "Bearer ") {
 			tokenStr = strings.TrimPrefix(h, "Bearer ")
+			claims, err = ParseSessionToken(tokenStr, c.ClientIP())
 		} else {
-			tokenStr, _ = c.Cookie("token")
+			tokenStr, claims, err = CookieSession(c)
+		}
+
+		// A cookie session that can't be renewed because of a restriction
+		// comes back without a token, so look for that first
+		var restricted *RestrictedError
+		if errors.As(err, &restricted) {
+			c.AbortWithStatusJSON(403, restricted.JSON())
+			return
 		}
 		if tokenStr == "" {
 			c.AbortWithStatusJSON(401, gin.H{"error": "missing or invalid authorization"})
 			return
 		}
-		claims, err := ParseToken(tokenStr)
+		if errors.Is(err, ErrSessionRevoked) {
+			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			c.AbortWithStatusJSON(401, gin.H{"error": "invalid token"})
 			return
@@ -29,17 +58,213 @@ func RequireAuth() gin.HandlerFunc {
 		c.Set("user_id", claims.UserID)
 		c.Set("user_email", claims.Email)
 		c.Set("user_role", claims.Role)
+		c.Set("permissions", claims.Permissions)
+		c.Set("session_id", claims.SessionID)
+		if claims.Actor != nil {
+			impersonationStarted(c, claims)
+			c.Next()
+			recordImpersonatedRequest(c, claims)
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireClientToken authenticates requests made by OIDC clients with the
+// access tokens they were issued, which RequireAuth refuses. The token's
+// scope is stored as "scope".
+func RequireClientToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h := c.GetHeader("Authorization")
+		if !strings.HasPrefix(h, "Bearer ") {
+			c.AbortWithStatusJSON(401, gin.H{"error": "invalid_token"})
+			return
+		}
+		claims, err := ParseClientSessionToken(strings.TrimPrefix(h, "Bearer "), c.ClientIP())
+		if err != nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "invalid_token"})
+			return
+		}
+
+		c.Set("user_id", claims.UserID)
+		c.Set("session_id", claims.SessionID)
+		c.Set("scope", claims.Scope)
+		c.Next()
+	}
+}
+
+// apiKeyFromRequest reads a key from X-API-Key or from a Bearer header that
+// carries an API key rather than a JWT.
+func apiKeyFromRequest(c *gin.Context) string {
+	if k := c.GetHeader("X-API-Key"); k != "" {
+		return k
+	}
+	h := c.GetHeader("Authorization")
+	if strings.HasPrefix(h, "Bearer "+apiKeyPrefix) {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
+
+// authenticateAPIKey validates the key, applies its rate limit and stores
+// it in the context. It aborts the request itself when it returns false.
+// With failOpen, a rate limit that can't be checked lets the request
+// through rather than failing it.
+func authenticateAPIKey(c *gin.Context, raw string, failOpen bool) bool {
+	key, err := LookupAPIKey(raw, c.ClientIP())
+	if err != nil {
+		if errors.Is(err, ErrInvalidAPIKey) || errors.Is(err, ErrAPIKeyExpired) || errors.Is(err, ErrAPIKeyRevoked) {
+			c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+			return false
+		}
+		c.AbortWithStatusJSON(500, gin.H{"error": "failed to check API key"})
+		return false
+	}
+
+	ok, wait, err := allowAPIKeyRequest(key)
+	if err != nil {
+		if !failOpen {
+			c.AbortWithStatusJSON(500, gin.H{"error": "failed to check rate limit"})
+			return false
+		}
+		log.Printf("api key %d: rate limit unavailable, letting the request through: %v", key.ID, err)
+		ok = true
+	}
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		c.AbortWithStatusJSON(429, gin.H{"error": "rate limit exceeded for this API key"})
+		return false
+	}
+
+	c.Set("api_key", key)
+	c.Set("api_key_id", key.ID)
+	return true
+}
+
+// RequireAPIKey authenticates service-to-service calls with an admin-issued
+// API key holding all of the given scopes.
+func RequireAPIKey(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := apiKeyFromRequest(c)
+		if raw == "" {
+			c.AbortWithStatusJSON(401, gin.H{"error": "missing API key"})
+			return
+		}
+		if !authenticateAPIKey(c, raw, false) {
+			return
+		}
+
+		if !checkAPIKeyScopes(c, scopes) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// OptionalAPIKey lets anonymous requests through but identifies, tracks and
+// rate-limits callers that present a key. A presented key must be valid and
+// hold the given scopes. Requests without a key share an in-memory per-IP
+// limit. Meant for read-only routes: when a key's limit can't be checked
+// the request goes through.
+func OptionalAPIKey(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := apiKeyFromRequest(c)
+		if raw == "" {
+			if ok, wait := allowAnonymousRequest(c.ClientIP()); !ok {
+				c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				c.AbortWithStatusJSON(429, gin.H{"error": "rate limit exceeded, use an API key for more"})
+				return
+			}
+			c.Next()
+			return
+		}
+		if !authenticateAPIKey(c, raw, true) || !checkAPIKeyScopes(c, scopes) {
+			return
+		}
 		c.Next()
 	}
 }
 
+func checkAPIKeyScopes(c *gin.Context, scopes []string) bool {
+	key := c.MustGet("api_key").(*APIKey)
+	for _, scope := range scopes {
+		if !key.HasScope(scope) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "API key lacks scope " + scope})
+			return false
+		}
+	}
+	return true
+}
+
+// HasPermission reports whether the authenticated caller holds permission.
+func HasPermission(c *gin.Context, permission string) bool {
+	return rbac.Contains(c.GetStringSlice("permissions"), permission)
+}
+
+// RequirePermission only lets callers through whose token carries the
+// permission. Must run after RequireAuth.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPermission(c, permission) {
+			c.AbortWithStatusJSON(403, gin.H{"error": "missing permission " + permission})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireAdmin lets in every role that may use the admin panel; the routes
+// inside are further restricted with RequirePermission.
 func RequireAdmin() gin.HandlerFunc {
+	return RequirePermission(rbac.AdminAccess)
+}
+
+// RequireVerifiedEmail blocks users whose address is not verified yet. It
+// only has an effect when REQUIRE_EMAIL_VERIFICATION=true and must run after
+// RequireAuth.
+func RequireVerifiedEmail() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		role, ok := c.Get("user_role")
-		if !ok || role != "admin" {
-			c.AbortWithStatusJSON(403, gin.H{"error": "admin access required"})
+		if !EmailVerificationRequired() {
+			c.Next()
+			return
+		}
+
+		var u users.User
+		if err := database.DB.Select("id", "email_verified_at").First(&u, c.GetUint("user_id")).Error; err != nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "user not found"})
+			return
+		}
+		if u.EmailVerifiedAt == nil {
+			c.AbortWithStatusJSON(403, gin.H{"error": "email address not verified"})
 			return
 		}
 		c.Next()
 	}
 }
+
+// RequireAdminTwoFactor keeps admin panel users without an authenticator
+// out while REQUIRE_ADMIN_2FA=true. Browsers are sent to the enrollment page.
+func RequireAdminTwoFactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !AdminTwoFactorRequired() {
+			c.Next()
+			return
+		}
+		enabled, err := TOTPEnabled(c.GetUint("user_id"))
+		if err != nil {
+			c.AbortWithStatusJSON(500, gin.H{"error": "failed to check two-factor authentication"})
+			return
+		}
+		if enabled {
+			c.Next()
+			return
+		}
+
+		if strings.Contains(c.GetHeader("Accept"), "text/html") {
+			c.Redirect(302, "/admin/security/2fa")
+			c.Abort()
+			return
+		}
+		c.AbortWithStatusJSON(403, gin.H{"error": "two-factor authentication required for admin accounts"})
+	}
+}
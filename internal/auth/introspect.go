@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Token states reported by Introspect besides "active".
+const (
+	TokenStatusActive    = "active"
+	TokenStatusInvalid   = "invalid"
+	TokenStatusExpired   = "expired"
+	TokenStatusRevoked   = "revoked"
+	TokenStatusSuspended = users.RestrictionSuspended
+	TokenStatusBanned    = users.RestrictionBanned
+	TokenStatusNoUser    = "user_deleted"
+)
+
+// Introspection is an RFC 7662 introspection response. Identity fields are
+// read from the user record, not from the token, so role changes show up
+// before the token is refreshed. Inactive tokens only carry Status, which
+// explains why.
+type Introspection struct {
+	Active      bool     `json:"active"`
+	Status      string   `json:"status"`
+	TokenType   string   `json:"token_type,omitempty"`
+	Subject     string   `json:"sub,omitempty"`
+	UserID      uint     `json:"user_id,omitempty"`
+	Username    string   `json:"username,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	SessionID   string   `json:"sid,omitempty"`
+	Actor       *Actor   `json:"act,omitempty"`
+	Issuer      string   `json:"iss,omitempty"`
+	IssuedAt    int64    `json:"iat,omitempty"`
+	ExpiresAt   int64    `json:"exp,omitempty"`
+}
+
+// Introspect reports whether an access or refresh token issued by Core is
+// currently usable. Opaque tokens are looked up as refresh tokens, anything
+// shaped like a JWT as an access token.
+func Introspect(token string) (*Introspection, error) {
+	var res *Introspection
+	var err error
+	if strings.Count(token, ".") == 2 {
+		res, err = introspectAccessToken(token)
+	} else {
+		res, err = introspectRefreshToken(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.visible(), nil
+}
+
+// visible is what the caller gets to see: everything for an active token,
+// only the status for any other, so whoever holds a dead token learns
+// nothing about its user.
+func (res *Introspection) visible() *Introspection {
+	if res.Active {
+		return res
+	}
+	return &Introspection{Status: res.Status}
+}
+
+func introspectAccessToken(token string) (*Introspection, error) {
+	claims := &Claims{}
+	if err := parseTyped(token, accessTokenType, claims); err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return &Introspection{Status: TokenStatusExpired}, nil
+		}
+		return &Introspection{Status: TokenStatusInvalid}, nil
+	}
+
+	res := &Introspection{TokenType: "access_token", SessionID: claims.SessionID, Actor: claims.Actor, Issuer: claims.Issuer}
+	if claims.IssuedAt != nil {
+		res.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if claims.ExpiresAt != nil {
+		res.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+
+	revoked, err := sessionRevoked(claims.SessionID, claims.SessionOwner())
+	if err != nil {
+		return nil, err
+	}
+	return res, res.fill(claims.UserID, revoked)
+}
+
+func introspectRefreshToken(token string) (*Introspection, error) {
+	var rt RefreshToken
+	if err := database.DB.Where("token_hash = ?", HashOpaqueToken(token)).First(&rt).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &Introspection{Status: TokenStatusInvalid}, nil
+		}
+		return nil, err
+	}
+
+	res := &Introspection{
+		TokenType: "refresh_token",
+		SessionID: rt.FamilyID,
+		Issuer:    Issuer(),
+		IssuedAt:  rt.CreatedAt.Unix(),
+		ExpiresAt: rt.ExpiresAt.Unix(),
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		res.Status = TokenStatusExpired
+		return res, nil
+	}
+	return res, res.fill(rt.UserID, rt.RevokedAt != nil)
+}
+
+// fill adds the user's current identity and settles the token's status.
+func (res *Introspection) fill(userID uint, revoked bool) error {
+	var u users.User
+	if err := database.DB.First(&u, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			res.Status = TokenStatusNoUser
+			return nil
+		}
+		return err
+	}
+
+	perms, err := rbac.PermissionsFor(u.Role)
+	if err != nil {
+		return err
+	}
+	if perms, err = enforceAdminTwoFactor(u.ID, perms); err != nil {
+		return err
+	}
+	res.Subject = strconv.FormatUint(uint64(u.ID), 10)
+	res.UserID = u.ID
+	res.Username = u.Username
+	res.Email = u.Email
+	res.Role = u.Role
+	res.Permissions = perms
+
+	r, err := users.ActiveRestriction(u.ID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case revoked:
+		res.Status = TokenStatusRevoked
+	case r != nil:
+		res.Status = r.Kind
+	default:
+		res.Active = true
+		res.Status = TokenStatusActive
+	}
+	return nil
+}
+
+// sessionRevoked reports whether an access token's session is signed out.
+// Unlike checkSession it leaves the session's last-seen data alone.
+func sessionRevoked(sessionID string, userID uint) (bool, error) {
+	if sessionID == "" {
+		return true, nil
+	}
+	var s Session
+	if err := database.DB.Where("family_id = ?", sessionID).First(&s).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	return s.UserID != userID || s.RevokedAt != nil || time.Now().After(s.ExpiresAt), nil
+}
+
+// ================================
+// HANDLERS
+// ================================
+
+type introspectDTO struct {
+	Token         string `form:"token" json:"token" binding:"required"`
+	TokenTypeHint string `form:"token_type_hint" json:"token_type_hint"`
+}
+
+// IntrospectHandler implements POST /auth/introspect (RFC 7662) for services
+// holding an API key with the tokens:introspect scope. Unknown or unusable
+// tokens still answer 200 with "active": false.
+func IntrospectHandler(c *gin.Context) {
+	var dto introspectDTO
+	if err := c.ShouldBind(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "token is required"})
+		return
+	}
+
+	res, err := Introspect(dto.Token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to introspect token"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useEphemeralKeys signs the test's tokens with a throwaway key.
+func useEphemeralKeys(t *testing.T) {
+	t.Helper()
+	t.Setenv("JWT_KEYS_DIR", t.TempDir())
+	t.Setenv("JWT_EPHEMERAL_KEY", "true")
+	t.Setenv("JWT_ACTIVE_KID", "")
+	if err := InitializeSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntrospectUnusableAccessTokens(t *testing.T) {
+	useEphemeralKeys(t)
+	now := time.Now()
+	sign := func(claims jwt.Claims, typ string) string {
+		tok, err := signClaims(claims, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	claims := func(exp time.Time) *Claims {
+		return &Claims{UserID: 42, Email: "jane@example.com", Role: "user", SessionID: "s1",
+			RegisteredClaims: jwt.RegisteredClaims{Issuer: Issuer(), IssuedAt: jwt.NewNumericDate(now.Add(-time.Hour)), ExpiresAt: jwt.NewNumericDate(exp)}}
+	}
+
+	_, foreign, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims(now.Add(time.Hour)))
+	forged.Header["kid"] = "ephemeral"
+	forged.Header["typ"] = accessTokenType
+	forgedTok, err := forged.SignedString(foreign)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"garbage", "a.b.c", TokenStatusInvalid},
+		{"expired", sign(claims(now.Add(-time.Minute)), accessTokenType), TokenStatusExpired},
+		{"ID token", sign(claims(now.Add(time.Hour)), "JWT"), TokenStatusInvalid},
+		{"OIDC client token", sign(claims(now.Add(time.Hour)), clientAccessTokenType), TokenStatusInvalid},
+		{"MFA pending token", sign(jwt.RegisteredClaims{Subject: "42", ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute))}, mfaPendingType), TokenStatusInvalid},
+		{"signed by another key", forgedTok, TokenStatusInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Introspect(tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (&Introspection{Status: tt.want}); !reflect.DeepEqual(res, want) {
+				t.Errorf("Introspect() = %+v, want %+v", res, want)
+			}
+		})
+	}
+}
+
+func TestIntrospectionVisible(t *testing.T) {
+	full := Introspection{TokenType: "access_token", Subject: "42", UserID: 42, Username: "jane",
+		Email: "jane@example.com", Role: "user", Permissions: []string{"forum:post"}, SessionID: "s1",
+		Actor: &Actor{UserID: 1, Email: "admin@example.com"}, Issuer: "http://localhost:8080", IssuedAt: 1, ExpiresAt: 2}
+
+	with := func(active bool, status string) *Introspection {
+		res := full
+		res.Active, res.Status = active, status
+		return &res
+	}
+	tests := []struct {
+		name string
+		res  *Introspection
+		want *Introspection
+	}{
+		{"active", with(true, TokenStatusActive), with(true, TokenStatusActive)},
+		{"revoked", with(false, TokenStatusRevoked), &Introspection{Status: TokenStatusRevoked}},
+		{"suspended", with(false, TokenStatusSuspended), &Introspection{Status: TokenStatusSuspended}},
+		{"banned", with(false, TokenStatusBanned), &Introspection{Status: TokenStatusBanned}},
+		{"expired", with(false, TokenStatusExpired), &Introspection{Status: TokenStatusExpired}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.res.visible(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("visible() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
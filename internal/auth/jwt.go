@@ -1,10 +1,12 @@
 package auth
 
 import (
-	"os"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
 	"github.com/Ponloe/cinemesh-core/internal/users"
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -15,42 +17,178 @@ type Claims struct {
 	Username  string `json:"username"`
 	Role      string `json:"role"`
 	AvatarURL string `json:"avatar_url"`
+	// Permissions granted by Role when the token was issued
+	Permissions []string `json:"permissions,omitempty"`
+	// SessionID names the session (refresh token family) the token belongs to
+	SessionID string `json:"sid,omitempty"`
+	// Actor is set on impersonation tokens; the session is the actor's
+	Actor *Actor `json:"act,omitempty"`
+	// Scope is set on tokens issued to OIDC clients, see GenerateClientToken
+	Scope string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(u *users.User) (string, error) {
-	hours := 24
-	if v := os.Getenv("JWT_EXPIRES_HOURS"); v != "" {
-		if h, err := strconv.Atoi(v); err == nil && h > 0 {
-			hours = h
+// accessTokenType marks access tokens (RFC 9068) so that ID tokens signed
+// with the same keys are never accepted as bearer tokens.
+const accessTokenType = "at+jwt"
+
+// clientAccessTokenType marks access tokens issued to OIDC clients. Core's
+// own middleware only accepts accessTokenType, so a relying party can't use
+// the token it was handed against Core's API.
+const clientAccessTokenType = "client-at+jwt"
+
+// parseTyped verifies a token signed by Core and only accepts it when its
+// typ header matches, so one kind of token can't stand in for another.
+func parseTyped(tokenStr, typ string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
+		if got, _ := t.Header["typ"].(string); got != typ {
+			return nil, fmt.Errorf("unexpected token type %q", got)
 		}
+		return verificationKey(t)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired(),
+	)
+	return err
+}
+
+// GenerateToken mints an access token for the given session.
+func GenerateToken(u *users.User, sessionID string) (string, error) {
+	claims, err := accessClaims(u, sessionID, AccessTokenTTL())
+	if err != nil {
+		return "", err
 	}
+	return signClaims(claims, accessTokenType)
+}
+
+func accessClaims(u *users.User, sessionID string, ttl time.Duration) (*Claims, error) {
+	perms, err := rbac.PermissionsFor(u.Role)
+	if err != nil {
+		return nil, fmt.Errorf("load permissions: %w", err)
+	}
+	if perms, err = enforceAdminTwoFactor(u.ID, perms); err != nil {
+		return nil, err
+	}
+
 	now := time.Now()
-	claims := Claims{
-		UserID:    u.ID,
-		Email:     u.Email,
-		Username:  u.Username,
-		Role:      u.Role,
-		AvatarURL: u.AvatarURL,
+	return &Claims{
+		UserID:      u.ID,
+		Email:       u.Email,
+		Username:    u.Username,
+		Role:        u.Role,
+		AvatarURL:   u.AvatarURL,
+		Permissions: perms,
+		SessionID:   sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer(),
 			Subject:   strconv.FormatUint(uint64(u.ID), 10),
 			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(hours) * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 		},
+	}, nil
+}
+
+// GenerateClientToken mints an access token for an OIDC client. Its audience
+// is the client, it carries no permissions, and it only holds the identity
+// claims the granted scope allows.
+func GenerateClientToken(u *users.User, sessionID, clientID, scope string) (string, error) {
+	claims, err := accessClaims(u, sessionID, AccessTokenTTL())
+	if err != nil {
+		return "", err
+	}
+	claims.Permissions = nil
+	claims.Scope = scope
+	claims.Audience = jwt.ClaimStrings{clientID}
+	if !scopeIncludes(scope, "email") {
+		claims.Email = ""
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	secret := []byte(os.Getenv("JWT_SECRET"))
-	return token.SignedString(secret)
+	if !scopeIncludes(scope, "profile") {
+		claims.Username, claims.Role, claims.AvatarURL = "", "", ""
+	}
+	return signClaims(claims, clientAccessTokenType)
 }
 
-func ParseToken(tokenStr string) (*Claims, error) {
-	secret := []byte(os.Getenv("JWT_SECRET"))
+func scopeIncludes(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseClientSessionToken accepts only access tokens issued to OIDC clients,
+// with the same session and restriction checks as ParseSessionToken.
+func ParseClientSessionToken(tokenStr, clientIP string) (*Claims, error) {
 	claims := &Claims{}
+	if err := parseTyped(tokenStr, clientAccessTokenType, claims); err != nil {
+		return nil, err
+	}
+	if err := checkSession(claims, clientIP); err != nil {
+		return nil, err
+	}
+	if err := CheckRestriction(claims.UserID); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ParseIDTokenHint verifies an ID token issued by Core, as sent back in an
+// id_token_hint. Expired tokens are accepted, as OIDC allows for hints.
+func ParseIDTokenHint(tokenStr string) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
 	_, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
-		return secret, nil
-	})
+		if got, _ := t.Header["typ"].(string); got != "JWT" {
+			return nil, fmt.Errorf("unexpected token type %q", got)
+		}
+		return verificationKey(t)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithoutClaimsValidation(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != Issuer() {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	return claims, nil
+}
+
+func ParseToken(tokenStr string) (*Claims, error) {
+	claims := &Claims{}
+	if err := parseTyped(tokenStr, accessTokenType, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// IssueTokenPair signs the user in on a new device: it starts a session with
+// its refresh token family and mints a short-lived access token for it.
+func IssueTokenPair(u *users.User, client ClientInfo) (string, string, error) {
+	refresh, sessionID, err := IssueRefreshToken(u.ID, client)
+	if err != nil {
+		return "", "", err
+	}
+	access, err := GenerateToken(u, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// ParseSessionToken is ParseToken plus a check that the token's session is
+// still signed in and its user is not suspended or banned.
+func ParseSessionToken(tokenStr, clientIP string) (*Claims, error) {
+	claims, err := ParseToken(tokenStr)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkSession(claims, clientIP); err != nil {
+		return nil, err
+	}
+	if err := CheckRestriction(claims.UserID); err != nil {
+		return nil, err
+	}
 	return claims, nil
 }
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestTokenTypesDontMix(t *testing.T) {
+	useEphemeralKeys(t)
+	claims := &Claims{UserID: 42, SessionID: "s1", Scope: "openid",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}}
+
+	tests := []struct {
+		name       string
+		typ        string
+		wantCore   bool
+		wantClient bool
+	}{
+		{"Core access token", accessTokenType, true, false},
+		{"OIDC client token", clientAccessTokenType, false, true},
+		{"ID token", "JWT", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := signClaims(claims, tt.typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseToken(tok); (err == nil) != tt.wantCore {
+				t.Errorf("ParseToken() error = %v, want accepted %v", err, tt.wantCore)
+			}
+			if err := parseTyped(tok, clientAccessTokenType, &Claims{}); (err == nil) != tt.wantClient {
+				t.Errorf("parseTyped(client) error = %v, want accepted %v", err, tt.wantClient)
+			}
+		})
+	}
+}
+
+func TestScopeIncludes(t *testing.T) {
+	tests := []struct {
+		scope, want string
+		ok          bool
+	}{
+		{"openid email", "email", true},
+		{"openid profile", "email", false},
+		{"openid emails", "email", false},
+		{"", "openid", false},
+	}
+	for _, tt := range tests {
+		if got := scopeIncludes(tt.scope, tt.want); got != tt.ok {
+			t.Errorf("scopeIncludes(%q, %q) = %v, want %v", tt.scope, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestParseIDTokenHint(t *testing.T) {
+	useEphemeralKeys(t)
+	now := time.Now()
+	idToken := func(iss string, exp time.Time) jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{Issuer: iss, Subject: "42", Audience: jwt.ClaimStrings{"app"}, ExpiresAt: jwt.NewNumericDate(exp)}
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.RegisteredClaims
+		typ    string
+		wantOK bool
+	}{
+		{"current ID token", idToken(Issuer(), now.Add(time.Hour)), "JWT", true},
+		{"expired ID token", idToken(Issuer(), now.Add(-time.Hour)), "JWT", true},
+		{"other issuer", idToken("https://evil.example", now.Add(time.Hour)), "JWT", false},
+		{"access token", idToken(Issuer(), now.Add(time.Hour)), accessTokenType, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := signClaims(tt.claims, tt.typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := ParseIDTokenHint(tok)
+			if (err == nil) != tt.wantOK {
+				t.Fatalf("ParseIDTokenHint() error = %v, want accepted %v", err, tt.wantOK)
+			}
+			if err == nil && claims.Subject != "42" {
+				t.Errorf("sub = %q, want 42", claims.Subject)
+			}
+		})
+	}
+	if _, err := ParseIDTokenHint("a.b.c"); err == nil {
+		t.Error("ParseIDTokenHint() accepted garbage")
+	}
+}
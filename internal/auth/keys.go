@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one entry of the key set. Keys without a private half are
+// verify-only; they stay published while tokens signed by them expire.
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+type keySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+	order  []string
+}
+
+var signingKeys *keySet
+
+// InitializeSigningKeys loads every PEM key in JWT_KEYS_DIR. The file name
+// without extension is used as the key id. JWT_ACTIVE_KID selects the key
+// that signs new tokens; when unset the last id in lexical order is used, so
+// date-prefixed file names rotate naturally. Without any key it fails,
+// unless JWT_EPHEMERAL_KEY=true allows a throwaway key for development.
+func InitializeSigningKeys() error {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		dir = "keys"
+	}
+
+	ks := &keySet{keys: make(map[string]*signingKey)}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pem"))
+	sort.Strings(files)
+	for _, f := range files {
+		kid := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		k, err := loadKey(kid, f)
+		if err != nil {
+			return fmt.Errorf("load key %s: %w", f, err)
+		}
+		ks.keys[kid] = k
+		ks.order = append(ks.order, kid)
+		log.Printf("✓ JWT key loaded: kid=%s alg=%s signing=%t", kid, k.Method.Alg(), k.Private != nil)
+	}
+
+	if len(ks.keys) == 0 {
+		if os.Getenv("JWT_EPHEMERAL_KEY") != "true" {
+			return fmt.Errorf("no JWT keys found in %s (set JWT_EPHEMERAL_KEY=true to use a temporary key in development)", dir)
+		}
+		log.Printf("WARNING: no JWT keys found in %s - using an ephemeral Ed25519 key, tokens will not survive a restart", dir)
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("generate ephemeral key: %w", err)
+		}
+		k := &signingKey{ID: "ephemeral", Method: jwt.SigningMethodEdDSA, Private: priv, Public: pub}
+		ks.keys[k.ID] = k
+		ks.order = append(ks.order, k.ID)
+	}
+
+	activeID := os.Getenv("JWT_ACTIVE_KID")
+	if activeID == "" {
+		for i := len(ks.order) - 1; i >= 0; i-- {
+			if ks.keys[ks.order[i]].Private != nil {
+				activeID = ks.order[i]
+				break
+			}
+		}
+	}
+	active, ok := ks.keys[activeID]
+	if !ok || active.Private == nil {
+		return fmt.Errorf("no private key available for active kid %q", activeID)
+	}
+	ks.active = active
+	log.Printf("✓ JWT signing with kid=%s", active.ID)
+
+	signingKeys = ks
+	return nil
+}
+
+func loadKey(kid, path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Private: k, Public: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Public: k}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Private: k, Public: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Public: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T (use RSA or Ed25519)", parsed)
+	}
+}
+
+// SignClaims signs arbitrary claims with the active key and sets the kid header.
+func SignClaims(claims jwt.Claims) (string, error) {
+	return signClaims(claims, "JWT")
+}
+
+func signClaims(claims jwt.Claims, typ string) (string, error) {
+	if signingKeys == nil {
+		return "", fmt.Errorf("signing keys not initialized")
+	}
+	k := signingKeys.active
+	token := jwt.NewWithClaims(k.Method, claims)
+	token.Header["kid"] = k.ID
+	token.Header["typ"] = typ
+	return token.SignedString(k.Private)
+}
+
+// SigningAlgorithms lists the JWS algorithms of all published keys.
+func SigningAlgorithms() []string {
+	seen := map[string]bool{}
+	algs := []string{}
+	if signingKeys == nil {
+		return algs
+	}
+	for _, kid := range signingKeys.order {
+		alg := signingKeys.keys[kid].Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// verificationKey resolves the public key for a token by its kid header.
+func verificationKey(t *jwt.Token) (interface{}, error) {
+	if signingKeys == nil {
+		return nil, fmt.Errorf("signing keys not initialized")
+	}
+	kid, _ := t.Header["kid"].(string)
+	k, ok := signingKeys.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if t.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+	}
+	return k.Public, nil
+}
+
+// JWKSHandler publishes every known public key so other services can verify
+// Core tokens without being able to mint them.
+func JWKSHandler(c *gin.Context) {
+	keys := []gin.H{}
+	if signingKeys != nil {
+		for _, kid := range signingKeys.order {
+			k := signingKeys.keys[kid]
+			jwk := gin.H{
+				"kid": k.ID,
+				"use": "sig",
+				"alg": k.Method.Alg(),
+			}
+			switch pub := k.Public.(type) {
+			case *rsa.PublicKey:
+				jwk["kty"] = "RSA"
+				jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+				jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+			case ed25519.PublicKey:
+				jwk["kty"] = "OKP"
+				jwk["crv"] = "Ed25519"
+				jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+			}
+			keys = append(keys, jwk)
+		}
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/throttle"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mfaPendingType marks the short-lived token handed out after a correct
+// password when a second factor is still missing.
+const (
+	mfaPendingType = "mfa-pending+jwt"
+	mfaPendingTTL  = 5 * time.Minute
+)
+
+var ErrInvalidMFAToken = errors.New("sign-in expired, please start again")
+
+// NewMFAPendingToken records that the user passed the password step.
+func NewMFAPendingToken(u *users.User) (string, error) {
+	now := time.Now()
+	return signClaims(jwt.RegisteredClaims{
+		Issuer:    Issuer(),
+		Subject:   strconv.FormatUint(uint64(u.ID), 10),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(mfaPendingTTL)),
+	}, mfaPendingType)
+}
+
+// CompleteSecondFactor finishes a login started with NewMFAPendingToken.
+// Wrong codes count against the account like wrong passwords do.
+func CompleteSecondFactor(pendingToken, code, clientIP string) (*users.User, error) {
+	claims := &jwt.RegisteredClaims{}
+	if err := parseTyped(pendingToken, mfaPendingType, claims); err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	id, err := strconv.ParseUint(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+
+	var u users.User
+	if err := database.DB.First(&u, uint(id)).Error; err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+
+	if err := VerifySecondFactorThrottled(u.ID, code, clientIP); err != nil {
+		return nil, err
+	}
+	if err := CheckRestriction(u.ID); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// VerifySecondFactorThrottled is VerifySecondFactor with wrong codes counted
+// against the user's "mfa:" key. Every endpoint that takes a code goes
+// through here, so they share one lockout.
+func VerifySecondFactorThrottled(userID uint, code, clientIP string) error {
+	key := "mfa:" + strconv.FormatUint(uint64(userID), 10)
+	policy := loginPolicy("LOGIN_MAX_FAILURES", 5)
+	counter, wait, err := throttle.Attempt(key, policy)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		log.Printf("login lockout: rejected second factor for user %d from %s", userID, clientIP)
+		return &LockoutError{RetryAfter: wait}
+	}
+
+	if err := VerifySecondFactor(userID, code); err != nil {
+		if !errors.Is(err, ErrInvalidSecondFactor) {
+			// Not a wrong code; don't hold it against the user
+			if rerr := throttle.Release(key, policy); rerr != nil {
+				log.Printf("login throttle: failed to release %s: %v", key, rerr)
+			}
+		} else if counter.Locked() {
+			log.Printf("login lockout: %s locked until %s after %d failures (ip=%s)",
+				key, counter.LockedUntil.Format(time.RFC3339), counter.Failures, clientIP)
+		}
+		return err
+	}
+
+	if err := throttle.Reset(key); err != nil {
+		log.Printf("login throttle: failed to reset %s: %v", key, err)
+	}
+	return nil
+}
+
+// ================================
+// HANDLERS
+// ================================
+
+type secondFactorDTO struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// LoginSecondFactorHandler is the second step of LoginHandler for accounts
+// with two-factor authentication.
+func LoginSecondFactorHandler(c *gin.Context) {
+	var dto secondFactorDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, err := CompleteSecondFactor(dto.MFAToken, dto.Code, c.ClientIP())
+	if err != nil {
+		var lockout *LockoutError
+		var restricted *RestrictedError
+		switch {
+		case errors.As(err, &restricted):
+			c.JSON(http.StatusForbidden, restricted.JSON())
+		case errors.As(err, &lockout):
+			c.Header("Retry-After", strconv.Itoa(int(lockout.RetryAfter.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": lockout.Error()})
+		case errors.Is(err, ErrInvalidMFAToken), errors.Is(err, ErrInvalidSecondFactor):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		}
+		return
+	}
+
+	respondWithTokens(c, u)
+}
+
+func TwoFactorStatusHandler(c *gin.Context) {
+	uid := c.GetUint("user_id")
+	enabled, err := TOTPEnabled(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  enabled,
+		"recovery_codes_remaining": RemainingRecoveryCodes(uid),
+	})
+}
+
+func TwoFactorSetupHandler(c *gin.Context) {
+	var u users.User
+	if err := database.DB.First(&u, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	secret, uri, err := BeginTOTPEnrollment(&u)
+	if err != nil {
+		if errors.Is(err, ErrTOTPAlreadyEnabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "provisioning_uri": uri})
+}
+
+type twoFactorCodeDTO struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// TwoFactorConfirmHandler activates 2FA. Other sessions are signed out and
+// the caller gets a fresh token pair.
+func TwoFactorConfirmHandler(c *gin.Context) {
+	var dto twoFactorCodeDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	uid := c.GetUint("user_id")
+	codes, err := ConfirmTOTPEnrollment(uid, dto.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidSecondFactor):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrTOTPNotEnrolled), errors.Is(err, ErrTOTPAlreadyEnabled):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable two-factor authentication"})
+		}
+		return
+	}
+
+	var u users.User
+	if err := database.DB.First(&u, uid).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err := RevokeUserRefreshTokens(uid); err != nil {
+		log.Printf("2fa: failed to revoke sessions of user %d: %v", uid, err)
+	}
+	access, refresh, err := IssueTokenPair(&u, ClientInfoFrom(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": codes,
+		"token":          access,
+		"refresh_token":  refresh,
+		"expires_in":     int(AccessTokenTTL().Seconds()),
+	})
+}
+
+func TwoFactorRecoveryCodesHandler(c *gin.Context) {
+	var dto twoFactorCodeDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := RegenerateRecoveryCodes(c.GetUint("user_id"), dto.Code, c.ClientIP())
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+type twoFactorDisableDTO struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// TwoFactorDisableHandler turns 2FA off. It needs both the password and a
+// current code, so a stolen session alone can't do it.
+func TwoFactorDisableHandler(c *gin.Context) {
+	var dto twoFactorDisableDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var u users.User
+	if err := database.DB.First(&u, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	if err := DisableTOTP(&u, dto.Password, dto.Code, c.ClientIP()); err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
+
+func twoFactorError(c *gin.Context, err error) {
+	var lockout *LockoutError
+	var restricted *RestrictedError
+	switch {
+	case errors.As(err, &lockout):
+		c.Header("Retry-After", strconv.Itoa(int(lockout.RetryAfter.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": lockout.Error()})
+	case errors.As(err, &restricted):
+		c.JSON(http.StatusForbidden, restricted.JSON())
+	case errors.Is(err, ErrInvalidCredentials):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is incorrect"})
+	case errors.Is(err, ErrInvalidSecondFactor):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrTOTPNotEnrolled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrTOTPRequiredByPolicy):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update two-factor authentication"})
+	}
+}
@@ -1,12 +1,13 @@
 package auth
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/Ponloe/cinemesh-core/internal/database"
 	"github.com/Ponloe/cinemesh-core/internal/users"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type loginDTO struct {
@@ -21,25 +22,57 @@ func LoginHandler(c *gin.Context) {
 		return
 	}
 
-	var u users.User
-	if err := database.DB.First(&u, "email = ?", dto.Email).Error; err != nil {
+	u, err := Authenticate(dto.Email, dto.Password, c.ClientIP())
+	if err != nil {
+		var lockout *LockoutError
+		if errors.As(err, &lockout) {
+			c.Header("Retry-After", strconv.Itoa(int(lockout.RetryAfter.Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": lockout.Error()})
+			return
+		}
+		var restricted *RestrictedError
+		if errors.As(err, &restricted) {
+			c.JSON(http.StatusForbidden, restricted.JSON())
+			return
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(dto.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+	mfa, err := TOTPEnabled(u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign in"})
+		return
+	}
+	if mfa {
+		mfaToken, err := NewMFAPendingToken(u)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int(mfaPendingTTL.Seconds()),
+		})
 		return
 	}
 
-	tok, err := GenerateToken(&u)
+	respondWithTokens(c, u)
+}
+
+// respondWithTokens completes a login with a new token pair.
+func respondWithTokens(c *gin.Context, u *users.User) {
+	tok, refresh, err := IssueTokenPair(u, ClientInfoFrom(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"token": tok,
+		"token":         tok,
+		"refresh_token": refresh,
+		"expires_in":    int(AccessTokenTTL().Seconds()),
 		"user": gin.H{
 			"id":       u.ID,
 			"username": u.Username,
@@ -49,6 +82,65 @@ func LoginHandler(c *gin.Context) {
 	})
 }
 
+type refreshDTO struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func RefreshHandler(c *gin.Context) {
+	var dto refreshDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, refresh, sessionID, err := RotateRefreshToken(dto.RefreshToken, ClientInfoFrom(c))
+	if err != nil {
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		var restricted *RestrictedError
+		if errors.As(err, &restricted) {
+			c.JSON(http.StatusForbidden, restricted.JSON())
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh token"})
+		return
+	}
+
+	tok, err := GenerateToken(u, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+
+	res := gin.H{
+		"token":      tok,
+		"expires_in": int(AccessTokenTTL().Seconds()),
+	}
+	// Empty for a replay within the grace period; the client keeps the
+	// refresh token the parallel request received
+	if refresh != "" {
+		res["refresh_token"] = refresh
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func LogoutHandler(c *gin.Context) {
+	var dto refreshDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := RevokeRefreshToken(dto.RefreshToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
 func MeHandler(c *gin.Context) {
 	uidv, ok := c.Get("user_id")
 	if !ok {
@@ -63,11 +155,17 @@ func MeHandler(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"id":         u.ID,
-		"username":   u.Username,
-		"email":      u.Email,
-		"avatar_url": u.AvatarURL,
-		"role":       u.Role,
-	})
+	resp := gin.H{
+		"id":             u.ID,
+		"username":       u.Username,
+		"email":          u.Email,
+		"email_verified": u.EmailVerifiedAt != nil,
+		"avatar_url":     u.AvatarURL,
+		"role":           u.Role,
+	}
+	// Lets frontends show an impersonation banner
+	if id, email, ok := Impersonator(c); ok {
+		resp["impersonated_by"] = gin.H{"id": id, "email": email}
+	}
+	c.JSON(http.StatusOK, resp)
 }
@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/mail"
+	"github.com/Ponloe/cinemesh-core/internal/throttle"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// PasswordResetToken is a single-use token mailed to a user. Only the
+// SHA-256 digest is stored.
+type PasswordResetToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"size:64;uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func passwordResetTTL() time.Duration {
+	minutes := 60
+	if v := os.Getenv("PASSWORD_RESET_TTL_MINUTES"); v != "" {
+		if m, err := strconv.Atoi(v); err == nil && m > 0 {
+			minutes = m
+		}
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// passwordResetURL is the page that receives the token, usually the frontend.
+// Without PASSWORD_RESET_URL the form served by ResetPasswordFormHandler is
+// used.
+func passwordResetURL(token string) string {
+	base := os.Getenv("PASSWORD_RESET_URL")
+	if base == "" {
+		base = Issuer() + "/password/reset"
+	}
+	return appendQueryParam(base, "token", token)
+}
+
+func appendQueryParam(rawURL, key, value string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// IssuePasswordResetToken invalidates any pending reset tokens of the user
+// and creates a new one valid for ttl.
+func IssuePasswordResetToken(userID uint, ttl time.Duration) (string, error) {
+	raw, hash, err := NewOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("generate reset token: %w", err)
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", userID).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&PasswordResetToken{
+			UserID:    userID,
+			TokenHash: hash,
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", fmt.Errorf("store reset token: %w", err)
+	}
+	return raw, nil
+}
+
+// inviteTTL is how long invitation links stay valid (INVITE_TTL_HOURS).
+func inviteTTL() time.Duration {
+	return time.Duration(envInt("INVITE_TTL_HOURS", 72)) * time.Hour
+}
+
+// SendInvitation mails an imported account a link to choose its password.
+// The link is a password reset token with the longer invitation lifetime.
+func SendInvitation(u *users.User) error {
+	ttl := inviteTTL()
+	raw, err := IssuePasswordResetToken(u.ID, ttl)
+	if err != nil {
+		return err
+	}
+
+	return mail.Send(mail.Message{
+		To:      u.Email,
+		Subject: "You have been invited to Cinemesh",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nAn account has been created for you on Cinemesh.\n"+
+				"Open the link below within %d hours to choose your password:\n\n%s\n",
+			u.Username, int(ttl.Hours()), passwordResetURL(raw)),
+	})
+}
+
+// ResetPassword consumes a reset token, sets the new password and signs the
+// user out everywhere. The password is only hashed once the token has been
+// locked and checked, so made-up tokens cost nothing but a lookup.
+func ResetPassword(raw, newPassword string) (*users.User, error) {
+	var u users.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var rt PasswordResetToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", HashOpaqueToken(raw)).
+			First(&rt).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidResetToken
+			}
+			return err
+		}
+		if rt.UsedAt != nil || time.Now().After(rt.ExpiresAt) {
+			return ErrInvalidResetToken
+		}
+
+		if err := tx.First(&u, rt.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidResetToken
+			}
+			return err
+		}
+		if err := users.ValidatePassword(newPassword, u.Username, u.Email); err != nil {
+			return err
+		}
+		hash, err := users.HashPassword(newPassword)
+		if err != nil {
+			return fmt.Errorf("hash password: %w", err)
+		}
+
+		if err := tx.Model(&rt).Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		// Following the mailed link proves ownership of the address
+		updates := map[string]interface{}{"password_hash": hash}
+		if u.EmailVerifiedAt == nil {
+			updates["email_verified_at"] = time.Now()
+		}
+		return tx.Model(&u).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := RevokeUserRefreshTokens(u.ID); err != nil {
+		log.Printf("password reset: failed to revoke sessions of user %d: %v", u.ID, err)
+	}
+	return &u, nil
+}
+
+// ================================
+// HANDLERS
+// ================================
+
+type forgotPasswordDTO struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ForgotPasswordHandler mails a reset link. It answers the same way whether
+// or not the address belongs to an account.
+func ForgotPasswordHandler(c *gin.Context) {
+	var dto forgotPasswordDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Counted whether or not the address exists, so the limit gives nothing away
+	hour := time.Hour
+	if !allowRequest(c, "forgot:"+throttle.IPKey(c.ClientIP()), envInt("PASSWORD_RESET_MAX_PER_IP", 20), hour) ||
+		!allowRequest(c, "forgot:"+throttle.AccountKey(dto.Email), envInt("PASSWORD_RESET_MAX_PER_ACCOUNT", 3), hour) {
+		return
+	}
+
+	// Looked up and mailed in the background so the response time doesn't
+	// reveal whether the address is registered
+	go sendPasswordReset(dto.Email)
+
+	c.JSON(http.StatusOK, gin.H{"message": "if the address is registered, a reset link has been sent"})
+}
+
+// sendPasswordReset issues a reset token for the account registered under
+// email, if any, and mails the link to it.
+func sendPasswordReset(email string) {
+	var u users.User
+	if err := database.DB.First(&u, "email = ?", email).Error; err != nil {
+		return
+	}
+	ttl := passwordResetTTL()
+	raw, err := IssuePasswordResetToken(u.ID, ttl)
+	if err != nil {
+		log.Printf("password reset: %v", err)
+		return
+	}
+	msg := mail.Message{
+		To:      u.Email,
+		Subject: "Reset your Cinemesh password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password of your Cinemesh account.\n"+
+				"Open the link below within %d minutes to choose a new one:\n\n%s\n\n"+
+				"If this wasn't you, you can ignore this email.\n",
+			u.Username, int(ttl.Minutes()), passwordResetURL(raw)),
+	}
+	if err := mail.Send(msg); err != nil {
+		log.Printf("password reset: failed to mail user %d: %v", u.ID, err)
+	}
+}
+
+type resetPasswordDTO struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// ResetPasswordHandler sets the new password, from JSON or from the form
+// served by ResetPasswordFormHandler. Attempts are limited per client IP.
+func ResetPasswordHandler(c *gin.Context) {
+	if !allowRequest(c, "reset:"+throttle.IPKey(c.ClientIP()), envInt("PASSWORD_RESET_ATTEMPTS_PER_IP", 20), time.Hour) {
+		return
+	}
+	if c.ContentType() == "application/x-www-form-urlencoded" {
+		resetPasswordForm(c)
+		return
+	}
+
+	var dto resetPasswordDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := ResetPassword(dto.Token, dto.Password); err != nil {
+		var policy *users.PolicyError
+		if errors.Is(err, ErrInvalidResetToken) || errors.As(err, &policy) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "password updated"})
+}
+
+// ResetPasswordFormHandler is the page the mailed link opens when
+// PASSWORD_RESET_URL is not set. It posts back to ResetPasswordHandler.
+func ResetPasswordFormHandler(c *gin.Context) {
+	// Keep the token out of the Referer sent for the page's assets
+	c.Header("Referrer-Policy", "no-referrer")
+	token := c.Query("token")
+	if token == "" {
+		c.HTML(http.StatusBadRequest, "password_reset.html", gin.H{"title": "Reset password", "error": ErrInvalidResetToken.Error()})
+		return
+	}
+	c.HTML(http.StatusOK, "password_reset.html", gin.H{"title": "Reset password", "token": token})
+}
+
+func resetPasswordForm(c *gin.Context) {
+	token := c.PostForm("token")
+	password := c.PostForm("password")
+	data := gin.H{"title": "Reset password", "token": token}
+
+	if password != c.PostForm("password_confirm") {
+		data["error"] = "the passwords do not match"
+		c.HTML(http.StatusBadRequest, "password_reset.html", data)
+		return
+	}
+
+	if _, err := ResetPassword(token, password); err != nil {
+		var policy *users.PolicyError
+		switch {
+		case errors.Is(err, ErrInvalidResetToken):
+			// The link is spent; asking again for a password won't help
+			c.HTML(http.StatusBadRequest, "password_reset.html", gin.H{"title": "Reset password", "error": err.Error()})
+		case errors.As(err, &policy):
+			data["error"] = err.Error()
+			c.HTML(http.StatusBadRequest, "password_reset.html", data)
+		default:
+			data["error"] = "failed to reset password"
+			c.HTML(http.StatusInternalServerError, "password_reset.html", data)
+		}
+		return
+	}
+
+	c.HTML(http.StatusOK, "password_reset.html", gin.H{"title": "Reset password", "done": true})
+}
@@ -0,0 +1,310 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/mail"
+	"github.com/Ponloe/cinemesh-core/internal/media"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+)
+
+func currentUser(c *gin.Context) (*users.User, bool) {
+	var u users.User
+	if err := database.DB.First(&u, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return nil, false
+	}
+	return &u, true
+}
+
+// reissueTokens answers a profile change with a new access token for the
+// caller's current session, so the claims match the updated user. The
+// refresh token stays valid. Browser sessions get a new access cookie too.
+// It never runs for impersonated requests: the new token would be a plain
+// one for the user, without the act claim or the impersonation TTL.
+func reissueTokens(c *gin.Context, u *users.User) {
+	if _, _, ok := Impersonator(c); ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": ErrImpersonating.Error()})
+		return
+	}
+	access, err := GenerateToken(u, c.GetString("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	if cookieSession(c) {
+		setAccessCookie(c, access)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      access,
+		"expires_in": int(AccessTokenTTL().Seconds()),
+		"user":       profileJSON(u),
+	})
+}
+
+// startNewSession answers with a token pair for a new session, for changes
+// that sign out every existing one.
+func startNewSession(c *gin.Context, u *users.User) {
+	access, refresh, err := IssueTokenPair(u, ClientInfoFrom(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+	if cookieSession(c) {
+		SetAuthCookies(c, access, refresh)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         access,
+		"refresh_token": refresh,
+		"expires_in":    int(AccessTokenTTL().Seconds()),
+		"user":          profileJSON(u),
+	})
+}
+
+// checkCurrentPassword confirms a sensitive change with the user's password.
+// It goes through Authenticate so guesses are throttled like logins.
+func checkCurrentPassword(c *gin.Context, u *users.User, password string) bool {
+	if _, err := Authenticate(u.Email, password, c.ClientIP()); err != nil {
+		var lockout *LockoutError
+		if errors.As(err, &lockout) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": lockout.Error()})
+			return false
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is incorrect"})
+		return false
+	}
+	return true
+}
+
+// cookieSession reports whether the caller is signed in with cookies rather
+// than an Authorization header.
+func cookieSession(c *gin.Context) bool {
+	return !strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+func profileJSON(u *users.User) gin.H {
+	return gin.H{
+		"id":             u.ID,
+		"username":       u.Username,
+		"email":          u.Email,
+		"email_verified": u.EmailVerifiedAt != nil,
+		"avatar_url":     u.AvatarURL,
+		"role":           u.Role,
+	}
+}
+
+// ================================
+// PROFILE
+// ================================
+
+type updateMeDTO struct {
+	Username        *string `json:"username" binding:"omitempty,min=3,max=50"`
+	Email           *string `json:"email" binding:"omitempty,email,max=100"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+// UpdateMeHandler changes the caller's username and/or email. Changing the
+// email needs the current password, notifies the old address and has to be
+// verified again.
+func UpdateMeHandler(c *gin.Context) {
+	var dto updateMeDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	updates := map[string]interface{}{}
+	emailChanged := false
+	if dto.Username != nil && strings.TrimSpace(*dto.Username) != u.Username {
+		updates["username"] = strings.TrimSpace(*dto.Username)
+	}
+	if dto.Email != nil && !strings.EqualFold(strings.TrimSpace(*dto.Email), u.Email) {
+		updates["email"] = strings.TrimSpace(*dto.Email)
+		updates["email_verified_at"] = nil
+		emailChanged = true
+	}
+	if len(updates) == 0 {
+		reissueTokens(c, u)
+		return
+	}
+	// The email is where password resets go, so a stolen token alone must
+	// not be enough to take the account over
+	if emailChanged {
+		if dto.CurrentPassword == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "current_password is required to change the email"})
+			return
+		}
+		if !checkCurrentPassword(c, u, dto.CurrentPassword) {
+			return
+		}
+	}
+
+	oldEmail := u.Email
+	if err := database.DB.Model(u).Updates(updates).Error; err != nil {
+		if strings.Contains(err.Error(), "duplicate key") {
+			c.JSON(http.StatusConflict, gin.H{"error": "username or email already taken"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update profile"})
+		return
+	}
+	if err := database.DB.First(u, u.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reload profile"})
+		return
+	}
+
+	if emailChanged {
+		SendVerificationEmail(u)
+		notify(oldEmail, "Your Cinemesh email address was changed",
+			fmt.Sprintf("Hi %s,\n\nThe email address of your Cinemesh account was changed to %s.\n"+
+				"If you didn't do this, reset your password and contact support.\n", u.Username, u.Email))
+	}
+
+	reissueTokens(c, u)
+}
+
+type changePasswordDTO struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ChangePasswordHandler sets a new password after checking the current one.
+// Every other session is signed out.
+func ChangePasswordHandler(c *gin.Context) {
+	var dto changePasswordDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	u, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	if !checkCurrentPassword(c, u, dto.CurrentPassword) {
+		return
+	}
+	if err := users.ValidatePassword(dto.NewPassword, u.Username, u.Email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := users.HashPassword(dto.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+	if err := database.DB.Model(u).Update("password_hash", hash).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update password"})
+		return
+	}
+	if err := RevokeUserRefreshTokens(u.ID); err != nil {
+		log.Printf("profile: failed to revoke sessions of user %d: %v", u.ID, err)
+	}
+
+	notify(u.Email, "Your Cinemesh password was changed",
+		fmt.Sprintf("Hi %s,\n\nThe password of your Cinemesh account was just changed.\n"+
+			"If you didn't do this, reset your password right away.\n", u.Username))
+
+	startNewSession(c, u)
+}
+
+// ================================
+// AVATAR
+// ================================
+
+// UploadAvatarHandler accepts a multipart "avatar" file.
+func UploadAvatarHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, media.MaxAvatarBytes+1<<20)
+
+	file, err := c.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "multipart field 'avatar' is required"})
+		return
+	}
+	if file.Size > media.MaxAvatarBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": media.ErrAvatarTooLarge.Error()})
+		return
+	}
+
+	u, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read upload"})
+		return
+	}
+	defer f.Close()
+
+	url, err := media.SaveAvatar(u.ID, f)
+	if err != nil {
+		switch {
+		case errors.Is(err, media.ErrAvatarTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, media.ErrUnsupportedImage), errors.Is(err, media.ErrImageTooManyPixels):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		default:
+			log.Printf("avatar upload failed for user %d: %v", u.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store avatar"})
+		}
+		return
+	}
+
+	old := u.AvatarURL
+	if err := database.DB.Model(u).Update("avatar_url", url).Error; err != nil {
+		media.DeleteAvatar(url)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update profile"})
+		return
+	}
+	u.AvatarURL = url
+	if err := media.DeleteAvatar(old); err != nil {
+		log.Printf("failed to delete old avatar %s: %v", old, err)
+	}
+
+	reissueTokens(c, u)
+}
+
+func DeleteAvatarHandler(c *gin.Context) {
+	u, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	old := u.AvatarURL
+	if err := database.DB.Model(u).Update("avatar_url", "").Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update profile"})
+		return
+	}
+	u.AvatarURL = ""
+	if err := media.DeleteAvatar(old); err != nil {
+		log.Printf("failed to delete old avatar %s: %v", old, err)
+	}
+
+	reissueTokens(c, u)
+}
+
+// notify sends a security notice in the background.
+func notify(to, subject, body string) {
+	go func() {
+		if err := mail.Send(mail.Message{To: to, Subject: subject, Body: body}); err != nil {
+			log.Printf("failed to send notice to %s: %v", to, err)
+		}
+	}()
+}
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is a persisted, single-use refresh token. Every rotation
+// creates a new row in the same family; presenting an already rotated token
+// revokes the whole family, unless it was rotated within the reuse grace
+// period (see reuseGrace).
+type RefreshToken struct {
+	ID           uint      `gorm:"primaryKey"`
+	UserID       uint      `gorm:"not null;index"`
+	TokenHash    string    `gorm:"size:64;uniqueIndex;not null"`
+	FamilyID     string    `gorm:"size:64;not null;index"`
+	ClientID     string    `gorm:"size:64"` // OIDC client, empty for Core's own logins
+	ExpiresAt    time.Time `gorm:"not null"`
+	RevokedAt    *time.Time
+	ReplacedByID *uint
+	ReplayedAt   *time.Time // presented once more within the grace period
+	CreatedAt    time.Time
+}
+
+// AccessTokenTTL is the lifetime of access tokens (JWT_ACCESS_TTL_MINUTES).
+func AccessTokenTTL() time.Duration {
+	minutes := 15
+	if v := os.Getenv("JWT_ACCESS_TTL_MINUTES"); v != "" {
+		if m, err := strconv.Atoi(v); err == nil && m > 0 {
+			minutes = m
+		}
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func refreshTokenTTL() time.Duration {
+	days := 30
+	if v := os.Getenv("JWT_REFRESH_TTL_DAYS"); v != "" {
+		if d, err := strconv.Atoi(v); err == nil && d > 0 {
+			days = d
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// NewOpaqueToken returns a random URL-safe token and its SHA-256 hex digest.
+// Only the digest is ever stored.
+func NewOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	raw := base64.RawURLEncoding.EncodeToString(b)
+	return raw, HashOpaqueToken(raw), nil
+}
+
+// HashOpaqueToken is the digest used to look up an opaque token.
+func HashOpaqueToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func newFamilyID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IssueRefreshToken starts a new token family, and with it a new session,
+// for the user. It returns the token and the family id.
+func IssueRefreshToken(userID uint, client ClientInfo) (string, string, error) {
+	familyID, err := newFamilyID()
+	if err != nil {
+		return "", "", fmt.Errorf("family id: %w", err)
+	}
+
+	var raw string
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := createSession(tx, userID, familyID, client); err != nil {
+			return fmt.Errorf("create session: %w", err)
+		}
+		raw, _, err = createRefreshToken(tx, userID, familyID, client.OAuthClientID)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return raw, familyID, nil
+}
+
+func createRefreshToken(tx *gorm.DB, userID uint, familyID, clientID string) (string, *RefreshToken, error) {
+	raw, hash, err := NewOpaqueToken()
+	if err != nil {
+		return "", nil, fmt.Errorf("generate refresh token: %w", err)
+	}
+	rt := RefreshToken{
+		UserID:    userID,
+		TokenHash: hash,
+		FamilyID:  familyID,
+		ClientID:  clientID,
+		ExpiresAt: time.Now().Add(refreshTokenTTL()),
+	}
+	if err := tx.Create(&rt).Error; err != nil {
+		return "", nil, fmt.Errorf("create refresh token: %w", err)
+	}
+	return raw, &rt, nil
+}
+
+// reuseGrace is how long a just-rotated token keeps working
+// (REFRESH_REUSE_GRACE_SECONDS, 10 by default). Clients often refresh from
+// several tabs or requests at once; all but the first would otherwise look
+// like a stolen token and sign the user out.
+func reuseGrace() time.Duration {
+	return time.Duration(envInt("REFRESH_REUSE_GRACE_SECONDS", 10)) * time.Second
+}
+
+// graceReplay reports whether presenting the already revoked rt at now is
+// the one replay allowed after a rotation. Tokens revoked by a logout or a
+// detected reuse have no successor and never qualify.
+func graceReplay(rt *RefreshToken, now time.Time) bool {
+	return rt.ReplacedByID != nil && rt.RevokedAt != nil && rt.ReplayedAt == nil &&
+		now.Sub(*rt.RevokedAt) <= reuseGrace()
+}
+
+// recentlyRotated reports whether rt may be replayed (see graceReplay) and
+// its session is still signed in.
+func recentlyRotated(tx *gorm.DB, rt *RefreshToken) (bool, error) {
+	if !graceReplay(rt, time.Now()) {
+		return false, nil
+	}
+	var s Session
+	if err := tx.Where("family_id = ?", rt.FamilyID).First(&s).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return s.RevokedAt == nil, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same
+// family and returns the owning user and the session (family) id. A token
+// that was already rotated or revoked is treated as stolen and takes its
+// whole family down with it. The one exception is a single replay within
+// reuseGrace of its rotation: it returns no new refresh token, only the
+// user and session for a new access token, and the caller keeps the
+// successor the first rotation handed out. Tokens only work for the OIDC
+// client they were issued to (client.OAuthClientID), and Core's own only
+// without one.
+func RotateRefreshToken(raw string, client ClientInfo) (*users.User, string, string, error) {
+	var (
+		u        users.User
+		newRaw   string
+		familyID string
+		reused   bool
+	)
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var rt RefreshToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", HashOpaqueToken(raw)).
+			First(&rt).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidRefreshToken
+			}
+			return err
+		}
+
+		rotated := rt.RevokedAt != nil
+		if rotated {
+			ok, err := recentlyRotated(tx, &rt)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				reused = true
+				return revokeFamily(tx, rt.FamilyID)
+			}
+		}
+		if time.Now().After(rt.ExpiresAt) || rt.ClientID != client.OAuthClientID {
+			return ErrInvalidRefreshToken
+		}
+
+		if err := tx.First(&u, rt.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidRefreshToken
+			}
+			return err
+		}
+		if err := CheckRestriction(u.ID); err != nil {
+			return err
+		}
+
+		if err := refreshSession(tx, rt.UserID, rt.FamilyID, client); err != nil {
+			return err
+		}
+		familyID = rt.FamilyID
+
+		now := time.Now()
+		if rotated {
+			// A parallel request rotated it moments ago and already got the
+			// successor; this one only gets an access token, and only once
+			return tx.Model(&rt).Update("replayed_at", now).Error
+		}
+
+		var next *RefreshToken
+		var err error
+		newRaw, next, err = createRefreshToken(tx, rt.UserID, rt.FamilyID, rt.ClientID)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&rt).Updates(map[string]interface{}{
+			"revoked_at":     now,
+			"replaced_by_id": next.ID,
+		}).Error
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+	if reused {
+		log.Printf("refresh token reuse detected, family revoked")
+		return nil, "", "", ErrRefreshTokenReused
+	}
+	return &u, newRaw, familyID, nil
+}
+
+// RevokeRefreshToken revokes the family the given token belongs to. Unknown
+// tokens are ignored so logout stays idempotent.
+func RevokeRefreshToken(raw string) error {
+	var rt RefreshToken
+	if err := database.DB.Where("token_hash = ?", HashOpaqueToken(raw)).First(&rt).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	return revokeFamily(database.DB, rt.FamilyID)
+}
+
+// RevokeUserRefreshTokens revokes every outstanding refresh token and
+// session of a user, signing out all of their devices.
+func RevokeUserRefreshTokens(userID uint) error {
+	now := time.Now()
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", now).Error
+	})
+}
+
+func revokeFamily(tx *gorm.DB, familyID string) error {
+	now := time.Now()
+	if err := tx.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return tx.Model(&Session{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", now).Error
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGraceReplay(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time { at := now.Add(-d); return &at }
+	successor := uint(2)
+
+	tests := []struct {
+		name  string
+		grace string
+		rt    RefreshToken
+		want  bool
+	}{
+		{"rotated moments ago", "", RefreshToken{RevokedAt: ago(2 * time.Second), ReplacedByID: &successor}, true},
+		{"rotated at the end of the grace period", "", RefreshToken{RevokedAt: ago(10 * time.Second), ReplacedByID: &successor}, true},
+		{"rotated after the grace period", "", RefreshToken{RevokedAt: ago(11 * time.Second), ReplacedByID: &successor}, false},
+		{"already replayed once", "", RefreshToken{RevokedAt: ago(2 * time.Second), ReplacedByID: &successor, ReplayedAt: ago(time.Second)}, false},
+		{"revoked by logout", "", RefreshToken{RevokedAt: ago(2 * time.Second)}, false},
+		{"never revoked", "", RefreshToken{ReplacedByID: &successor}, false},
+		{"longer configured grace", "60", RefreshToken{RevokedAt: ago(30 * time.Second), ReplacedByID: &successor}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.grace != "" {
+				t.Setenv("REFRESH_REUSE_GRACE_SECONDS", tt.grace)
+			}
+			if got := graceReplay(&tt.rt, now); got != tt.want {
+				t.Errorf("graceReplay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+// sessionTouchInterval limits how often a request updates LastSeenAt.
+const sessionTouchInterval = time.Minute
+
+// Session is one signed-in device. It lives as long as its refresh token
+// family, and access tokens name it in their sid claim so that signing a
+// device out takes effect immediately rather than when its token expires.
+type Session struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"-"`
+	FamilyID   string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	UserAgent  string     `gorm:"size:512" json:"user_agent"`
+	IP         string     `gorm:"size:64" json:"ip"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CSRFToken  string     `gorm:"size:64" json:"-"`
+	// AuthenticatedAt is when the user signed in; refreshes keep it
+	AuthenticatedAt *time.Time `json:"authenticated_at,omitempty"`
+	// Scope lists the OIDC scopes the session was granted; empty for Core's
+	// own logins
+	Scope     string    `gorm:"size:255" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuthTime is when the user signed in to start the session. Sessions from
+// before it was recorded fall back to their creation time.
+func (s *Session) AuthTime() time.Time {
+	if s.AuthenticatedAt != nil {
+		return *s.AuthenticatedAt
+	}
+	return s.CreatedAt
+}
+
+// ClientInfo describes the device a session is created from and, for
+// OIDC, the client application it signed in to.
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+	// OAuthClientID is the registered client the refresh tokens are issued
+	// to; empty for Core's own logins
+	OAuthClientID string
+	// Scope and AuthTime carry over from the authorization code, so that
+	// refreshes keep the scopes granted and the original sign-in time
+	Scope    string
+	AuthTime time.Time
+}
+
+func ClientInfoFrom(c *gin.Context) ClientInfo {
+	ua := c.Request.UserAgent()
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+	return ClientInfo{UserAgent: ua, IP: c.ClientIP()}
+}
+
+func createSession(tx *gorm.DB, userID uint, familyID string, client ClientInfo) error {
+	csrfToken, err := newCSRFToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	authTime := client.AuthTime
+	if authTime.IsZero() {
+		authTime = now
+	}
+	return tx.Create(&Session{
+		UserID:          userID,
+		FamilyID:        familyID,
+		UserAgent:       client.UserAgent,
+		IP:              client.IP,
+		LastSeenAt:      now,
+		ExpiresAt:       now.Add(refreshTokenTTL()),
+		CSRFToken:       csrfToken,
+		AuthenticatedAt: &authTime,
+		Scope:           client.Scope,
+	}).Error
+}
+
+// refreshSession records a refresh of the family's session. Families issued
+// before sessions existed get one on their first refresh.
+func refreshSession(tx *gorm.DB, userID uint, familyID string, client ClientInfo) error {
+	res := tx.Model(&Session{}).
+		Where("family_id = ?", familyID).
+		Updates(map[string]interface{}{
+			"user_agent":   client.UserAgent,
+			"ip":           client.IP,
+			"last_seen_at": time.Now(),
+			"expires_at":   time.Now().Add(refreshTokenTTL()),
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return createSession(tx, userID, familyID, client)
+	}
+	return nil
+}
+
+// checkSession rejects access tokens whose session was signed out and keeps
+// LastSeenAt current.
+func checkSession(claims *Claims, ip string) error {
+	if claims.SessionID == "" {
+		return ErrSessionRevoked
+	}
+
+	var s Session
+	if err := database.DB.Where("family_id = ?", claims.SessionID).First(&s).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionRevoked
+		}
+		return err
+	}
+	if s.UserID != claims.SessionOwner() || s.RevokedAt != nil || time.Now().After(s.ExpiresAt) {
+		return ErrSessionRevoked
+	}
+
+	if time.Since(s.LastSeenAt) > sessionTouchInterval {
+		if err := database.DB.Model(&s).Updates(map[string]interface{}{"last_seen_at": time.Now(), "ip": ip}).Error; err != nil {
+			log.Printf("session %d: failed to update last seen: %v", s.ID, err)
+		}
+	}
+	return nil
+}
+
+// FindSession returns the session with the given ID, as carried in the
+// session_id claim of access tokens.
+func FindSession(sessionID string) (*Session, error) {
+	var s Session
+	if err := database.DB.Where("family_id = ?", sessionID).First(&s).Error; err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ActiveSessions lists a user's signed-in devices, most recently used first.
+func ActiveSessions(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := database.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSession signs a device out: its refresh tokens stop working and its
+// access tokens are refused by RequireAuth.
+func RevokeSession(userID, sessionID uint) error {
+	var s Session
+	if err := database.DB.Where("id = ? AND user_id = ?", sessionID, userID).First(&s).Error; err != nil {
+		return err
+	}
+	return revokeFamily(database.DB, s.FamilyID)
+}
+
+// ================================
+// HANDLERS
+// ================================
+
+// ListSessionsHandler returns the signed-in user's devices. The one making
+// the request is flagged as current.
+func ListSessionsHandler(c *gin.Context) {
+	sessions, err := ActiveSessions(c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	current := c.GetString("session_id")
+	out := make([]gin.H, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, gin.H{
+			"id":           s.ID,
+			"user_agent":   s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt,
+			"last_seen_at": s.LastSeenAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.FamilyID == current,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": out})
+}
+
+// RevokeSessionHandler signs one of the user's devices out.
+func RevokeSessionHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	if err := RevokeSession(c.GetUint("user_id"), uint(id)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTOTPNotEnrolled      = errors.New("two-factor authentication is not set up")
+	ErrTOTPAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrInvalidSecondFactor  = errors.New("invalid authentication code")
+	ErrTOTPRequiredByPolicy = errors.New("two-factor authentication is mandatory for admin accounts")
+)
+
+// TOTPCredential is a user's authenticator app secret (RFC 6238). It only
+// takes effect once ConfirmedAt is set.
+type TOTPCredential struct {
+	ID           uint   `gorm:"primaryKey"`
+	UserID       uint   `gorm:"uniqueIndex;not null"`
+	Secret       string `gorm:"size:64;not null"`
+	ConfirmedAt  *time.Time
+	LastUsedStep int64
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (TOTPCredential) TableName() string {
+	return "totp_credentials"
+}
+
+// RecoveryCode is a single-use fallback for a lost authenticator.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"size:64;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// AdminTwoFactorRequired reports whether accounts with admin panel access
+// must use 2FA (REQUIRE_ADMIN_2FA=true).
+func AdminTwoFactorRequired() bool {
+	return os.Getenv("REQUIRE_ADMIN_2FA") == "true"
+}
+
+// TOTPEnabled reports whether the user has a confirmed authenticator.
+// Callers must treat an error as "unknown" and refuse to sign the user in,
+// never as "disabled".
+func TOTPEnabled(userID uint) (bool, error) {
+	var count int64
+	if err := database.DB.Model(&TOTPCredential{}).
+		Where("user_id = ? AND confirmed_at IS NOT NULL", userID).
+		Count(&count).Error; err != nil {
+		return false, fmt.Errorf("check two-factor status: %w", err)
+	}
+	return count > 0, nil
+}
+
+// enforceAdminTwoFactor cuts the permissions of an admin panel account down
+// to admin:access while REQUIRE_ADMIN_2FA=true and the account has no
+// authenticator. That is enough to reach the enrollment page; every other
+// permission only appears in tokens issued after enrollment, so tokens from
+// /login or /oauth/token can't be used elsewhere without the second factor.
+func enforceAdminTwoFactor(userID uint, perms []string) ([]string, error) {
+	if !AdminTwoFactorRequired() || !rbac.Contains(perms, rbac.AdminAccess) {
+		return perms, nil
+	}
+	enabled, err := TOTPEnabled(userID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return perms, nil
+	}
+	return []string{rbac.AdminAccess}, nil
+}
+
+// BeginTOTPEnrollment creates a new, unconfirmed secret for the user and
+// returns it with its otpauth:// provisioning URI.
+func BeginTOTPEnrollment(u *users.User) (string, string, error) {
+	enabled, err := TOTPEnabled(u.ID)
+	if err != nil {
+		return "", "", err
+	}
+	if enabled {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generate secret: %w", err)
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	cred := TOTPCredential{UserID: u.ID, Secret: secret}
+	if err := database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "confirmed_at", "last_used_step", "updated_at"}),
+	}).Create(&cred).Error; err != nil {
+		return "", "", fmt.Errorf("store secret: %w", err)
+	}
+
+	return secret, provisioningURI(u.Email, secret), nil
+}
+
+// PendingTOTPEnrollment returns the unconfirmed secret of the user, if any,
+// so a failed confirmation can be retried without rescanning.
+func PendingTOTPEnrollment(u *users.User) (string, string, bool) {
+	var cred TOTPCredential
+	if err := database.DB.Where("user_id = ? AND confirmed_at IS NULL", u.ID).First(&cred).Error; err != nil {
+		return "", "", false
+	}
+	return cred.Secret, provisioningURI(u.Email, cred.Secret), true
+}
+
+func provisioningURI(account, secret string) string {
+	issuer := os.Getenv("APP_NAME")
+	if issuer == "" {
+		issuer = "Cinemesh"
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + params.Encode()
+}
+
+// ConfirmTOTPEnrollment activates the pending secret once the user proves
+// their app produces valid codes, and returns a fresh set of recovery codes.
+func ConfirmTOTPEnrollment(userID uint, code string) ([]string, error) {
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var cred TOTPCredential
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", userID).First(&cred).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrTOTPNotEnrolled
+			}
+			return err
+		}
+		if cred.ConfirmedAt != nil {
+			return ErrTOTPAlreadyEnabled
+		}
+
+		step, ok := validateTOTP(cred.Secret, code, cred.LastUsedStep, time.Now())
+		if !ok {
+			return ErrInvalidSecondFactor
+		}
+
+		now := time.Now()
+		if err := tx.Model(&cred).Updates(map[string]interface{}{
+			"confirmed_at":   now,
+			"last_used_step": step,
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// RegenerateRecoveryCodes invalidates the old recovery codes after checking
+// a current authenticator code. Wrong codes count towards the 2FA lockout.
+func RegenerateRecoveryCodes(userID uint, code, clientIP string) ([]string, error) {
+	if err := VerifySecondFactorThrottled(userID, code, clientIP); err != nil {
+		return nil, err
+	}
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// DisableTOTP removes the authenticator and recovery codes after checking
+// the password and a current code, both throttled like a login. Admins
+// cannot opt out while the policy is on.
+func DisableTOTP(u *users.User, password, code, clientIP string) error {
+	if AdminTwoFactorRequired() && rbac.RoleHasPermission(u.Role, rbac.AdminAccess) {
+		return ErrTOTPRequiredByPolicy
+	}
+	if _, err := Authenticate(u.Email, password, clientIP); err != nil {
+		return err
+	}
+	if err := VerifySecondFactorThrottled(u.ID, code, clientIP); err != nil {
+		return err
+	}
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", u.ID).Delete(&TOTPCredential{}).Error
+	})
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Each TOTP step and each recovery code works only once.
+// Endpoints should call VerifySecondFactorThrottled instead.
+func VerifySecondFactor(userID uint, code string) error {
+	code = strings.TrimSpace(code)
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var cred TOTPCredential
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND confirmed_at IS NOT NULL", userID).
+			First(&cred).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrTOTPNotEnrolled
+			}
+			return err
+		}
+
+		if len(code) == totpDigits {
+			step, ok := validateTOTP(cred.Secret, code, cred.LastUsedStep, time.Now())
+			if !ok {
+				return ErrInvalidSecondFactor
+			}
+			return tx.Model(&cred).Update("last_used_step", step).Error
+		}
+
+		res := tx.Model(&RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, HashOpaqueToken(normalizeRecoveryCode(code))).
+			Update("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidSecondFactor
+		}
+		return nil
+	})
+}
+
+// RemainingRecoveryCodes counts the unused recovery codes of a user.
+func RemainingRecoveryCodes(userID uint) int64 {
+	var count int64
+	database.DB.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+		rows[i] = RecoveryCode{UserID: userID, CodeHash: HashOpaqueToken(h)}
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// ================================
+// RFC 6238
+// ================================
+
+// validateTOTP accepts codes from one step before to one step after now,
+// but never a step at or before lastStep, so a code can't be replayed.
+func validateTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000)
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// rfc6238Key is the SHA-1 seed of the RFC 6238 test vectors.
+var rfc6238Key = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, cut to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode(T=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(rfc6238Key)
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+	code := func(s int64) string { return totpCode(rfc6238Key, s) }
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", secret, code(step), 0, step, true},
+		{"previous step", secret, code(step - 1), 0, step - 1, true},
+		{"next step", secret, code(step + 1), 0, step + 1, true},
+		{"two steps old", secret, code(step - 2), 0, 0, false},
+		{"two steps ahead", secret, code(step + 2), 0, 0, false},
+		{"lower-case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code(step), 0, step, true},
+		{"replayed code", secret, code(step), step, 0, false},
+		{"older than the last used step", secret, code(step - 1), step - 1, 0, false},
+		{"newer than the last used step", secret, code(step + 1), step, step + 1, true},
+		{"wrong code", secret, "000000", 0, 0, false},
+		{"too short", secret, code(step)[:5], 0, 0, false},
+		{"too long", secret, code(step) + "0", 0, 0, false},
+		{"invalid secret", "not base32!", code(step), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := validateTOTP(tt.secret, tt.code, tt.lastStep, now)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("validateTOTP() = %d, %v, want %d, %v", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
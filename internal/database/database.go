@@ -8,6 +8,7 @@ import (
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
@@ -70,3 +71,37 @@ func Migrate(models ...interface{}) error {
 	log.Println("migrations complete")
 	return nil
 }
+
+// DataMigration records a one-time data change that has been applied.
+type DataMigration struct {
+	Name      string `gorm:"primaryKey;size:100"`
+	AppliedAt time.Time
+}
+
+func (DataMigration) TableName() string {
+	return "data_migrations"
+}
+
+// RunOnce applies fn unless a migration called name has been recorded
+// already. The record is written in the same transaction, so concurrent
+// instances wait for each other and only one of them runs fn.
+func RunOnce(name string, fn func(tx *gorm.DB) error) error {
+	if err := DB.AutoMigrate(&DataMigration{}); err != nil {
+		return fmt.Errorf("auto migrate: %w", err)
+	}
+	return DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&DataMigration{Name: name, AppliedAt: time.Now()})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+		log.Printf("running data migration %s", name)
+		if err := fn(tx); err != nil {
+			return fmt.Errorf("data migration %s: %w", name, err)
+		}
+		return nil
+	})
+}
@@ -3,6 +3,7 @@ package forum
 import (
 	"net/http"
 
+	"github.com/Ponloe/cinemesh-core/internal/audit"
 	"github.com/gin-gonic/gin"
 )
 
@@ -22,6 +23,7 @@ func DeleteReplyHandler(c *gin.Context) {
 		})
 		return
 	}
+	audit.Record(c, "forum.reply.delete", "forum_reply", replyID, nil, nil)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Reply deleted successfully",
@@ -53,6 +55,11 @@ func PinThreadHandler(c *gin.Context) {
 		})
 		return
 	}
+	action := "forum.thread.unpin"
+	if req.IsPinned {
+		action = "forum.thread.pin"
+	}
+	audit.Record(c, action, "forum_thread", threadID, nil, gin.H{"is_pinned": req.IsPinned})
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Thread updated successfully",
@@ -79,6 +86,7 @@ func DeleteThreadHandler(c *gin.Context) {
 		})
 		return
 	}
+	audit.Record(c, "forum.thread.delete", "forum_thread", threadSlug, nil, nil)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Thread deleted successfully",
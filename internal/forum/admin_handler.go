@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/Ponloe/cinemesh-core/internal/audit"
 	"github.com/gin-gonic/gin"
 )
 
@@ -109,13 +110,14 @@ func CreateTopicHandler(c *gin.Context) {
 	client := GetClient()
 	client.Token = token.(string)
 
-	_, err := client.CreateTopic(req.Name, req.Description, req.Icon)
+	topic, err := client.CreateTopic(req.Name, req.Description, req.Icon)
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "forum_topic_form.html", gin.H{
 			"error": "Failed to create topic: " + err.Error(),
 		})
 		return
 	}
+	audit.Record(c, "forum.topic.create", "forum_topic", topic.Slug, nil, topic)
 
 	c.Redirect(http.StatusFound, "/admin/forum")
 }
@@ -134,12 +136,14 @@ func DeleteTopicHandler(c *gin.Context) {
 	client := GetClient()
 	client.Token = token.(string)
 
+	before, _ := client.GetTopicBySlug(topicSlug)
 	if err := client.DeleteTopic(topicSlug); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to delete topic: " + err.Error(),
 		})
 		return
 	}
+	audit.Record(c, "forum.topic.delete", "forum_topic", topicSlug, before, nil)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Topic deleted successfully",
@@ -194,7 +198,8 @@ func UpdateTopicHandler(c *gin.Context) {
 	client := GetClient()
 	client.Token = token.(string)
 
-	_, err := client.UpdateTopic(topicSlug, req.Name, req.Description, req.Icon)
+	before, _ := client.GetTopicBySlug(topicSlug)
+	after, err := client.UpdateTopic(topicSlug, req.Name, req.Description, req.Icon)
 	if err != nil {
 		// Fetch topic again to repopulate form
 		topic, _ := client.GetTopicBySlug(topicSlug)
@@ -205,6 +210,7 @@ func UpdateTopicHandler(c *gin.Context) {
 		})
 		return
 	}
+	audit.Record(c, "forum.topic.update", "forum_topic", topicSlug, before, after)
 
 	c.Redirect(http.StatusFound, "/admin/forum")
 }
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"time"
 )
 
 // Base Client
@@ -356,3 +357,95 @@ func (c *ForumClient) GetTopicBySlug(slug string) (*Topic, error) {
 
 	return &topic, nil
 }
+
+// GetUserThreads fetches every thread created by a Core user
+func (c *ForumClient) GetUserThreads(userID string) ([]Thread, error) {
+	var threads []Thread
+	if err := c.getAuthorized(fmt.Sprintf("%s/api/forum/users/%s/threads", c.BaseURL, userID), &threads); err != nil {
+		return nil, err
+	}
+	return threads, nil
+}
+
+// GetUserReplies fetches every reply written by a Core user
+func (c *ForumClient) GetUserReplies(userID string) ([]Reply, error) {
+	var replies []Reply
+	if err := c.getAuthorized(fmt.Sprintf("%s/api/forum/users/%s/replies", c.BaseURL, userID), &replies); err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// AnonymizeUser asks the forum to strip a user's identity from their
+// threads and replies (account deletion)
+func (c *ForumClient) AnonymizeUser(userID string) error {
+	url := fmt.Sprintf("%s/api/forum/users/%s", c.BaseURL, userID)
+
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Nothing stored for this user is fine too
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("anonymize failed with status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// SoftDeleteUserThreads marks every thread of a Core user as deleted and
+// returns how many were changed
+func (c *ForumClient) SoftDeleteUserThreads(userID string) (int, error) {
+	threads, err := c.GetUserThreads(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, t := range threads {
+		if t.IsDeleted {
+			continue
+		}
+		if err := c.UpdateThread(t.ID, map[string]interface{}{"is_deleted": true}); err != nil {
+			return deleted, fmt.Errorf("thread %s: %w", t.ID, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (c *ForumClient) getAuthorized(url string, out interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("request failed with status: %d", resp.StatusCode)
+	}
+
+	var apiResp APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return err
+	}
+
+	data, _ := json.Marshal(apiResp.Data)
+	return json.Unmarshal(data, out)
+}
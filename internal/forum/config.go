@@ -1,10 +1,15 @@
 package forum
 
 import (
+	"errors"
 	"os"
 	"sync"
 )
 
+// ErrNoServiceToken is returned by ServiceClient when Core has no forum
+// credentials of its own.
+var ErrNoServiceToken = errors.New("no forum credentials, set FORUM_SERVICE_TOKEN")
+
 var (
 	client *ForumClient
 	once   sync.Once
@@ -27,3 +32,14 @@ func InitializeForumClient() {
 func GetClient() *ForumClient {
 	return client
 }
+
+// ServiceClient returns a forum client that authenticates as Core itself
+// with FORUM_SERVICE_TOKEN. Use it for calls Core makes on its own behalf,
+// which mustn't depend on an admin's or user's session staying valid.
+func ServiceClient() (*ForumClient, error) {
+	token := os.Getenv("FORUM_SERVICE_TOKEN")
+	if token == "" {
+		return nil, ErrNoServiceToken
+	}
+	return NewForumClient(client.BaseURL, token), nil
+}
@@ -0,0 +1,53 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileMailer writes each message as an .eml file into Dir, or prints it to
+// stdout when Dir is empty. Meant for development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	raw := buildMessage(m.From, msg)
+
+	if m.Dir == "" {
+		fmt.Printf("----- outgoing mail -----\n%s\n-------------------------\n", raw)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("create mail dir: %w", err)
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitizeFileName(msg.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(raw), 0o644)
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func buildMessage(from string, msg Message) string {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	return b.String()
+}
@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing email.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var (
+	mailer Mailer
+	once   sync.Once
+)
+
+// InitializeMailer picks the mailer from MAIL_DRIVER: "smtp" for real
+// delivery, anything else writes messages to MAIL_DIR (or stdout when unset).
+func InitializeMailer() {
+	once.Do(func() {
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			from = "Cinemesh <no-reply@cinemesh.local>"
+		}
+
+		switch os.Getenv("MAIL_DRIVER") {
+		case "smtp":
+			port, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
+			if port == 0 {
+				port = 587
+			}
+			mailer = &SMTPMailer{
+				Host:     os.Getenv("SMTP_HOST"),
+				Port:     port,
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+				From:     from,
+			}
+			log.Printf("✓ Mailer: smtp %s:%d", os.Getenv("SMTP_HOST"), port)
+		default:
+			mailer = &FileMailer{Dir: os.Getenv("MAIL_DIR"), From: from}
+			log.Println("✓ Mailer: file/stdout (set MAIL_DRIVER=smtp for real delivery)")
+		}
+	})
+}
+
+// GetMailer returns the global mailer
+func GetMailer() Mailer {
+	return mailer
+}
+
+// Send delivers a message with the global mailer
+func Send(msg Message) error {
+	return mailer.Send(msg)
+}
@@ -0,0 +1,40 @@
+package mail
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"strings"
+)
+
+// SMTPMailer delivers mail through an SMTP relay using PLAIN auth (STARTTLS
+// is negotiated automatically by net/smtp when the server offers it).
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid header value")
+	}
+
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("parse from address: %w", err)
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+	if err := smtp.SendMail(addr, auth, from.Address, []string{msg.To}, []byte(buildMessage(m.From, msg))); err != nil {
+		return fmt.Errorf("smtp send: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package media
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// MaxAvatarBytes is the largest upload accepted.
+	MaxAvatarBytes = 5 << 20
+	// AvatarSize is the edge length of the stored, square avatar.
+	AvatarSize = 256
+	// maxAvatarPixels guards against decompression bombs.
+	maxAvatarPixels = 25_000_000
+)
+
+var (
+	ErrAvatarTooLarge     = fmt.Errorf("avatar must be at most %d MB", MaxAvatarBytes>>20)
+	ErrUnsupportedImage   = errors.New("avatar must be a JPEG, PNG or GIF image")
+	ErrImageTooManyPixels = errors.New("avatar dimensions are too large")
+)
+
+// UploadDir is where uploaded files live (UPLOAD_DIR, default "uploads").
+// It is served under /uploads.
+func UploadDir() string {
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return "uploads"
+}
+
+func publicBaseURL() string {
+	if base := os.Getenv("BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// SaveAvatar validates an uploaded image, crops it to a centred square,
+// scales it to AvatarSize and stores it as JPEG. It returns the public URL.
+func SaveAvatar(userID uint, r io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxAvatarBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("read upload: %w", err)
+	}
+	if len(data) > MaxAvatarBytes {
+		return "", ErrAvatarTooLarge
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png" && format != "gif") {
+		return "", ErrUnsupportedImage
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return "", ErrUnsupportedImage
+	}
+	if cfg.Width*cfg.Height > maxAvatarPixels {
+		return "", ErrImageTooManyPixels
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", ErrUnsupportedImage
+	}
+
+	out := resizeSquare(src, AvatarSize)
+
+	dir := filepath.Join(UploadDir(), "avatars")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("create avatar dir: %w", err)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%d-%s.jpg", userID, hex.EncodeToString(suffix))
+
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("create avatar file: %w", err)
+	}
+	defer f.Close()
+	if err := jpeg.Encode(f, out, &jpeg.Options{Quality: 85}); err != nil {
+		return "", fmt.Errorf("encode avatar: %w", err)
+	}
+
+	return publicBaseURL() + "/uploads/avatars/" + name, nil
+}
+
+// DeleteAvatar removes a previously stored avatar. URLs that don't point to
+// our own storage (e.g. external avatars) are ignored.
+func DeleteAvatar(url string) error {
+	prefix := publicBaseURL() + "/uploads/avatars/"
+	if !strings.HasPrefix(url, prefix) {
+		return nil
+	}
+	name := filepath.Base(strings.TrimPrefix(url, prefix))
+	err := os.Remove(filepath.Join(UploadDir(), "avatars", name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// resizeSquare crops the centre square of src and box-filters it down to
+// size x size. Transparent areas end up white.
+func resizeSquare(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	// Flatten onto white first so alpha doesn't turn black in JPEG
+	flat := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, image.Pt(x0, y0), draw.Over)
+
+	if side <= size {
+		// Small images are enlarged by nearest neighbour
+		return scaleNearest(flat, size)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0 := dy * side / size
+		sy1 := (dy + 1) * side / size
+		for dx := 0; dx < size; dx++ {
+			sx0 := dx * side / size
+			sx1 := (dx + 1) * side / size
+
+			var r, g, bl, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				off := flat.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint32(flat.Pix[off])
+					g += uint32(flat.Pix[off+1])
+					bl += uint32(flat.Pix[off+2])
+					off += 4
+					n++
+				}
+			}
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+func scaleNearest(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		for dx := 0; dx < size; dx++ {
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4],
+				src.Pix[src.PixOffset(dx*side/size, dy*side/size):src.PixOffset(dx*side/size, dy*side/size)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,106 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func solid(w, h int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encode(t *testing.T, format string, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatalf("encode %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestSaveAvatar(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+
+	tests := []struct {
+		name    string
+		format  string
+		img     image.Image
+		wantErr error
+	}{
+		{"zero-sized jpeg", "jpeg", solid(0, 0, color.White), ErrUnsupportedImage},
+		{"zero-width jpeg", "jpeg", solid(0, 4, color.White), ErrUnsupportedImage},
+		{"zero-sized gif", "gif", solid(0, 0, color.White), ErrUnsupportedImage},
+		{"zero-height gif", "gif", solid(4, 0, color.White), ErrUnsupportedImage},
+		{"1x1 jpeg", "jpeg", solid(1, 1, color.Black), nil},
+		{"1x1 png", "png", solid(1, 1, color.Black), nil},
+		{"1x1 gif", "gif", solid(1, 1, color.Black), nil},
+		{"wide png", "png", solid(600, 300, color.Black), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, err := SaveAvatar(1, bytes.NewReader(encode(t, tt.format, tt.img)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SaveAvatar() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && url == "" {
+				t.Error("SaveAvatar() returned an empty URL")
+			}
+		})
+	}
+}
+
+func TestSaveAvatarRejectsGarbage(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	if _, err := SaveAvatar(1, bytes.NewReader([]byte("not an image"))); !errors.Is(err, ErrUnsupportedImage) {
+		t.Errorf("SaveAvatar() error = %v, want %v", err, ErrUnsupportedImage)
+	}
+}
+
+func TestResizeSquare(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	tests := []struct {
+		name string
+		src  image.Image
+		want color.RGBA
+	}{
+		{"1x1 is enlarged", solid(1, 1, red), red},
+		{"smaller than the avatar", solid(10, 10, red), red},
+		{"exactly the avatar size", solid(AvatarSize, AvatarSize, red), red},
+		{"larger and not square", solid(AvatarSize*3, AvatarSize+7, red), red},
+		{"transparent turns white", solid(4, 4, color.Transparent), color.RGBA{0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resizeSquare(tt.src, AvatarSize)
+			if b := got.Bounds(); b.Dx() != AvatarSize || b.Dy() != AvatarSize {
+				t.Fatalf("resizeSquare() size = %dx%d, want %dx%d", b.Dx(), b.Dy(), AvatarSize, AvatarSize)
+			}
+			for _, p := range []image.Point{{0, 0}, {AvatarSize / 2, AvatarSize / 2}, {AvatarSize - 1, AvatarSize - 1}} {
+				if c := got.RGBAAt(p.X, p.Y); c != tt.want {
+					t.Errorf("pixel %v = %v, want %v", p, c, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/Ponloe/cinemesh-core/internal/audit"
 	"github.com/Ponloe/cinemesh-core/internal/database"
 	"github.com/gin-gonic/gin"
 )
@@ -124,6 +125,7 @@ func CreateMovieAdminHandler(c *gin.Context) {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(c, "movie.create", "movie", movie.ID, nil, movie)
 	c.Redirect(http.StatusFound, "/admin/movies")
 }
 
@@ -173,6 +175,8 @@ func UpdateMovieHandler(c *gin.Context) {
 		return
 	}
 
+	before := movie
+
 	// Update fields
 	movie.Title = c.PostForm("title")
 	movie.Slug = c.PostForm("slug")
@@ -225,6 +229,10 @@ func UpdateMovieHandler(c *gin.Context) {
 		return
 	}
 
+	var after Movie
+	database.DB.Preload("Genres").First(&after, movie.ID)
+	audit.Record(c, "movie.update", "movie", movie.ID, before, after)
+
 	c.Redirect(http.StatusFound, "/admin/movies")
 }
 func DeleteMovieHandler(c *gin.Context) {
@@ -235,10 +243,17 @@ func DeleteMovieHandler(c *gin.Context) {
 		return
 	}
 
-	if err := database.DB.Delete(&Movie{}, uint(id)).Error; err != nil {
+	var movie Movie
+	if err := database.DB.Preload("Genres").First(&movie, uint(id)).Error; err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "movie not found"})
+		return
+	}
+
+	if err := database.DB.Delete(&movie).Error; err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(c, "movie.delete", "movie", movie.ID, movie, nil)
 	c.Redirect(http.StatusFound, "/admin/movies")
 }
 
@@ -268,6 +283,7 @@ func CreateGenreAdminHandler(c *gin.Context) {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(c, "genre.create", "genre", genre.ID, nil, genre)
 	c.Redirect(http.StatusFound, "/admin/genres")
 }
 
@@ -302,11 +318,13 @@ func UpdateGenreHandler(c *gin.Context) {
 		return
 	}
 
+	before := genre
 	genre.Name = c.PostForm("name")
 	if err := database.DB.Save(&genre).Error; err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(c, "genre.update", "genre", genre.ID, before, genre)
 	c.Redirect(http.StatusFound, "/admin/genres")
 }
 
@@ -318,10 +336,17 @@ func DeleteGenreHandler(c *gin.Context) {
 		return
 	}
 
-	if err := database.DB.Delete(&Genre{}, uint(id)).Error; err != nil {
+	var genre Genre
+	if err := database.DB.First(&genre, uint(id)).Error; err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "genre not found"})
+		return
+	}
+
+	if err := database.DB.Delete(&genre).Error; err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(c, "genre.delete", "genre", genre.ID, genre, nil)
 	c.Redirect(http.StatusFound, "/admin/genres")
 }
 
@@ -395,6 +420,7 @@ func AddCastMemberHandler(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Failed to add cast member: "+err.Error())
 		return
 	}
+	audit.Record(c, "cast.add", "movie", moviePerson.MovieID, nil, castSnapshot(moviePerson))
 
 	c.Redirect(http.StatusFound, "/admin/movies/"+idStr+"/cast")
 }
@@ -416,16 +442,34 @@ func RemoveCastMemberHandler(c *gin.Context) {
 
 	role := c.Param("role")
 
+	var moviePerson MoviePerson
+	if err := database.DB.Where("movie_id = ? AND person_id = ? AND role = ?", movieID, personID, role).
+		First(&moviePerson).Error; err != nil {
+		c.Redirect(http.StatusFound, "/admin/movies/"+movieIDStr+"/cast")
+		return
+	}
+
 	// Delete the relationship
 	if err := database.DB.Where("movie_id = ? AND person_id = ? AND role = ?", movieID, personID, role).
 		Delete(&MoviePerson{}).Error; err != nil {
 		c.String(http.StatusInternalServerError, "Failed to remove cast member")
 		return
 	}
+	audit.Record(c, "cast.remove", "movie", moviePerson.MovieID, castSnapshot(moviePerson), nil)
 
 	c.Redirect(http.StatusFound, "/admin/movies/"+movieIDStr+"/cast")
 }
 
+// castSnapshot is the audited form of a cast entry, without the nested
+// movie and person.
+func castSnapshot(mp MoviePerson) gin.H {
+	return gin.H{
+		"person_id":      mp.PersonID,
+		"role":           mp.Role,
+		"character_name": mp.CharacterName,
+	}
+}
+
 func ListPeopleAdminHandler(c *gin.Context) {
 	var people []Person
 
@@ -16,6 +16,7 @@ type Movie struct {
 	PosterURL       string
 	BackdropURL     string
 	AverageRating   float64 `gorm:"type:decimal(3,2);default:0.0"`
+	Popularity      float64 `gorm:"default:0;index"`
 	MPAARating      string
 	TMDbID          *int `gorm:"column:tmdb_id;uniqueIndex" json:"tmdb_id"`
 	CreatedAt       time.Time
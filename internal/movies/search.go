@@ -0,0 +1,228 @@
+package movies
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"gorm.io/gorm/clause"
+)
+
+// InitializeSearch maintains movies.search_vector, a weighted English
+// document of the title (A), cast and crew names (B) and synopsis (C). Triggers
+// on movies, movie_people and people keep it current and a GIN index serves
+// it. Rows written before the triggers existed are filled in. Titles and
+// people's names also get unstemmed ("simple") indexes for name search and
+// autocomplete, and trigram indexes for fuzzy matching.
+//
+// Every configuration strips accents with unaccent, so "Amelie" finds
+// "Amélie". This needs the unaccent and pg_trgm extensions, which Postgres
+// 13+ lets the database owner create.
+func InitializeSearch() error {
+	return database.DB.Exec(`
+CREATE EXTENSION IF NOT EXISTS unaccent;
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS search_vector tsvector;
+
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_ts_config WHERE cfgname = 'english_unaccent') THEN
+		CREATE TEXT SEARCH CONFIGURATION english_unaccent (COPY = english);
+		ALTER TEXT SEARCH CONFIGURATION english_unaccent
+			ALTER MAPPING FOR hword, hword_part, word WITH unaccent, english_stem;
+		-- Rebuilt with the new configuration below
+		UPDATE movies SET search_vector = NULL;
+	END IF;
+	IF NOT EXISTS (SELECT 1 FROM pg_ts_config WHERE cfgname = 'simple_unaccent') THEN
+		CREATE TEXT SEARCH CONFIGURATION simple_unaccent (COPY = simple);
+		ALTER TEXT SEARCH CONFIGURATION simple_unaccent
+			ALTER MAPPING FOR hword, hword_part, word WITH unaccent, simple;
+	END IF;
+END
+$$;
+
+-- unaccent() is only STABLE; pinning the dictionary makes it usable in indexes
+CREATE OR REPLACE FUNCTION search_normalize(text) RETURNS text AS $$
+	SELECT lower(public.unaccent('public.unaccent'::regdictionary, $1))
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT;
+
+DROP INDEX IF EXISTS idx_movies_title_search;
+DROP INDEX IF EXISTS idx_people_name_search;
+CREATE INDEX IF NOT EXISTS idx_movies_search_vector ON movies USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_movies_title_simple ON movies USING GIN (to_tsvector('simple_unaccent', title));
+CREATE INDEX IF NOT EXISTS idx_people_name_simple ON people USING GIN (to_tsvector('simple_unaccent', name));
+CREATE INDEX IF NOT EXISTS idx_movies_title_trgm ON movies USING GIN (search_normalize(title) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_people_name_trgm ON people USING GIN (search_normalize(name) gin_trgm_ops);
+
+CREATE OR REPLACE FUNCTION movie_search_document(m_id bigint, m_title text, m_synopsis text) RETURNS tsvector AS $$
+	SELECT setweight(to_tsvector('english_unaccent', coalesce(m_title, '')), 'A') ||
+		setweight(to_tsvector('english_unaccent', coalesce((
+			SELECT string_agg(DISTINCT p.name, ' ')
+			FROM movie_people mp JOIN people p ON p.id = mp.person_id
+			WHERE mp.movie_id = m_id AND p.deleted_at IS NULL
+		), '')), 'B') ||
+		setweight(to_tsvector('english_unaccent', coalesce(m_synopsis, '')), 'C')
+$$ LANGUAGE sql STABLE;
+
+CREATE OR REPLACE FUNCTION movies_search_vector_update() RETURNS trigger AS $$
+BEGIN
+	NEW.search_vector := movie_search_document(NEW.id, NEW.title, NEW.synopsis);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS movies_search_vector ON movies;
+CREATE TRIGGER movies_search_vector
+	BEFORE INSERT OR UPDATE OF title, synopsis ON movies
+	FOR EACH ROW EXECUTE FUNCTION movies_search_vector_update();
+
+CREATE OR REPLACE FUNCTION movie_people_search_vector_update() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP <> 'INSERT' THEN
+		UPDATE movies SET search_vector = movie_search_document(id, title, synopsis) WHERE id = OLD.movie_id;
+	END IF;
+	IF TG_OP <> 'DELETE' THEN
+		UPDATE movies SET search_vector = movie_search_document(id, title, synopsis) WHERE id = NEW.movie_id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS movie_people_search_vector ON movie_people;
+CREATE TRIGGER movie_people_search_vector
+	AFTER INSERT OR UPDATE OR DELETE ON movie_people
+	FOR EACH ROW EXECUTE FUNCTION movie_people_search_vector_update();
+
+CREATE OR REPLACE FUNCTION people_search_vector_update() RETURNS trigger AS $$
+BEGIN
+	UPDATE movies SET search_vector = movie_search_document(id, title, synopsis)
+	WHERE id IN (SELECT movie_id FROM movie_people WHERE person_id = NEW.id);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS people_search_vector ON people;
+CREATE TRIGGER people_search_vector
+	AFTER UPDATE OF name, deleted_at ON people
+	FOR EACH ROW
+	WHEN (OLD.name IS DISTINCT FROM NEW.name OR OLD.deleted_at IS DISTINCT FROM NEW.deleted_at)
+	EXECUTE FUNCTION people_search_vector_update();
+
+UPDATE movies SET search_vector = movie_search_document(id, title, synopsis) WHERE search_vector IS NULL;
+`).Error
+}
+
+// Text search configurations created by InitializeSearch: English stemming
+// for movie documents, none for names. Both ignore accents.
+const (
+	SearchEnglish = "english_unaccent"
+	SearchSimple  = "simple_unaccent"
+)
+
+// ParseSearch turns search box input into a tsquery expression for the given
+// text search configuration. Words must all match, "quoted text" matches as
+// a phrase and a trailing * matches a prefix, as in "dark knight" nol*. ok is
+// false when nothing searchable is left.
+func ParseSearch(input, config string) (expr clause.Expr, ok bool) {
+	var parts, words []string
+	var vars []interface{}
+
+	for _, tok := range tokenize(input) {
+		switch {
+		case tok.phrase:
+			parts = append(parts, "phraseto_tsquery(?::regconfig, ?)")
+			vars = append(vars, config, tok.text)
+		case strings.HasSuffix(tok.text, "*"):
+			if prefix := prefixQuery(strings.TrimRight(tok.text, "*")); prefix != "" {
+				parts = append(parts, "to_tsquery(?::regconfig, ?)")
+				vars = append(vars, config, prefix)
+			}
+		default:
+			words = append(words, tok.text)
+		}
+	}
+	if len(words) > 0 {
+		parts = append([]string{"plainto_tsquery(?::regconfig, ?)"}, parts...)
+		vars = append([]interface{}{config, strings.Join(words, " ")}, vars...)
+	}
+	if len(parts) == 0 {
+		return clause.Expr{}, false
+	}
+	return clause.Expr{SQL: "(" + strings.Join(parts, " && ") + ")", Vars: vars}, true
+}
+
+type searchToken struct {
+	text   string
+	phrase bool
+}
+
+// tokenize splits input on whitespace, keeping "quoted phrases" together.
+// An unterminated quote runs to the end of the input.
+func tokenize(input string) []searchToken {
+	var toks []searchToken
+	for input = strings.TrimSpace(input); input != ""; input = strings.TrimSpace(input) {
+		if input[0] == '"' {
+			text, rest, _ := strings.Cut(input[1:], `"`)
+			if text = strings.TrimSpace(text); text != "" {
+				toks = append(toks, searchToken{text: text, phrase: true})
+			}
+			input = rest
+			continue
+		}
+		end := strings.IndexFunc(input, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+		if end < 0 {
+			end = len(input)
+		}
+		toks = append(toks, searchToken{text: input[:end]})
+		input = input[end:]
+	}
+	return toks
+}
+
+// ParsePrefix builds an unstemmed tsquery for text typed so far: every word
+// must match and the last one may be incomplete, so "dark kn" finds "The
+// Dark Knight".
+func ParsePrefix(input string) (expr clause.Expr, ok bool) {
+	prefix := prefixQuery(input)
+	if prefix == "" {
+		return clause.Expr{}, false
+	}
+	return clause.Expr{SQL: "to_tsquery('simple_unaccent', ?)", Vars: []interface{}{prefix}}, true
+}
+
+// prefixQuery turns text into to_tsquery syntax, "spider & ma:*" for
+// "Spider-Ma". Only letters and digits are kept, so user input can't inject
+// tsquery operators.
+func prefixQuery(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	return strings.Join(words, " & ") + ":*"
+}
+
+// Markers ts_headline puts around matches. They are swapped for <mark> tags
+// after the rest of the snippet has been HTML-escaped.
+const (
+	highlightStart = "⟦"
+	highlightStop  = "⟧"
+	headlineMarks  = "StartSel=" + highlightStart + ", StopSel=" + highlightStop
+)
+
+// ts_headline options for titles (marked in full) and synopsis snippets.
+const (
+	TitleHeadlineOptions   = headlineMarks + ", HighlightAll=true"
+	SnippetHeadlineOptions = headlineMarks + `, MaxWords=35, MinWords=15, ShortWord=3, MaxFragments=2, FragmentDelimiter=" … "`
+)
+
+// Highlight escapes a ts_headline snippet and marks its matches with
+// <mark>, so it can be inserted into a page as HTML.
+func Highlight(headline string) string {
+	s := html.EscapeString(headline)
+	s = strings.ReplaceAll(s, highlightStart, "<mark>")
+	return strings.ReplaceAll(s, highlightStop, "</mark>")
+}
@@ -0,0 +1,101 @@
+package movies
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSearch(t *testing.T) {
+	const cfg = SearchEnglish
+	tests := []struct {
+		name   string
+		input  string
+		wantOK bool
+		sql    string
+		vars   []interface{}
+	}{
+		{"empty", "", false, "", nil},
+		{"only whitespace", "  \t ", false, "", nil},
+		{"only stars", "***", false, "", nil},
+		{"empty quotes", `""`, false, "", nil},
+		{"words", "dark  knight", true,
+			"(plainto_tsquery(?::regconfig, ?))", []interface{}{cfg, "dark knight"}},
+		{"phrase", `"dark knight"`, true,
+			"(phraseto_tsquery(?::regconfig, ?))", []interface{}{cfg, "dark knight"}},
+		{"unterminated phrase", `"dark knight`, true,
+			"(phraseto_tsquery(?::regconfig, ?))", []interface{}{cfg, "dark knight"}},
+		{"prefix", "Nol*", true,
+			"(to_tsquery(?::regconfig, ?))", []interface{}{cfg, "nol:*"}},
+		{"prefix operators are dropped", "a|b&!c*", true,
+			"(to_tsquery(?::regconfig, ?))", []interface{}{cfg, "a & b & c:*"}},
+		{"words come first", `"the dark" batman nol* returns`, true,
+			"(plainto_tsquery(?::regconfig, ?) && phraseto_tsquery(?::regconfig, ?) && to_tsquery(?::regconfig, ?))",
+			[]interface{}{cfg, "batman returns", cfg, "the dark", cfg, "nol:*"}},
+		{"quote inside a word", `dark"knight"`, true,
+			"(plainto_tsquery(?::regconfig, ?) && phraseto_tsquery(?::regconfig, ?))",
+			[]interface{}{cfg, "dark", cfg, "knight"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, ok := ParseSearch(tt.input, cfg)
+			if ok != tt.wantOK {
+				t.Fatalf("ParseSearch(%q) ok = %v, want %v", tt.input, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if expr.SQL != tt.sql {
+				t.Errorf("SQL = %q, want %q", expr.SQL, tt.sql)
+			}
+			if !reflect.DeepEqual(expr.Vars, tt.vars) {
+				t.Errorf("Vars = %#v, want %#v", expr.Vars, tt.vars)
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name     string
+		headline string
+		want     string
+	}{
+		{"empty", "", ""},
+		{"no matches", "The Dark Knight", "The Dark Knight"},
+		{"match", "The ⟦Dark⟧ Knight", "The <mark>Dark</mark> Knight"},
+		{"several matches", "⟦Dark⟧ ⟦Knight⟧", "<mark>Dark</mark> <mark>Knight</mark>"},
+		{"markup is escaped", "<b>⟦Tom⟧ & Jerry</b>", "&lt;b&gt;<mark>Tom</mark> &amp; Jerry&lt;/b&gt;"},
+		{"quotes are escaped", `"⟦Heat⟧"`, "&#34;<mark>Heat</mark>&#34;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Highlight(tt.headline); got != tt.want {
+				t.Errorf("Highlight(%q) = %q, want %q", tt.headline, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"!&|:*", ""},
+		{"kn", "kn:*"},
+		{"Spider-Ma", "spider & ma:*"},
+		{"dark  kn", "dark & kn:*"},
+		{"a:* | b", "a & b:*"},
+		{"Amélie", "amélie:*"},
+		{"2001 a sp", "2001 & a & sp:*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := prefixQuery(tt.input); got != tt.want {
+				t.Errorf("prefixQuery(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/gin-gonic/gin"
+)
+
+// ListClientsHandler renders the registered OIDC clients
+func ListClientsHandler(c *gin.Context) {
+	var clients []Client
+	if err := database.DB.Order("id ASC").Find(&clients).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	c.HTML(http.StatusOK, "oauth_clients.html", gin.H{"title": "OAuth Clients", "clients": clients})
+}
+
+// CreateClientHandler registers a client. The secret is shown exactly once.
+func CreateClientHandler(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	redirectURIs := normalizeURIList(c.PostForm("redirect_uris"))
+	if name == "" || redirectURIs == "" {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "name and at least one redirect URI are required"})
+		return
+	}
+
+	idBytes := make([]byte, 12)
+	if _, err := rand.Read(idBytes); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": "failed to generate client id"})
+		return
+	}
+
+	client := Client{
+		ClientID:               hex.EncodeToString(idBytes),
+		Name:                   name,
+		RedirectURIs:           redirectURIs,
+		PostLogoutRedirectURIs: normalizeURIList(c.PostForm("post_logout_redirect_uris")),
+	}
+
+	var secret string
+	if c.PostForm("confidential") != "" {
+		raw, hash, err := auth.NewOpaqueToken()
+		if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": "failed to generate client secret"})
+			return
+		}
+		secret = raw
+		client.SecretHash = hash
+	}
+
+	if err := database.DB.Create(&client).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "oauth_client.create", "oauth_client", client.ClientID, nil, client)
+
+	var clients []Client
+	database.DB.Order("id ASC").Find(&clients)
+	c.HTML(http.StatusOK, "oauth_clients.html", gin.H{
+		"title":     "OAuth Clients",
+		"clients":   clients,
+		"newClient": client,
+		"newSecret": secret,
+	})
+}
+
+// DeleteClientHandler removes a client and its pending codes
+func DeleteClientHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "invalid id"})
+		return
+	}
+
+	var client Client
+	if err := database.DB.First(&client, uint(id)).Error; err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "client not found"})
+		return
+	}
+
+	database.DB.Where("client_id = ?", client.ClientID).Delete(&AuthorizationCode{})
+	if err := database.DB.Delete(&client).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "oauth_client.delete", "oauth_client", client.ClientID, client, nil)
+
+	c.Redirect(http.StatusFound, "/admin/oauth/clients")
+}
+
+func normalizeURIList(raw string) string {
+	var out []string
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,788 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	codeTTL    = 5 * time.Minute
+	idTokenTTL = time.Hour
+)
+
+var errCodeInvalid = errors.New("authorization code is invalid, expired or already used")
+
+// DiscoveryHandler serves /.well-known/openid-configuration.
+func DiscoveryHandler(c *gin.Context) {
+	issuer := auth.Issuer()
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+		"end_session_endpoint":                  issuer + "/oauth/logout",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": auth.SigningAlgorithms(),
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"email", "email_verified", "preferred_username", "picture", "role",
+		},
+	})
+}
+
+// ================================
+// AUTHORIZE
+// ================================
+
+type authorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Prompt              string
+	// MaxAge is the max_age parameter in seconds, -1 when absent
+	MaxAge int
+}
+
+// prompts reports whether the prompt parameter includes value.
+func (r *authorizeRequest) prompts(value string) bool {
+	return hasScope(r.Prompt, value)
+}
+
+// needsLogin reports whether a session that signed in at authTime is too old
+// for max_age or the client asked for a fresh sign-in.
+func (r *authorizeRequest) needsLogin(authTime time.Time) bool {
+	if r.prompts("login") {
+		return true
+	}
+	return r.MaxAge >= 0 && time.Since(authTime) > time.Duration(r.MaxAge)*time.Second
+}
+
+// validateAuthorizeRequest checks the request and renders an error itself
+// when it returns false. Errors about the client or redirect URI are shown
+// to the user; everything else is sent back to the client.
+func validateAuthorizeRequest(c *gin.Context) (*authorizeRequest, *Client, bool) {
+	req := &authorizeRequest{
+		ResponseType:        c.Query("response_type"),
+		ClientID:            c.Query("client_id"),
+		RedirectURI:         c.Query("redirect_uri"),
+		Scope:               c.Query("scope"),
+		State:               c.Query("state"),
+		Nonce:               c.Query("nonce"),
+		CodeChallenge:       c.Query("code_challenge"),
+		CodeChallengeMethod: c.Query("code_challenge_method"),
+		Prompt:              c.Query("prompt"),
+		MaxAge:              -1,
+	}
+
+	var client Client
+	if err := database.DB.Where("client_id = ?", req.ClientID).First(&client).Error; err != nil {
+		renderMessage(c, http.StatusBadRequest, "Sign-in error", "Unknown client.")
+		return nil, nil, false
+	}
+	if !client.AllowsRedirect(req.RedirectURI) {
+		renderMessage(c, http.StatusBadRequest, "Sign-in error", "The redirect URI is not registered for this client.")
+		return nil, nil, false
+	}
+
+	if req.ResponseType != "code" {
+		redirectError(c, req, "unsupported_response_type", "only the authorization code flow is supported")
+		return nil, nil, false
+	}
+	if !hasScope(req.Scope, "openid") {
+		redirectError(c, req, "invalid_scope", "the openid scope is required")
+		return nil, nil, false
+	}
+	if req.CodeChallenge == "" && client.IsPublic() {
+		redirectError(c, req, "invalid_request", "public clients must use PKCE")
+		return nil, nil, false
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod != "S256" {
+		redirectError(c, req, "invalid_request", "code_challenge_method must be S256")
+		return nil, nil, false
+	}
+	for _, p := range strings.Fields(req.Prompt) {
+		if p != "none" && p != "login" && p != "consent" {
+			redirectError(c, req, "invalid_request", "unsupported prompt "+p)
+			return nil, nil, false
+		}
+	}
+	if req.prompts("none") && len(strings.Fields(req.Prompt)) > 1 {
+		redirectError(c, req, "invalid_request", "prompt=none can't be combined with other values")
+		return nil, nil, false
+	}
+	if v := c.Query("max_age"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			redirectError(c, req, "invalid_request", "max_age must be a non-negative number of seconds")
+			return nil, nil, false
+		}
+		req.MaxAge = n
+	}
+
+	return req, &client, true
+}
+
+// AuthorizeHandler continues with the browser's Core session when it has one
+// that satisfies prompt and max_age, otherwise it shows the login form. With
+// prompt=none it never shows a page and answers login_required or
+// consent_required instead.
+func AuthorizeHandler(c *gin.Context) {
+	req, client, ok := validateAuthorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	session, ok := currentSession(c)
+	if !ok || req.needsLogin(session.AuthTime()) {
+		if req.prompts("none") {
+			redirectError(c, req, "login_required", "the user must sign in")
+			return
+		}
+		renderLogin(c, http.StatusOK, client, "")
+		return
+	}
+	continueAuthorize(c, req, client, session.UserID, session.AuthTime())
+}
+
+// currentSession returns the browser's Core session, if it has one.
+func currentSession(c *gin.Context) (*auth.Session, bool) {
+	tokenStr, claims, err := auth.CookieSession(c)
+	if tokenStr == "" || err != nil || claims.Actor != nil {
+		return nil, false
+	}
+	session, err := auth.FindSession(claims.SessionID)
+	if err != nil {
+		return nil, false
+	}
+	return session, true
+}
+
+// continueAuthorize issues a code to a signed-in user once they have allowed
+// the client the requested scopes. auth_time is when the user signed in, not
+// when the access token was last refreshed.
+func continueAuthorize(c *gin.Context, req *authorizeRequest, client *Client, userID uint, authTime time.Time) {
+	consented, err := hasConsent(userID, client.ClientID, req.Scope)
+	if err != nil {
+		redirectError(c, req, "server_error", "failed to check consent")
+		return
+	}
+	if consented && !req.prompts("consent") {
+		issueCode(c, req, userID, authTime)
+		return
+	}
+	if req.prompts("none") {
+		redirectError(c, req, "consent_required", "the user must allow this client")
+		return
+	}
+	renderConsent(c, client, req)
+}
+
+func hasConsent(userID uint, clientID, scope string) (bool, error) {
+	var co Consent
+	err := database.DB.Where("user_id = ? AND client_id = ?", userID, clientID).First(&co).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return co.Covers(scope), nil
+}
+
+// grantConsent adds scope to what the user has allowed the client.
+func grantConsent(userID uint, clientID, scope string) error {
+	var co Consent
+	err := database.DB.Where("user_id = ? AND client_id = ?", userID, clientID).First(&co).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		co = Consent{UserID: userID, ClientID: clientID}
+	} else if err != nil {
+		return err
+	}
+	for _, s := range strings.Fields(scope) {
+		if !hasScope(co.Scope, s) {
+			co.Scope = strings.TrimSpace(co.Scope + " " + s)
+		}
+	}
+	return database.DB.Save(&co).Error
+}
+
+// consentHandler answers the consent form shown by continueAuthorize.
+func consentHandler(c *gin.Context, req *authorizeRequest, client *Client) {
+	session, ok := currentSession(c)
+	if !ok {
+		renderLogin(c, http.StatusUnauthorized, client, "Please sign in again")
+		return
+	}
+	if c.PostForm("consent") != "allow" {
+		redirectError(c, req, "access_denied", "the user denied access")
+		return
+	}
+	if err := grantConsent(session.UserID, client.ClientID, req.Scope); err != nil {
+		redirectError(c, req, "server_error", "failed to store consent")
+		return
+	}
+	issueCode(c, req, session.UserID, session.AuthTime())
+}
+
+// AuthorizeLoginHandler handles the login form shown by AuthorizeHandler
+// and, for accounts with 2FA, the code form that follows it.
+func AuthorizeLoginHandler(c *gin.Context) {
+	req, client, ok := validateAuthorizeRequest(c)
+	if !ok {
+		return
+	}
+	if !auth.CheckLoginCSRF(c) {
+		renderLogin(c, http.StatusForbidden, client, "Your sign-in form expired, please try again")
+		return
+	}
+	if c.PostForm("consent") != "" {
+		consentHandler(c, req, client)
+		return
+	}
+
+	var (
+		u   *users.User
+		err error
+	)
+	mfaToken := c.PostForm("mfa_token")
+	if mfaToken != "" {
+		u, err = auth.CompleteSecondFactor(mfaToken, c.PostForm("code"), c.ClientIP())
+	} else {
+		u, err = auth.Authenticate(c.PostForm("email"), c.PostForm("password"), c.ClientIP())
+	}
+	if err != nil {
+		var lockout *auth.LockoutError
+		var restricted *auth.RestrictedError
+		switch {
+		case errors.As(err, &lockout):
+			c.Header("Retry-After", strconv.Itoa(int(lockout.RetryAfter.Seconds())+1))
+			renderLogin(c, http.StatusTooManyRequests, client, "Too many failed attempts, try again later")
+		case errors.As(err, &restricted):
+			renderLogin(c, http.StatusForbidden, client, "Your "+restricted.Error())
+		case errors.Is(err, auth.ErrInvalidSecondFactor):
+			renderSecondFactor(c, http.StatusUnauthorized, mfaToken, "Invalid code")
+		case errors.Is(err, auth.ErrInvalidMFAToken):
+			renderLogin(c, http.StatusUnauthorized, client, err.Error())
+		default:
+			renderLogin(c, http.StatusUnauthorized, client, "Invalid credentials")
+		}
+		return
+	}
+
+	mfa, err := auth.TOTPEnabled(u.ID)
+	if err != nil {
+		renderLogin(c, http.StatusInternalServerError, client, "Failed to sign in")
+		return
+	}
+	if mfaToken == "" && mfa {
+		pending, err := auth.NewMFAPendingToken(u)
+		if err != nil {
+			renderLogin(c, http.StatusInternalServerError, client, "Failed to sign in")
+			return
+		}
+		renderSecondFactor(c, http.StatusOK, pending, "")
+		return
+	}
+
+	authTime := time.Now()
+	info := auth.ClientInfoFrom(c)
+	info.AuthTime = authTime
+	access, refresh, err := auth.IssueTokenPair(u, info)
+	if err != nil {
+		renderLogin(c, http.StatusInternalServerError, client, "Failed to sign in")
+		return
+	}
+	auth.SetAuthCookies(c, access, refresh)
+
+	continueAuthorize(c, req, client, u.ID, authTime)
+}
+
+func issueCode(c *gin.Context, req *authorizeRequest, userID uint, authTime time.Time) {
+	raw, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		redirectError(c, req, "server_error", "failed to generate code")
+		return
+	}
+
+	code := AuthorizationCode{
+		CodeHash:            hash,
+		ClientID:            req.ClientID,
+		UserID:              userID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               req.Scope,
+		Nonce:               req.Nonce,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		AuthTime:            authTime,
+		ExpiresAt:           time.Now().Add(codeTTL),
+	}
+	if err := database.DB.Create(&code).Error; err != nil {
+		redirectError(c, req, "server_error", "failed to store code")
+		return
+	}
+
+	params := url.Values{}
+	params.Set("code", raw)
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	c.Redirect(http.StatusFound, appendQuery(req.RedirectURI, params))
+}
+
+func redirectError(c *gin.Context, req *authorizeRequest, code, description string) {
+	params := url.Values{}
+	params.Set("error", code)
+	params.Set("error_description", description)
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	c.Redirect(http.StatusFound, appendQuery(req.RedirectURI, params))
+}
+
+func renderLogin(c *gin.Context, status int, client *Client, errMsg string) {
+	c.HTML(status, "oidc_login.html", gin.H{
+		"title":     "Sign in",
+		"client":    client,
+		"action":    template.URL("/oauth/authorize?" + c.Request.URL.RawQuery),
+		"error":     errMsg,
+		"csrfToken": auth.LoginCSRFToken(c),
+	})
+}
+
+// scopeDescriptions explain the scopes on the consent page.
+var scopeDescriptions = map[string]string{
+	"openid":  "Know who you are on Cinemesh",
+	"profile": "See your username, avatar and role",
+	"email":   "See your email address and whether it is verified",
+}
+
+func renderConsent(c *gin.Context, client *Client, req *authorizeRequest) {
+	var scopes []string
+	for _, s := range strings.Fields(req.Scope) {
+		if d, ok := scopeDescriptions[s]; ok {
+			scopes = append(scopes, d)
+		}
+	}
+	// Clicking "Allow" must not be something another site can trick the
+	// user into through a frame
+	c.Header("X-Frame-Options", "DENY")
+	c.HTML(http.StatusOK, "oidc_consent.html", gin.H{
+		"title":     "Allow access",
+		"client":    client,
+		"scopes":    scopes,
+		"action":    template.URL("/oauth/authorize?" + c.Request.URL.RawQuery),
+		"csrfToken": auth.LoginCSRFToken(c),
+	})
+}
+
+func renderSecondFactor(c *gin.Context, status int, mfaToken, errMsg string) {
+	c.HTML(status, "login_2fa.html", gin.H{
+		"title":     "Sign in",
+		"action":    template.URL("/oauth/authorize?" + c.Request.URL.RawQuery),
+		"mfaToken":  mfaToken,
+		"error":     errMsg,
+		"csrfToken": auth.LoginCSRFToken(c),
+	})
+}
+
+func renderMessage(c *gin.Context, status int, title, message string) {
+	c.HTML(status, "oidc_message.html", gin.H{"title": title, "message": message})
+}
+
+// ================================
+// TOKEN
+// ================================
+
+func TokenHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		exchangeCode(c, client)
+	case "refresh_token":
+		exchangeRefreshToken(c, client)
+	default:
+		tokenError(c, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+// authenticateClient accepts client_secret_basic, client_secret_post and,
+// for public clients, no authentication at all.
+func authenticateClient(c *gin.Context) (*Client, bool) {
+	clientID, secret, hasBasic := c.Request.BasicAuth()
+	if !hasBasic {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	var client Client
+	if err := database.DB.Where("client_id = ?", clientID).First(&client).Error; err != nil {
+		tokenError(c, http.StatusUnauthorized, "invalid_client", "unknown client")
+		return nil, false
+	}
+
+	if !client.IsPublic() {
+		given := auth.HashOpaqueToken(secret)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte(client.SecretHash)) != 1 {
+			tokenError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return nil, false
+		}
+	}
+
+	return &client, true
+}
+
+func exchangeCode(c *gin.Context, client *Client) {
+	raw := c.PostForm("code")
+	redirectURI := c.PostForm("redirect_uri")
+	verifier := c.PostForm("code_verifier")
+
+	var code AuthorizationCode
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("code_hash = ?", auth.HashOpaqueToken(raw)).
+			First(&code).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errCodeInvalid
+			}
+			return err
+		}
+
+		if code.UsedAt != nil || time.Now().After(code.ExpiresAt) ||
+			code.ClientID != client.ClientID || code.RedirectURI != redirectURI {
+			return errCodeInvalid
+		}
+		if code.CodeChallenge != "" && !verifyPKCE(verifier, code.CodeChallenge) {
+			return errCodeInvalid
+		}
+
+		now := time.Now()
+		return tx.Model(&code).Update("used_at", now).Error
+	})
+	if err != nil {
+		if errors.Is(err, errCodeInvalid) {
+			tokenError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+		tokenError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	var u users.User
+	if err := database.DB.First(&u, code.UserID).Error; err != nil {
+		tokenError(c, http.StatusBadRequest, "invalid_grant", "user no longer exists")
+		return
+	}
+	// The account may have been suspended since the code was issued
+	if err := auth.CheckRestriction(u.ID); err != nil {
+		var restricted *auth.RestrictedError
+		if errors.As(err, &restricted) {
+			tokenError(c, http.StatusBadRequest, "invalid_grant", restricted.Error())
+			return
+		}
+		tokenError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	// The refresh token family belongs to this client only, with the scopes
+	// and sign-in time of the code
+	info := auth.ClientInfoFrom(c)
+	info.OAuthClientID = client.ClientID
+	info.Scope = code.Scope
+	info.AuthTime = code.AuthTime
+	refresh, sessionID, err := auth.IssueRefreshToken(u.ID, info)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	access, err := auth.GenerateClientToken(&u, sessionID, client.ClientID, code.Scope)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	idToken, err := buildIDToken(&u, client.ClientID, code.Scope, code.Nonce, code.AuthTime)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(auth.AccessTokenTTL().Seconds()),
+		"refresh_token": refresh,
+		"id_token":      idToken,
+		"scope":         code.Scope,
+	})
+}
+
+func exchangeRefreshToken(c *gin.Context, client *Client) {
+	info := auth.ClientInfoFrom(c)
+	info.OAuthClientID = client.ClientID
+	u, refresh, sessionID, err := auth.RotateRefreshToken(c.PostForm("refresh_token"), info)
+	if err != nil {
+		var restricted *auth.RestrictedError
+		if errors.Is(err, auth.ErrInvalidRefreshToken) || errors.Is(err, auth.ErrRefreshTokenReused) || errors.As(err, &restricted) {
+			tokenError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+		tokenError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	session, err := auth.FindSession(sessionID)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	access, err := auth.GenerateClientToken(u, sessionID, client.ClientID, session.Scope)
+	if err != nil {
+		tokenError(c, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	res := gin.H{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   int(auth.AccessTokenTTL().Seconds()),
+	}
+	// No new refresh token for a replay within the grace period
+	if refresh != "" {
+		res["refresh_token"] = refresh
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func verifyPKCE(verifier, challenge string) bool {
+	if verifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func tokenError(c *gin.Context, status int, code, description string) {
+	body := gin.H{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	c.JSON(status, body)
+}
+
+// ================================
+// ID TOKEN & USERINFO
+// ================================
+
+type idTokenClaims struct {
+	Nonce             string           `json:"nonce,omitempty"`
+	AuthTime          *jwt.NumericDate `json:"auth_time,omitempty"`
+	Email             string           `json:"email,omitempty"`
+	EmailVerified     *bool            `json:"email_verified,omitempty"`
+	PreferredUsername string           `json:"preferred_username,omitempty"`
+	Picture           string           `json:"picture,omitempty"`
+	Role              string           `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func buildIDToken(u *users.User, audience, scope, nonce string, authTime time.Time) (string, error) {
+	now := time.Now()
+	claims := idTokenClaims{
+		Nonce:    nonce,
+		AuthTime: jwt.NewNumericDate(authTime),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    auth.Issuer(),
+			Subject:   strconv.FormatUint(uint64(u.ID), 10),
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(idTokenTTL)),
+		},
+	}
+	if hasScope(scope, "email") {
+		claims.Email = u.Email
+		verified := u.EmailVerifiedAt != nil
+		claims.EmailVerified = &verified
+	}
+	if hasScope(scope, "profile") {
+		claims.PreferredUsername = u.Username
+		claims.Picture = u.AvatarURL
+		claims.Role = u.Role
+	}
+	return auth.SignClaims(claims)
+}
+
+// UserInfoHandler returns the standard claims of the bearer token's user,
+// limited to the scopes the client was granted. Must run after
+// auth.RequireClientToken.
+func UserInfoHandler(c *gin.Context) {
+	var u users.User
+	if err := database.DB.First(&u, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, userInfoClaims(&u, c.GetString("scope")))
+}
+
+func userInfoClaims(u *users.User, scope string) gin.H {
+	claims := gin.H{"sub": strconv.FormatUint(uint64(u.ID), 10)}
+	if hasScope(scope, "email") {
+		claims["email"] = u.Email
+		claims["email_verified"] = u.EmailVerifiedAt != nil
+	}
+	if hasScope(scope, "profile") {
+		claims["preferred_username"] = u.Username
+		claims["picture"] = u.AvatarURL
+		claims["role"] = u.Role
+	}
+	return claims
+}
+
+// ================================
+// END SESSION
+// ================================
+
+// EndSessionHandler signs the browser out of Core when the request carries
+// an id_token_hint for the signed-in user. Without one it only asks the user
+// to confirm, so that other sites can't sign people out with a link or an
+// image.
+func EndSessionHandler(c *gin.Context) {
+	hint, ok := validIDTokenHint(c)
+	if !ok {
+		c.Header("X-Frame-Options", "DENY")
+		c.HTML(http.StatusOK, "oidc_logout.html", gin.H{
+			"title":     "Sign out",
+			"action":    template.URL("/oauth/logout?" + c.Request.URL.RawQuery),
+			"csrfToken": auth.LoginCSRFToken(c),
+		})
+		return
+	}
+	clientID := c.Query("client_id")
+	if clientID == "" && len(hint.Audience) == 1 {
+		clientID = hint.Audience[0]
+	}
+	endSession(c, clientID)
+}
+
+// EndSessionConfirmHandler signs the browser out after the user confirmed
+// on the page shown by EndSessionHandler.
+func EndSessionConfirmHandler(c *gin.Context) {
+	if !auth.CheckLoginCSRF(c) {
+		renderMessage(c, http.StatusForbidden, "Sign out", "Your sign-out form expired, please try again.")
+		return
+	}
+	endSession(c, c.Query("client_id"))
+}
+
+// validIDTokenHint checks that id_token_hint is an ID token Core issued for
+// the browser's current user and, if client_id is given, to that client.
+func validIDTokenHint(c *gin.Context) (*jwt.RegisteredClaims, bool) {
+	raw := c.Query("id_token_hint")
+	if raw == "" {
+		return nil, false
+	}
+	hint, err := auth.ParseIDTokenHint(raw)
+	if err != nil {
+		return nil, false
+	}
+	if clientID := c.Query("client_id"); clientID != "" && !containsString(hint.Audience, clientID) {
+		return nil, false
+	}
+	// No session means there is nothing to sign out of
+	if session, ok := currentSession(c); ok && strconv.FormatUint(uint64(session.UserID), 10) != hint.Subject {
+		return nil, false
+	}
+	return hint, true
+}
+
+// endSession revokes the browser's session and, when the client registered
+// the given post_logout_redirect_uri, sends it back there.
+func endSession(c *gin.Context, clientID string) {
+	if refresh, _ := c.Cookie(auth.RefreshCookieName); refresh != "" {
+		auth.RevokeRefreshToken(refresh)
+	}
+	auth.ClearAuthCookies(c)
+
+	redirectURI := c.Query("post_logout_redirect_uri")
+	if redirectURI != "" {
+		var client Client
+		if err := database.DB.Where("client_id = ?", clientID).First(&client).Error; err == nil &&
+			client.AllowsPostLogoutRedirect(redirectURI) {
+			params := url.Values{}
+			if state := c.Query("state"); state != "" {
+				params.Set("state", state)
+			}
+			c.Redirect(http.StatusFound, appendQuery(redirectURI, params))
+			return
+		}
+	}
+
+	renderMessage(c, http.StatusOK, "Signed out", "You have been signed out of Cinemesh.")
+}
+
+// ================================
+// HELPERS
+// ================================
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, want string) bool {
+	for _, s := range list {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func appendQuery(rawURL string, params url.Values) string {
+	if len(params) == 0 {
+		return rawURL
+	}
+	sep := "?"
+	if strings.Contains(rawURL, "?") {
+		sep = "&"
+	}
+	return rawURL + sep + params.Encode()
+}
@@ -0,0 +1,85 @@
+package oidc
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/users"
+)
+
+func TestUserInfoClaims(t *testing.T) {
+	u := &users.User{ID: 7, Email: "ana@example.com", Username: "ana", Role: "user"}
+	tests := []struct {
+		name  string
+		scope string
+		want  []string
+	}{
+		{"openid only", "openid", []string{"sub"}},
+		{"email", "openid email", []string{"email", "email_verified", "sub"}},
+		{"profile", "openid profile", []string{"picture", "preferred_username", "role", "sub"}},
+		{"all scopes", "openid profile email", []string{"email", "email_verified", "picture", "preferred_username", "role", "sub"}},
+		{"no scope", "", []string{"sub"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := userInfoClaims(u, tt.scope)
+			var got []string
+			for k := range claims {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("userInfoClaims(%q) keys = %v, want %v", tt.scope, got, tt.want)
+			}
+			if claims["sub"] != "7" {
+				t.Errorf("sub = %v, want 7", claims["sub"])
+			}
+		})
+	}
+}
+
+func TestNeedsLogin(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		req      authorizeRequest
+		authTime time.Time
+		want     bool
+	}{
+		{"no constraints", authorizeRequest{MaxAge: -1}, now.Add(-24 * time.Hour), false},
+		{"prompt=login", authorizeRequest{Prompt: "login", MaxAge: -1}, now, true},
+		{"prompt=login consent", authorizeRequest{Prompt: "login consent", MaxAge: -1}, now, true},
+		{"prompt=consent", authorizeRequest{Prompt: "consent", MaxAge: -1}, now, false},
+		{"within max_age", authorizeRequest{MaxAge: 3600}, now.Add(-time.Minute), false},
+		{"older than max_age", authorizeRequest{MaxAge: 60}, now.Add(-2 * time.Minute), true},
+		{"max_age=0", authorizeRequest{MaxAge: 0}, now.Add(-time.Second), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.needsLogin(tt.authTime); got != tt.want {
+				t.Errorf("needsLogin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConsentCovers(t *testing.T) {
+	co := Consent{Scope: "openid email"}
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{"openid", true},
+		{"openid email", true},
+		{"email openid", true},
+		{"openid profile", false},
+		{"openid emails", false},
+	}
+	for _, tt := range tests {
+		if got := co.Covers(tt.scope); got != tt.want {
+			t.Errorf("Covers(%q) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package privacy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"github.com/gin-gonic/gin"
+)
+
+func statusURL(rawToken string) string {
+	return auth.Issuer() + "/privacy/jobs/" + rawToken
+}
+
+func currentUser(c *gin.Context) (*users.User, bool) {
+	var u users.User
+	if err := database.DB.First(&u, c.GetUint("user_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return nil, false
+	}
+	return &u, true
+}
+
+// ================================
+// EXPORT
+// ================================
+
+// ExportHandler starts a data export of the signed-in user. Only one export
+// runs at a time.
+func ExportHandler(c *gin.Context) {
+	u, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var running Job
+	err := database.DB.Preload("Steps").
+		Where("user_id = ? AND kind = ? AND status IN ?", u.ID, KindExport, []string{StatusPending, StatusRunning}).
+		First(&running).Error
+	if err == nil {
+		c.JSON(http.StatusAccepted, gin.H{"job": running})
+		return
+	}
+
+	job, raw, err := StartExport(u, c.GetString("token"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start export"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job": job, "status_url": statusURL(raw)})
+}
+
+// DownloadExportHandler streams a finished export archive to its owner.
+func DownloadExportHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	var job Job
+	if err := database.DB.Where("id = ? AND user_id = ? AND kind = ?", id, c.GetUint("user_id"), KindExport).
+		First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "export not found"})
+		return
+	}
+	if job.ArchivePath == "" || job.ExpiresAt == nil || time.Now().After(*job.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "export is not available"})
+		return
+	}
+	if _, err := os.Stat(job.ArchivePath); err != nil {
+		c.JSON(http.StatusGone, gin.H{"error": "export is not available"})
+		return
+	}
+
+	c.FileAttachment(job.ArchivePath, fmt.Sprintf("cinemesh-export-%d.zip", job.ID))
+}
+
+// ================================
+// DELETION
+// ================================
+
+type deleteAccountDTO struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code"`
+	Mode     string `json:"mode"`
+}
+
+// lockedOut answers 429 with Retry-After if err is a login lockout.
+func lockedOut(c *gin.Context, err error) bool {
+	var lockout *auth.LockoutError
+	if !errors.As(err, &lockout) {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(int(lockout.RetryAfter.Seconds())+1))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": lockout.Error()})
+	return true
+}
+
+// DeleteAccountHandler erases the signed-in user's account after confirming
+// the password (and second factor, when enabled). The returned status_url
+// keeps working after the account is gone.
+func DeleteAccountHandler(c *gin.Context) {
+	var dto deleteAccountDTO
+	if err := c.ShouldBindJSON(&dto); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	mode := dto.Mode
+	if mode == "" {
+		mode = ModeAnonymize
+	}
+	if mode != ModeAnonymize && mode != ModeDelete {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be anonymize or delete"})
+		return
+	}
+
+	u, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	if _, err := auth.Authenticate(u.Email, dto.Password, c.ClientIP()); err != nil {
+		if lockedOut(c, err) {
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "password is incorrect"})
+		return
+	}
+	mfa, err := auth.TOTPEnabled(u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if mfa {
+		if err := auth.VerifySecondFactorThrottled(u.ID, dto.Code, c.ClientIP()); err != nil {
+			if lockedOut(c, err) {
+				return
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "a valid two-factor code is required"})
+			return
+		}
+	}
+
+	running, err := deletionInProgress(u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if running {
+		c.JSON(http.StatusConflict, gin.H{"error": "account deletion is already in progress"})
+		return
+	}
+
+	job, raw, err := StartDeletion(u, mode, 0)
+	if errors.Is(err, ErrDeletionUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start deletion"})
+		return
+	}
+
+	auth.ClearAuthCookies(c)
+	c.JSON(http.StatusAccepted, gin.H{"job": job, "status_url": statusURL(raw)})
+}
+
+// ================================
+// STATUS
+// ================================
+
+// ListJobsHandler returns the signed-in user's exports and deletions.
+func ListJobsHandler(c *gin.Context) {
+	var jobs []Job
+	if err := database.DB.Preload("Steps").Where("user_id = ?", c.GetUint("user_id")).
+		Order("id DESC").Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+}
+
+// JobStatusHandler reports a job's progress by its status token. It needs no
+// login so a deleted user can still follow their deletion.
+func JobStatusHandler(c *gin.Context) {
+	var job Job
+	if err := database.DB.Preload("Steps").
+		Where("status_token_hash = ?", auth.HashOpaqueToken(c.Param("token"))).
+		First(&job).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
@@ -0,0 +1,648 @@
+package privacy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/auth"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/forum"
+	"github.com/Ponloe/cinemesh-core/internal/mail"
+	"github.com/Ponloe/cinemesh-core/internal/media"
+	"github.com/Ponloe/cinemesh-core/internal/oidc"
+	"github.com/Ponloe/cinemesh-core/internal/throttle"
+	"github.com/Ponloe/cinemesh-core/internal/users"
+	"gorm.io/gorm"
+)
+
+// archiveTTL is how long a finished export can be downloaded.
+const archiveTTL = 7 * 24 * time.Hour
+
+func exportDir() string {
+	if dir := os.Getenv("EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return "exports"
+}
+
+func ticketAPI() string {
+	if v := os.Getenv("TICKET_API"); v != "" {
+		return v
+	}
+	return "http://localhost:8000"
+}
+
+// ticketingRequest calls the ticketing service as Core, authenticated with
+// TICKET_SERVICE_TOKEN.
+func ticketingRequest(method, path string) (*http.Response, error) {
+	token := os.Getenv("TICKET_SERVICE_TOKEN")
+	if token == "" {
+		return nil, errors.New("no ticketing credentials, set TICKET_SERVICE_TOKEN")
+	}
+	req, err := http.NewRequest(method, ticketAPI()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ticketing service unavailable: %w", err)
+	}
+	return resp, nil
+}
+
+// InitializeJobs fails exports that were cut short by a restart (the user
+// can simply ask again) and starts the scheduler that resumes deletions and
+// removes expired export archives. Interrupted deletions are resumed from
+// their first unfinished step.
+func InitializeJobs() {
+	now := time.Now()
+	interrupted := database.DB.Model(&Job{}).Select("id").
+		Where("kind = ? AND status IN ?", KindExport, []string{StatusPending, StatusRunning})
+	database.DB.Model(&JobStep{}).
+		Where("job_id IN (?) AND status IN ?", interrupted, []string{StatusPending, StatusRunning}).
+		Updates(map[string]interface{}{"status": StatusFailed, "error": "interrupted by server restart", "finished_at": now})
+	database.DB.Model(&Job{}).
+		Where("kind = ? AND status IN ?", KindExport, []string{StatusPending, StatusRunning}).
+		Updates(map[string]interface{}{"status": StatusFailed, "finished_at": now})
+
+	go runScheduler()
+}
+
+// schedulerInterval is how often due deletions and expired exports are
+// looked for.
+const schedulerInterval = time.Minute
+
+func runScheduler() {
+	for {
+		purgeExpiredExports()
+		resumeDeletions()
+		time.Sleep(schedulerInterval)
+	}
+}
+
+// purgeExpiredExports removes archives past their download window.
+func purgeExpiredExports() {
+	var expired []Job
+	if err := database.DB.Where("archive_path <> '' AND expires_at < ?", time.Now()).Find(&expired).Error; err != nil {
+		log.Printf("privacy: failed to list expired exports: %v", err)
+		return
+	}
+	for i := range expired {
+		removeArchive(&expired[i])
+	}
+}
+
+// purgeUserExports removes every export archive of a user, whether or not
+// it has expired.
+func purgeUserExports(userID uint) error {
+	var jobs []Job
+	if err := database.DB.Where("user_id = ? AND archive_path <> ''", userID).Find(&jobs).Error; err != nil {
+		return err
+	}
+	for i := range jobs {
+		if err := removeArchive(&jobs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeArchive(job *Job) error {
+	if err := os.Remove(job.ArchivePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("privacy job %d: failed to remove archive: %v", job.ID, err)
+		return err
+	}
+	job.ArchivePath = ""
+	return database.DB.Model(job).Update("archive_path", "").Error
+}
+
+func newJob(userID uint, kind, mode string, requestedBy uint, steps []string) (*Job, string, error) {
+	raw, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	job := Job{
+		UserID:          userID,
+		Kind:            kind,
+		Mode:            mode,
+		RequestedBy:     requestedBy,
+		Status:          StatusPending,
+		StatusTokenHash: hash,
+	}
+	for _, name := range steps {
+		job.Steps = append(job.Steps, JobStep{Name: name, Status: StatusPending})
+	}
+	if err := database.DB.Create(&job).Error; err != nil {
+		return nil, "", err
+	}
+	return &job, raw, nil
+}
+
+func startJob(job *Job) {
+	now := time.Now()
+	job.Status = StatusRunning
+	job.StartedAt = &now
+	database.DB.Model(job).Updates(map[string]interface{}{"status": job.Status, "started_at": now})
+}
+
+// runStep executes one step and records its outcome.
+func runStep(job *Job, name string, fn func() error) bool {
+	var step *JobStep
+	for i := range job.Steps {
+		if job.Steps[i].Name == name {
+			step = &job.Steps[i]
+		}
+	}
+
+	started := time.Now()
+	step.Status = StatusRunning
+	step.StartedAt = &started
+	database.DB.Model(step).Updates(map[string]interface{}{"status": step.Status, "started_at": started})
+
+	err := fn()
+
+	finished := time.Now()
+	updates := map[string]interface{}{"status": StatusCompleted, "finished_at": finished, "error": ""}
+	if err != nil {
+		log.Printf("privacy job %d (%s): step %s failed: %v", job.ID, job.Kind, name, err)
+		updates["status"] = StatusFailed
+		updates["error"] = err.Error()
+	}
+	database.DB.Model(step).Updates(updates)
+	step.Status = updates["status"].(string)
+	step.FinishedAt = &finished
+	return err == nil
+}
+
+func finishJob(job *Job, failed int) {
+	status := StatusCompleted
+	switch {
+	case failed == len(job.Steps):
+		status = StatusFailed
+	case failed > 0:
+		status = StatusPartial
+	}
+	now := time.Now()
+	job.Status = status
+	job.FinishedAt = &now
+	database.DB.Model(job).Updates(map[string]interface{}{"status": status, "finished_at": now})
+}
+
+// ================================
+// EXPORT
+// ================================
+
+// StartExport collects everything Cinemesh stores about the user into a zip
+// archive in the background. accessToken is forwarded to the forum service.
+func StartExport(u *users.User, accessToken string) (*Job, string, error) {
+	job, raw, err := newJob(u.ID, KindExport, "", 0, []string{"core", "ticketing", "forum", "archive"})
+	if err != nil {
+		return nil, "", err
+	}
+	go runExport(job, *u, accessToken)
+	return job, raw, nil
+}
+
+func runExport(job *Job, u users.User, accessToken string) {
+	startJob(job)
+	files := map[string]interface{}{}
+	failed := 0
+
+	if !runStep(job, "core", func() error {
+		files["account.json"] = accountData(u)
+		return nil
+	}) {
+		failed++
+	}
+
+	if !runStep(job, "ticketing", func() error {
+		reservations, err := fetchReservations(u.ID)
+		if err != nil {
+			return err
+		}
+		files["reservations.json"] = reservations
+		return nil
+	}) {
+		failed++
+	}
+
+	if !runStep(job, "forum", func() error {
+		client := forum.NewForumClient(forum.GetClient().BaseURL, accessToken)
+		threads, err := client.GetUserThreads(strconv.FormatUint(uint64(u.ID), 10))
+		if err != nil {
+			return fmt.Errorf("threads: %w", err)
+		}
+		replies, err := client.GetUserReplies(strconv.FormatUint(uint64(u.ID), 10))
+		if err != nil {
+			return fmt.Errorf("replies: %w", err)
+		}
+		files["forum_threads.json"] = threads
+		files["forum_replies.json"] = replies
+		return nil
+	}) {
+		failed++
+	}
+
+	if !runStep(job, "archive", func() error {
+		return writeArchive(job, files)
+	}) {
+		failed++
+	}
+
+	finishJob(job, failed)
+}
+
+// accountData lists the account fields handed out in an export; secrets such
+// as the password hash are never included.
+func accountData(u users.User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                u.ID,
+		"username":          u.Username,
+		"email":             u.Email,
+		"email_verified_at": u.EmailVerifiedAt,
+		"avatar_url":        u.AvatarURL,
+		"role":              u.Role,
+		"created_at":        u.CreatedAt,
+		"updated_at":        u.UpdatedAt,
+	}
+}
+
+func writeArchive(job *Job, files map[string]interface{}) error {
+	if err := os.MkdirAll(exportDir(), 0o700); err != nil {
+		return err
+	}
+	path := filepath.Join(exportDir(), fmt.Sprintf("export-%d-%d.zip", job.UserID, job.ID))
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	manifest := map[string]interface{}{
+		"job_id":       job.ID,
+		"user_id":      job.UserID,
+		"generated_at": time.Now(),
+		"steps":        job.Steps,
+	}
+	files["manifest.json"] = manifest
+
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(content); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(archiveTTL)
+	job.ArchivePath = path
+	job.ExpiresAt = &expires
+	return database.DB.Model(job).Updates(map[string]interface{}{"archive_path": path, "expires_at": expires}).Error
+}
+
+func fetchReservations(userID uint) (interface{}, error) {
+	resp, err := ticketingRequest(http.MethodGet, "/users/"+strconv.FormatUint(uint64(userID), 10)+"/reservations")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return []interface{}{}, nil
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("ticketing returned %d", resp.StatusCode)
+	}
+
+	var result interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("invalid ticketing response: %w", err)
+	}
+	return result, nil
+}
+
+// ================================
+// DELETION
+// ================================
+
+const (
+	// deletionLease bounds how long one attempt may take before another
+	// instance may pick the job up
+	deletionLease = 10 * time.Minute
+	// Failed attempts are retried after 1, 2, 4, ... minutes, up to
+	// maxRetryDelay, until they succeed
+	maxRetryDelay = 6 * time.Hour
+)
+
+// httpClient is used for the calls Core makes to the sub-systems as itself.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// ErrDeletionUnavailable is returned when Core has no credentials of its own
+// for the sub-systems, so a deletion could never finish.
+var ErrDeletionUnavailable = errors.New("account deletion is not configured, set TICKET_SERVICE_TOKEN and FORUM_SERVICE_TOKEN")
+
+// subsystemsConfigured reports whether Core has credentials of its own for
+// every sub-system a deletion has to call.
+func subsystemsConfigured() bool {
+	return os.Getenv("TICKET_SERVICE_TOKEN") != "" && os.Getenv("FORUM_SERVICE_TOKEN") != ""
+}
+
+// StartDeletion removes the user's data from the sub-systems first and, once
+// every one of them has succeeded, anonymizes or deletes the Core account.
+// Failed steps are retried in the background, also after a restart. Export
+// archives of the user are removed right away. requestedBy is the admin
+// deleting the account, or 0 when the user asked themselves.
+//
+// Without credentials for the sub-systems, users can't delete themselves.
+// Admins still can: the Core account is erased straight away and the
+// sub-system steps wait until the credentials are configured.
+func StartDeletion(u *users.User, mode string, requestedBy uint) (*Job, string, error) {
+	// The user's sessions are revoked below, so every step runs with Core's
+	// own credentials
+	if requestedBy == 0 && !subsystemsConfigured() {
+		return nil, "", ErrDeletionUnavailable
+	}
+
+	job, raw, err := newJob(u.ID, KindDelete, mode, requestedBy, []string{"ticketing", "forum", "core"})
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	job.NextAttemptAt = &now
+	if err := database.DB.Model(job).Update("next_attempt_at", now).Error; err != nil {
+		return nil, "", err
+	}
+
+	// Stop new logins right away; the job takes care of the rest
+	if err := auth.RevokeUserRefreshTokens(u.ID); err != nil {
+		log.Printf("privacy job %d: failed to revoke sessions: %v", job.ID, err)
+	}
+	if err := purgeUserExports(u.ID); err != nil {
+		log.Printf("privacy job %d: failed to remove exports: %v", job.ID, err)
+	}
+
+	go runDeletion(job.ID)
+	return job, raw, nil
+}
+
+// deletionInProgress reports whether a deletion of the user is underway.
+func deletionInProgress(userID uint) (bool, error) {
+	var n int64
+	err := database.DB.Model(&Job{}).
+		Where("user_id = ? AND kind = ? AND status IN ?", userID, KindDelete, []string{StatusPending, StatusRunning}).
+		Count(&n).Error
+	return n > 0, err
+}
+
+// DeleteAccount deletes an account on behalf of the admin adminID, through
+// the same job as self-service deletion so the ticketing and forum data goes
+// too. Accounts already being deleted are left alone.
+func DeleteAccount(u *users.User, adminID uint) error {
+	running, err := deletionInProgress(u.ID)
+	if err != nil || running {
+		return err
+	}
+	_, _, err = StartDeletion(u, ModeDelete, adminID)
+	return err
+}
+
+// resumeDeletions runs the deletions that are due for another attempt or
+// whose instance died while running them.
+func resumeDeletions() {
+	now := time.Now()
+	var ids []uint
+	if err := database.DB.Model(&Job{}).
+		Where("kind = ?", KindDelete).
+		Where("(status = ? AND next_attempt_at <= ?) OR (status = ? AND lease_until < ?)", StatusPending, now, StatusRunning, now).
+		Order("id ASC").
+		Pluck("id", &ids).Error; err != nil {
+		log.Printf("privacy: failed to list pending deletions: %v", err)
+		return
+	}
+	for _, id := range ids {
+		runDeletion(id)
+	}
+}
+
+// claimDeletion takes the job for this instance unless another one holds it.
+func claimDeletion(id uint) (*Job, bool) {
+	now := time.Now()
+	res := database.DB.Model(&Job{}).
+		Where("id = ? AND kind = ?", id, KindDelete).
+		Where("(status = ? AND next_attempt_at <= ?) OR (status = ? AND lease_until < ?)", StatusPending, now, StatusRunning, now).
+		Updates(map[string]interface{}{"status": StatusRunning, "lease_until": now.Add(deletionLease)})
+	if res.Error != nil {
+		log.Printf("privacy job %d: failed to claim: %v", id, res.Error)
+		return nil, false
+	}
+	if res.RowsAffected == 0 {
+		return nil, false
+	}
+
+	var job Job
+	if err := database.DB.Preload("Steps").First(&job, id).Error; err != nil {
+		log.Printf("privacy job %d: failed to load: %v", id, err)
+		return nil, false
+	}
+	if job.StartedAt == nil {
+		job.StartedAt = &now
+		database.DB.Model(&job).Update("started_at", now)
+	}
+	return &job, true
+}
+
+// runDeletion makes one attempt at a deletion job. Steps that already
+// succeeded are skipped.
+func runDeletion(id uint) {
+	job, ok := claimDeletion(id)
+	if !ok {
+		return
+	}
+
+	var u users.User
+	if err := database.DB.First(&u, job.UserID).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			retryDeletion(job)
+			return
+		}
+		// Removed by other means; only the sub-systems are left to clean up
+		u = users.User{ID: job.UserID}
+	}
+
+	external := true
+	for _, name := range []string{"ticketing", "forum"} {
+		if stepDone(job, name) {
+			continue
+		}
+		if !runStep(job, name, func() error { return deleteFromSubsystem(name, u.ID) }) {
+			external = false
+		}
+	}
+	// The account is only erased once nothing of the user is left elsewhere,
+	// so a failed step can still be retried for the right user. Admin
+	// deletions don't wait for sub-systems Core has no credentials for; the
+	// steps only need the id, which the job keeps.
+	eraseFirst := job.RequestedBy != 0 && !subsystemsConfigured()
+	if !external && !eraseFirst {
+		retryDeletion(job)
+		return
+	}
+	if !stepDone(job, "core") {
+		if !runStep(job, "core", func() error { return eraseCoreAccount(&u, job.Mode) }) {
+			retryDeletion(job)
+			return
+		}
+		// The address is gone from now on, so confirm while it is known
+		sendDeletionConfirmation(job, &u)
+	}
+	if !external {
+		retryDeletion(job)
+		return
+	}
+
+	now := time.Now()
+	job.Status = StatusCompleted
+	job.FinishedAt = &now
+	database.DB.Model(job).Updates(map[string]interface{}{
+		"status": StatusCompleted, "finished_at": now, "next_attempt_at": nil, "lease_until": nil,
+	})
+}
+
+// sendDeletionConfirmation tells the user their account has been erased.
+func sendDeletionConfirmation(job *Job, u *users.User) {
+	if u.Email == "" {
+		return
+	}
+	body := fmt.Sprintf("Hi %s,\n\nAs requested, your Cinemesh account and personal data have been removed.\n", u.Username)
+	if job.RequestedBy != 0 {
+		body = fmt.Sprintf("Hi %s,\n\nYour Cinemesh account and personal data have been removed by an administrator. "+
+			"If you think this is a mistake, please contact support.\n", u.Username)
+	}
+	if err := mail.Send(mail.Message{
+		To:      u.Email,
+		Subject: "Your Cinemesh account has been deleted",
+		Body:    body,
+	}); err != nil {
+		log.Printf("privacy job %d: failed to send confirmation: %v", job.ID, err)
+	}
+}
+
+func stepDone(job *Job, name string) bool {
+	for _, s := range job.Steps {
+		if s.Name == name {
+			return s.Status == StatusCompleted
+		}
+	}
+	return false
+}
+
+// retryDeletion puts the job back in line with an exponential delay.
+func retryDeletion(job *Job) {
+	job.Attempts++
+	delay := maxRetryDelay
+	if job.Attempts < 20 {
+		if d := time.Duration(1<<(job.Attempts-1)) * time.Minute; d < maxRetryDelay {
+			delay = d
+		}
+	}
+	next := time.Now().Add(delay)
+	job.Status = StatusPending
+	job.NextAttemptAt = &next
+	log.Printf("privacy job %d: attempt %d failed, retrying at %s", job.ID, job.Attempts, next.Format(time.RFC3339))
+	database.DB.Model(job).Updates(map[string]interface{}{
+		"status": StatusPending, "attempts": job.Attempts, "next_attempt_at": next, "lease_until": nil,
+	})
+}
+
+func deleteFromSubsystem(name string, userID uint) error {
+	if name == "ticketing" {
+		return deleteTicketingUser(userID)
+	}
+
+	client, err := forum.ServiceClient()
+	if err != nil {
+		return err
+	}
+	return client.AnonymizeUser(strconv.FormatUint(uint64(userID), 10))
+}
+
+func deleteTicketingUser(userID uint) error {
+	resp, err := ticketingRequest(http.MethodDelete, "/users/"+strconv.FormatUint(uint64(userID), 10))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("ticketing returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// eraseCoreAccount removes credentials and export archives and either
+// deletes the user row or replaces everything identifying in it.
+func eraseCoreAccount(u *users.User, mode string) error {
+	if err := purgeUserExports(u.ID); err != nil {
+		return err
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&auth.TOTPCredential{}, &auth.RecoveryCode{}, &auth.PasswordResetToken{}, &oidc.Consent{}} {
+			if err := tx.Where("user_id = ?", u.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		if mode == ModeDelete {
+			return tx.Delete(&users.User{}, u.ID).Error
+		}
+
+		id := strconv.FormatUint(uint64(u.ID), 10)
+		return tx.Model(&users.User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+			"username":          "deleted-user-" + id,
+			"email":             "deleted-" + id + "@deleted.invalid",
+			"password_hash":     "!",
+			"avatar_url":        "",
+			"role":              "user",
+			"email_verified_at": nil,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := auth.RevokeUserRefreshTokens(u.ID); err != nil {
+		return err
+	}
+	if u.Email != "" {
+		throttle.Reset(throttle.AccountKey(u.Email))
+	}
+	if err := media.DeleteAvatar(u.AvatarURL); err != nil {
+		log.Printf("failed to delete avatar of user %d: %v", u.ID, err)
+	}
+	return nil
+}
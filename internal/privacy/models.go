@@ -0,0 +1,65 @@
+package privacy
+
+import "time"
+
+const (
+	KindExport = "export"
+	KindDelete = "delete"
+
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusPartial   = "partial" // finished, but at least one step failed
+	StatusFailed    = "failed"
+
+	// Deletion modes: anonymize keeps the user row with every identifying
+	// field replaced, delete removes it.
+	ModeAnonymize = "anonymize"
+	ModeDelete    = "delete"
+)
+
+// Job is one data export or account deletion. Its status can be checked with
+// the opaque token handed out when it was created, which keeps working after
+// the account itself is gone.
+type Job struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	UserID          uint       `gorm:"not null;index" json:"user_id"`
+	Kind            string     `gorm:"size:20;not null" json:"kind"`
+	Mode            string     `gorm:"size:20" json:"mode,omitempty"`
+	Status          string     `gorm:"size:20;not null" json:"status"`
+	StatusTokenHash string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	ArchivePath     string     `json:"-"`
+	Steps           []JobStep  `gorm:"constraint:OnDelete:CASCADE" json:"steps"`
+	CreatedAt       time.Time  `json:"created_at"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	// Deletions are retried until every step has succeeded
+	Attempts      int        `gorm:"not null;default:0" json:"attempts,omitempty"`
+	NextAttemptAt *time.Time `gorm:"index" json:"next_attempt_at,omitempty"`
+	// LeaseUntil marks a job as taken by a running instance; a crashed
+	// instance's jobs are picked up again once it passes
+	LeaseUntil *time.Time `json:"-"`
+	// RequestedBy is the admin who deleted the account; 0 when the user
+	// asked themselves
+	RequestedBy uint `gorm:"not null;default:0" json:"-"`
+}
+
+func (Job) TableName() string {
+	return "privacy_jobs"
+}
+
+// JobStep is the part of a job handled by one system (core, ticketing, forum).
+type JobStep struct {
+	ID         uint       `gorm:"primaryKey" json:"-"`
+	JobID      uint       `gorm:"not null;index" json:"-"`
+	Name       string     `gorm:"size:50;not null" json:"name"`
+	Status     string     `gorm:"size:20;not null" json:"status"`
+	Error      string     `gorm:"type:text" json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func (JobStep) TableName() string {
+	return "privacy_job_steps"
+}
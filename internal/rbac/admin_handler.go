@@ -0,0 +1,180 @@
+package rbac
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/gin-gonic/gin"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,49}$`)
+
+func renderRoles(c *gin.Context, status int, errMsg string) {
+	var roles []Role
+	if err := database.DB.Preload("Permissions").Order("name ASC").Find(&roles).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	var permissions []Permission
+	if err := database.DB.Order("name ASC").Find(&permissions).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	c.HTML(status, "roles.html", gin.H{
+		"title":       "Roles",
+		"roles":       roles,
+		"permissions": permissions,
+		"error":       errMsg,
+	})
+}
+
+// ListRolesHandler renders the role/permission matrix
+func ListRolesHandler(c *gin.Context) {
+	renderRoles(c, http.StatusOK, "")
+}
+
+// checkGrant refuses permissions the caller doesn't hold, so roles:manage
+// can't be used to grant more than the caller has (see CanAssign).
+func checkGrant(c *gin.Context, names []string) bool {
+	if missing := Missing(c.GetStringSlice("permissions"), names); len(missing) > 0 {
+		renderRoles(c, http.StatusForbidden, "You can't grant permissions you don't hold: "+strings.Join(missing, ", "))
+		return false
+	}
+	return true
+}
+
+func CreateRoleHandler(c *gin.Context) {
+	name := strings.TrimSpace(c.PostForm("name"))
+	if !roleNamePattern.MatchString(name) {
+		renderRoles(c, http.StatusBadRequest, "Role names are lowercase letters, digits and underscores")
+		return
+	}
+	if RoleExists(name) {
+		renderRoles(c, http.StatusConflict, "A role with this name already exists")
+		return
+	}
+
+	if !checkGrant(c, c.PostFormArray("permissions")) {
+		return
+	}
+
+	role := Role{Name: name, Description: strings.TrimSpace(c.PostForm("description"))}
+	if perms := c.PostFormArray("permissions"); len(perms) > 0 {
+		if err := database.DB.Where("name IN ?", perms).Find(&role.Permissions).Error; err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := database.DB.Create(&role).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "role.create", "role", role.ID, nil, roleSnapshot(&role))
+	c.Redirect(http.StatusFound, "/admin/roles")
+}
+
+// UpdateRoleHandler replaces the permissions of a role. The admin role is
+// managed by Seed and can't be edited, and nobody can edit their own role
+// or one granting something they lack.
+func UpdateRoleHandler(c *gin.Context) {
+	role, ok := findRole(c)
+	if !ok {
+		return
+	}
+	if role.Name == RoleAdmin {
+		renderRoles(c, http.StatusBadRequest, "The admin role always has every permission")
+		return
+	}
+	if role.Name == c.GetString("user_role") {
+		renderRoles(c, http.StatusForbidden, "You can't edit your own role")
+		return
+	}
+	current := make([]string, len(role.Permissions))
+	for i, p := range role.Permissions {
+		current[i] = p.Name
+	}
+	if !checkGrant(c, current) || !checkGrant(c, c.PostFormArray("permissions")) {
+		return
+	}
+
+	var perms []Permission
+	if names := c.PostFormArray("permissions"); len(names) > 0 {
+		if err := database.DB.Where("name IN ?", names).Find(&perms).Error; err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	before := roleSnapshot(role)
+	role.Description = strings.TrimSpace(c.PostForm("description"))
+	if err := database.DB.Save(role).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	if err := database.DB.Model(role).Association("Permissions").Replace(perms); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	role.Permissions = perms
+	audit.Record(c, "role.update", "role", role.ID, before, roleSnapshot(role))
+	c.Redirect(http.StatusFound, "/admin/roles")
+}
+
+// DeleteRoleHandler removes a role that no user holds anymore
+func DeleteRoleHandler(c *gin.Context) {
+	role, ok := findRole(c)
+	if !ok {
+		return
+	}
+	if role.Name == RoleAdmin || role.Name == RoleUser {
+		renderRoles(c, http.StatusBadRequest, "Built-in roles can't be deleted")
+		return
+	}
+
+	var holders int64
+	database.DB.Table("users").Where("role = ?", role.Name).Count(&holders)
+	if holders > 0 {
+		renderRoles(c, http.StatusConflict, "Role "+role.Name+" is still assigned to "+strconv.FormatInt(holders, 10)+" user(s)")
+		return
+	}
+
+	if err := database.DB.Model(role).Association("Permissions").Clear(); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	if err := database.DB.Delete(role).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	audit.Record(c, "role.delete", "role", role.ID, roleSnapshot(role), nil)
+	c.Redirect(http.StatusFound, "/admin/roles")
+}
+
+// roleSnapshot is the audited form of a role, with permissions by name.
+func roleSnapshot(r *Role) gin.H {
+	names := make([]string, 0, len(r.Permissions))
+	for _, p := range r.Permissions {
+		names = append(names, p.Name)
+	}
+	return gin.H{"name": r.Name, "description": r.Description, "permissions": names}
+}
+
+func findRole(c *gin.Context) (*Role, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var role Role
+	if err := database.DB.Preload("Permissions").First(&role, uint(id)).Error; err != nil {
+		c.HTML(http.StatusNotFound, "error.html", gin.H{"error": "role not found"})
+		return nil, false
+	}
+	return &role, true
+}
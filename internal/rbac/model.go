@@ -0,0 +1,46 @@
+package rbac
+
+import "time"
+
+// Permission names are "<resource>:<action>".
+const (
+	AdminAccess      = "admin:access"
+	UsersRead        = "users:read"
+	UsersWrite       = "users:write"
+	MoviesWrite      = "movies:write"
+	GenresWrite      = "genres:write"
+	ForumModerate    = "forum:moderate"
+	TicketsRead      = "tickets:read"
+	OAuthManage      = "oauth:manage"
+	RolesManage      = "roles:manage"
+	APIKeysManage    = "apikeys:manage"
+	AuditRead        = "audit:read"
+	UsersImpersonate = "users:impersonate"
+)
+
+// Permission is a single capability that can be granted to roles.
+type Permission struct {
+	ID          uint   `gorm:"primaryKey"`
+	Name        string `gorm:"size:64;uniqueIndex;not null"`
+	Description string `gorm:"size:255"`
+}
+
+// Role is referenced by name from users.User.Role.
+type Role struct {
+	ID          uint         `gorm:"primaryKey"`
+	Name        string       `gorm:"size:50;uniqueIndex;not null"`
+	Description string       `gorm:"size:255"`
+	Permissions []Permission `gorm:"many2many:role_permissions;"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// HasPermission reports whether the role grants the permission
+func (r *Role) HasPermission(name string) bool {
+	for _, p := range r.Permissions {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package rbac
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"gorm.io/gorm"
+)
+
+// Built-in role names. "admin" always holds every permission.
+const (
+	RoleUser           = "user"
+	RoleAdmin          = "admin"
+	RoleForumModerator = "forum_moderator"
+	RoleCatalogEditor  = "catalog_editor"
+	RoleTicketSupport  = "ticket_support"
+)
+
+var defaultPermissions = []Permission{
+	{Name: AdminAccess, Description: "Sign in to the admin panel"},
+	{Name: UsersRead, Description: "View user accounts"},
+	{Name: UsersWrite, Description: "Create, edit and delete user accounts"},
+	{Name: MoviesWrite, Description: "Manage movies, cast, people and TMDb imports"},
+	{Name: GenresWrite, Description: "Manage genres"},
+	{Name: ForumModerate, Description: "Manage forum topics, threads and replies"},
+	{Name: TicketsRead, Description: "View ticket reservations"},
+	{Name: OAuthManage, Description: "Manage OAuth / OIDC clients"},
+	{Name: RolesManage, Description: "Manage roles and their permissions"},
+	{Name: APIKeysManage, Description: "Issue and revoke API keys"},
+	{Name: AuditRead, Description: "View and export the audit log"},
+	{Name: UsersImpersonate, Description: "Act as a regular user for support"},
+}
+
+var defaultRoles = []struct {
+	Name        string
+	Description string
+	Permissions []string
+}{
+	{RoleUser, "Regular account", nil},
+	{RoleForumModerator, "Moderates the forum", []string{AdminAccess, ForumModerate}},
+	{RoleCatalogEditor, "Maintains the movie catalog", []string{AdminAccess, MoviesWrite, GenresWrite}},
+	{RoleTicketSupport, "Helps customers with reservations", []string{AdminAccess, TicketsRead, UsersRead, UsersImpersonate}},
+}
+
+// Seed creates the built-in permissions and roles. Existing roles other than
+// admin are left alone so changes made in the admin panel survive restarts.
+func Seed() error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var all []Permission
+		for _, p := range defaultPermissions {
+			perm := p
+			if err := tx.Where(Permission{Name: perm.Name}).
+				Assign(Permission{Description: perm.Description}).
+				FirstOrCreate(&perm).Error; err != nil {
+				return fmt.Errorf("seed permission %s: %w", p.Name, err)
+			}
+			all = append(all, perm)
+		}
+
+		admin := Role{Name: RoleAdmin}
+		if err := tx.Where(Role{Name: RoleAdmin}).
+			Attrs(Role{Description: "Full access"}).
+			FirstOrCreate(&admin).Error; err != nil {
+			return fmt.Errorf("seed admin role: %w", err)
+		}
+		if err := tx.Model(&admin).Association("Permissions").Replace(all); err != nil {
+			return fmt.Errorf("seed admin permissions: %w", err)
+		}
+
+		for _, def := range defaultRoles {
+			var count int64
+			tx.Model(&Role{}).Where("name = ?", def.Name).Count(&count)
+			if count > 0 {
+				continue
+			}
+			role := Role{Name: def.Name, Description: def.Description}
+			if len(def.Permissions) > 0 {
+				if err := tx.Where("name IN ?", def.Permissions).Find(&role.Permissions).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Create(&role).Error; err != nil {
+				return fmt.Errorf("seed role %s: %w", def.Name, err)
+			}
+			log.Printf("✓ Role created: %s", def.Name)
+		}
+		return nil
+	})
+}
+
+// PermissionsFor returns the permission names granted to a role. Unknown
+// roles have none.
+func PermissionsFor(roleName string) ([]string, error) {
+	var role Role
+	if err := database.DB.Preload("Permissions").Where("name = ?", roleName).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	names := make([]string, len(role.Permissions))
+	for i, p := range role.Permissions {
+		names[i] = p.Name
+	}
+	return names, nil
+}
+
+// RoleHasPermission looks up a single permission of a role.
+func RoleHasPermission(roleName, permission string) bool {
+	perms, err := PermissionsFor(roleName)
+	if err != nil {
+		return false
+	}
+	return Contains(perms, permission)
+}
+
+// CanAssign reports whether a caller holding perms may give an account the
+// role, or edit an account that has it: only when the role grants nothing
+// the caller lacks. Without this, users:write would be a way to become admin.
+func CanAssign(perms []string, role string) (bool, error) {
+	granted, err := PermissionsFor(role)
+	if err != nil {
+		return false, err
+	}
+	return len(Missing(perms, granted)) == 0, nil
+}
+
+// Missing lists the permissions in wanted that held lacks. A caller may
+// only give out, through roles or role edits, what Missing leaves empty.
+func Missing(held, wanted []string) []string {
+	var missing []string
+	for _, p := range wanted {
+		if !Contains(held, p) {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// RoleExists reports whether a role with this name exists.
+func RoleExists(name string) bool {
+	var count int64
+	database.DB.Model(&Role{}).Where("name = ?", name).Count(&count)
+	return count > 0
+}
+
+// RoleNames lists all role names, for select boxes.
+func RoleNames() []string {
+	var names []string
+	database.DB.Model(&Role{}).Order("name ASC").Pluck("name", &names)
+	return names
+}
+
+// Contains reports whether perms includes permission.
+func Contains(perms []string, permission string) bool {
+	for _, p := range perms {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package rbac
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMissing(t *testing.T) {
+	editor := []string{AdminAccess, "movies:write", "people:write"}
+	tests := []struct {
+		name   string
+		held   []string
+		wanted []string
+		want   []string
+	}{
+		{"nothing wanted", editor, nil, nil},
+		{"subset", editor, []string{"movies:write"}, nil},
+		{"same set", editor, editor, nil},
+		{"one more", editor, []string{"movies:write", "roles:manage"}, []string{"roles:manage"}},
+		{"holding nothing", nil, []string{"movies:write", "users:write"}, []string{"movies:write", "users:write"}},
+		{"names are exact", []string{"movies:write"}, []string{"movies:*"}, []string{"movies:*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Missing(tt.held, tt.wanted); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Missing() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package throttle
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Window counts requests for one key in fixed time windows. It lives in the
+// database so a limit holds across all instances. Use it for limits that
+// must hold exactly, such as per API key; busy anonymous traffic belongs on
+// a LocalLimiter.
+type Window struct {
+	ID        uint      `gorm:"primaryKey"`
+	Key       string    `gorm:"size:255;uniqueIndex;not null"`
+	Hits      int       `gorm:"not null;default:0"`
+	StartedAt time.Time `gorm:"not null"`
+}
+
+func (Window) TableName() string {
+	return "throttle_windows"
+}
+
+// Allow counts a request for key and reports whether it is within limit
+// requests per window. If not, it also returns when the window resets.
+func Allow(key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	var (
+		w     Window
+		allow bool
+		wait  time.Duration
+	)
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&Window{Key: key, StartedAt: now}).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("key = ?", key).First(&w).Error; err != nil {
+			return err
+		}
+
+		if now.Sub(w.StartedAt) >= window {
+			w.Hits = 0
+			w.StartedAt = now
+		}
+		if w.Hits >= limit {
+			wait = w.StartedAt.Add(window).Sub(now)
+			return nil
+		}
+
+		allow = true
+		w.Hits++
+		return tx.Save(&w).Error
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return allow, wait, nil
+}
+
+// windowRetention is how long an idle window is kept. It must exceed the
+// longest window any caller uses.
+const windowRetention = 24 * time.Hour
+
+// PruneWindows deletes windows that have been idle for windowRetention.
+func PruneWindows() error {
+	return database.DB.Where("started_at < ?", time.Now().Add(-windowRetention)).Delete(&Window{}).Error
+}
+
+// InitializeCleanup prunes idle windows in the background every hour.
+func InitializeCleanup() {
+	go func() {
+		for {
+			if err := PruneWindows(); err != nil {
+				log.Printf("throttle: failed to prune windows: %v", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// LocalLimiter is an in-process token bucket per key. It needs no database
+// round trip, so it suits hot paths like anonymous catalog requests; the
+// limit applies per instance rather than across all of them.
+type LocalLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// NewLocalLimiter allows perMinute requests per key and minute, in bursts
+// of up to perMinute.
+func NewLocalLimiter(perMinute int) *LocalLimiter {
+	return &LocalLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Allow takes a token for key. If none is left it reports false and how
+// long until the next one.
+func (l *LocalLimiter) Allow(key string) (bool, time.Duration) {
+	return l.allow(key, time.Now())
+}
+
+func (l *LocalLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return false, time.Minute
+	}
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that have refilled completely, which behave the
+// same as a new one, so the map only holds recently active keys.
+func (l *LocalLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.at) >= full {
+			delete(l.buckets, k)
+		}
+	}
+}
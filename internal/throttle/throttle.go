@@ -0,0 +1,192 @@
+package throttle
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Counter tracks consecutive failures for one key, e.g. an account or an IP.
+type Counter struct {
+	ID            uint   `gorm:"primaryKey"`
+	Key           string `gorm:"size:255;uniqueIndex;not null"`
+	Failures      int    `gorm:"not null;default:0"`
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (Counter) TableName() string {
+	return "throttle_counters"
+}
+
+// Locked reports whether the counter is locked right now.
+func (ct *Counter) Locked() bool {
+	return ct.LockedUntil != nil && time.Now().Before(*ct.LockedUntil)
+}
+
+// Policy decides when a key gets locked. After MaxFailures the lockout is
+// BaseLockout and doubles with every further failure, up to MaxLockout.
+// Counters reset once Window has passed without a failure or lockout.
+type Policy struct {
+	MaxFailures int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+	Window      time.Duration
+}
+
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Attempt reserves an attempt for key before the caller checks anything.
+// While the key is locked it returns how long for and counts nothing.
+// Otherwise the attempt is counted as a failure right away, locking the key
+// once it reaches MaxFailures, and the caller has to Release or Reset the
+// key if it succeeds. Counting first, under a row lock, means concurrent
+// requests can't squeeze in more guesses than the policy allows.
+func Attempt(key string, p Policy) (*Counter, time.Duration, error) {
+	var (
+		ct   Counter
+		wait time.Duration
+	)
+	err := withCounter(key, &ct, func(tx *gorm.DB) error {
+		var ok bool
+		if wait, ok = reserve(&ct, p, time.Now()); !ok {
+			return nil
+		}
+		return tx.Save(&ct).Error
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &ct, wait, nil
+}
+
+// Release takes back an attempt reserved by Attempt that turned out to be
+// legitimate, lifting the lockout it may have triggered.
+func Release(key string, p Policy) error {
+	var ct Counter
+	return withCounter(key, &ct, func(tx *gorm.DB) error {
+		release(&ct, p)
+		return tx.Save(&ct).Error
+	})
+}
+
+// withCounter runs fn with the key's counter loaded and locked, creating it
+// if needed.
+func withCounter(key string, ct *Counter, fn func(tx *gorm.DB) error) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&Counter{Key: key}).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("key = ?", key).First(ct).Error; err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// reserve counts an attempt on ct unless it is locked at now, in which case
+// it returns the time left and false.
+func reserve(ct *Counter, p Policy, now time.Time) (time.Duration, bool) {
+	if ct.LockedUntil != nil && now.Before(*ct.LockedUntil) {
+		return ct.LockedUntil.Sub(now), false
+	}
+	if expired(ct, p.Window, now) {
+		ct.Failures = 0
+		ct.LockedUntil = nil
+	}
+
+	ct.Failures++
+	ct.LastFailureAt = now
+	if ct.Failures >= p.MaxFailures {
+		until := now.Add(backoff(ct.Failures-p.MaxFailures, p))
+		ct.LockedUntil = &until
+	}
+	return 0, true
+}
+
+// release undoes one reserve. A lockout only stands while the failures that
+// triggered it do.
+func release(ct *Counter, p Policy) {
+	if ct.Failures > 0 {
+		ct.Failures--
+	}
+	if ct.Failures < p.MaxFailures {
+		ct.LockedUntil = nil
+	}
+}
+
+// Reset clears the counter of a key.
+func Reset(key string) error {
+	return database.DB.Where("key = ?", key).Delete(&Counter{}).Error
+}
+
+// ResetByID clears a counter by its id (used by the admin UI).
+func ResetByID(id uint) (*Counter, error) {
+	var ct Counter
+	if err := database.DB.First(&ct, id).Error; err != nil {
+		return nil, err
+	}
+	if err := database.DB.Delete(&ct).Error; err != nil {
+		return nil, err
+	}
+	return &ct, nil
+}
+
+// ForKeys returns the counters that exist for the given keys, by key.
+func ForKeys(keys []string) (map[string]*Counter, error) {
+	out := make(map[string]*Counter)
+	if len(keys) == 0 {
+		return out, nil
+	}
+	var counters []Counter
+	if err := database.DB.Where("key IN ?", keys).Find(&counters).Error; err != nil {
+		return nil, err
+	}
+	for i := range counters {
+		out[counters[i].Key] = &counters[i]
+	}
+	return out, nil
+}
+
+// LockedWithPrefix lists the counters currently locked whose key starts with
+// prefix, e.g. "ip:".
+func LockedWithPrefix(prefix string) ([]Counter, error) {
+	var counters []Counter
+	err := database.DB.
+		Where("key LIKE ? AND locked_until > ?", prefix+"%", time.Now()).
+		Order("locked_until DESC").
+		Find(&counters).Error
+	return counters, err
+}
+
+func expired(ct *Counter, window time.Duration, now time.Time) bool {
+	last := ct.LastFailureAt
+	if ct.LockedUntil != nil && ct.LockedUntil.After(last) {
+		last = *ct.LockedUntil
+	}
+	return now.Sub(last) > window
+}
+
+func backoff(step int, p Policy) time.Duration {
+	d := p.BaseLockout
+	for i := 0; i < step && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+	return d
+}
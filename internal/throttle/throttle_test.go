@@ -0,0 +1,142 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseLockout: time.Minute, MaxLockout: 15 * time.Minute}
+	tests := []struct {
+		name   string
+		step   int
+		policy Policy
+		want   time.Duration
+	}{
+		{"first lockout", 0, p, time.Minute},
+		{"doubles", 1, p, 2 * time.Minute},
+		{"doubles again", 3, p, 8 * time.Minute},
+		{"capped", 4, p, 15 * time.Minute},
+		{"stays capped", 1000, p, 15 * time.Minute},
+		{"negative step", -1, p, time.Minute},
+		{"base above max", 0, Policy{BaseLockout: time.Hour, MaxLockout: time.Minute}, time.Minute},
+		{"max equal to base", 5, Policy{BaseLockout: time.Minute, MaxLockout: time.Minute}, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backoff(tt.step, tt.policy); got != tt.want {
+				t.Errorf("backoff(%d) = %s, want %s", tt.step, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReserve(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time { t := now.Add(d); return &t }
+	p := Policy{MaxFailures: 3, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: 15 * time.Minute}
+
+	tests := []struct {
+		name         string
+		ct           Counter
+		wantWait     time.Duration
+		wantOK       bool
+		wantFailures int
+		wantLocked   bool
+	}{
+		{"first attempt", Counter{}, 0, true, 1, false},
+		{"below the limit", Counter{Failures: 1, LastFailureAt: now}, 0, true, 2, false},
+		{"reaching the limit locks the next attempts", Counter{Failures: 2, LastFailureAt: now}, 0, true, 3, true},
+		{"locked", Counter{Failures: 3, LastFailureAt: now, LockedUntil: at(30 * time.Second)}, 30 * time.Second, false, 3, true},
+		{"lock ran out", Counter{Failures: 3, LastFailureAt: now.Add(-2 * time.Minute), LockedUntil: at(-time.Minute)}, 0, true, 4, true},
+		{"window passed", Counter{Failures: 2, LastFailureAt: now.Add(-time.Hour)}, 0, true, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct := tt.ct
+			wait, ok := reserve(&ct, p, now)
+			if wait != tt.wantWait || ok != tt.wantOK {
+				t.Errorf("reserve() = %s, %v, want %s, %v", wait, ok, tt.wantWait, tt.wantOK)
+			}
+			if ct.Failures != tt.wantFailures {
+				t.Errorf("Failures = %d, want %d", ct.Failures, tt.wantFailures)
+			}
+			if locked := ct.LockedUntil != nil && now.Before(*ct.LockedUntil); locked != tt.wantLocked {
+				t.Errorf("locked = %v, want %v", locked, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func TestReserveAllowsOnlyMaxFailures(t *testing.T) {
+	p := Policy{MaxFailures: 5, BaseLockout: time.Minute, MaxLockout: time.Hour, Window: 15 * time.Minute}
+	now := time.Now()
+	var ct Counter
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if _, ok := reserve(&ct, p, now); ok {
+			allowed++
+		}
+	}
+	if allowed != p.MaxFailures {
+		t.Errorf("allowed %d attempts, want %d", allowed, p.MaxFailures)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	now := time.Now()
+	until := now.Add(time.Minute)
+	p := Policy{MaxFailures: 3}
+
+	tests := []struct {
+		name         string
+		ct           Counter
+		wantFailures int
+		wantLocked   bool
+	}{
+		{"undoes an attempt", Counter{Failures: 2}, 1, false},
+		{"lifts the lockout it triggered", Counter{Failures: 3, LockedUntil: &until}, 2, false},
+		{"keeps a lockout earned before", Counter{Failures: 5, LockedUntil: &until}, 4, true},
+		{"never below zero", Counter{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct := tt.ct
+			release(&ct, p)
+			if ct.Failures != tt.wantFailures || (ct.LockedUntil != nil) != tt.wantLocked {
+				t.Errorf("release() = %d failures, locked %v, want %d, %v", ct.Failures, ct.LockedUntil != nil, tt.wantFailures, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func TestLocalLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewLocalLimiter(60) // one per second, bursts of 60
+
+	for i := 0; i < 60; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok || wait != time.Second {
+		t.Errorf("past the burst: allow() = %v, %s, want false, 1s", ok, wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("another key was refused")
+	}
+	if ok, _ := l.allow("a", now.Add(time.Second)); !ok {
+		t.Error("a refilled token was refused")
+	}
+
+	// Keys that have refilled completely are swept
+	l.allow("c", now.Add(2*time.Hour))
+	if _, ok := l.buckets["a"]; ok || len(l.buckets) != 1 {
+		t.Errorf("buckets after sweep = %v, want only c", l.buckets)
+	}
+
+	if ok, _ := NewLocalLimiter(0).allow("a", now); ok {
+		t.Error("a zero limit allowed a request")
+	}
+}
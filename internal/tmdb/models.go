@@ -34,6 +34,7 @@ type MovieDetails struct {
 	ReleaseDate   string               `json:"release_date"`
 	Runtime       int                  `json:"runtime"`
 	VoteAverage   float64              `json:"vote_average"`
+	Popularity    float64              `json:"popularity"`
 	Status        string               `json:"status"`
 	Tagline       string               `json:"tagline"`
 	Genres        []Genre              `json:"genres"`
@@ -46,6 +46,7 @@ func (f *MovieFetcher) convertToMovie(details *MovieDetails) *movies.Movie {
 		PosterURL:     BuildPosterURL(details.PosterPath),
 		BackdropURL:   BuildBackdropURL(details.BackdropPath),
 		AverageRating: details.VoteAverage,
+		Popularity:    details.Popularity,
 	}
 
 	if details.ReleaseDate != "" {
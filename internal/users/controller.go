@@ -2,15 +2,18 @@ package users
 
 import (
 	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"time"
 
+	"github.com/Ponloe/cinemesh-core/internal/audit"
 	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
+	"github.com/Ponloe/cinemesh-core/internal/throttle"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -21,38 +24,34 @@ type CreateUserDTO struct {
 }
 
 type UserResponse struct {
-	ID        uint      `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	AvatarURL string    `json:"avatar_url,omitempty"`
-	Role      string    `json:"role"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              uint       `json:"id"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	AvatarURL       string     `json:"avatar_url,omitempty"`
+	Role            string     `json:"role"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
 }
 
 func toResponse(u *User) UserResponse {
 	return UserResponse{
-		ID:        u.ID,
-		Username:  u.Username,
-		Email:     u.Email,
-		AvatarURL: u.AvatarURL,
-		Role:      u.Role,
-		CreatedAt: u.CreatedAt,
-		UpdatedAt: u.UpdatedAt,
+		ID:              u.ID,
+		Username:        u.Username,
+		Email:           u.Email,
+		AvatarURL:       u.AvatarURL,
+		Role:            u.Role,
+		EmailVerifiedAt: u.EmailVerifiedAt,
+		CreatedAt:       u.CreatedAt,
+		UpdatedAt:       u.UpdatedAt,
 	}
 }
 
-func HashPassword(pw string) (string, error) {
-	b, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
-	return string(b), err
-}
-
 func CreateUserHandler(c *gin.Context) {
 	var input struct {
 		Username string `json:"username" binding:"required,min=3"`
 		Email    string `json:"email" binding:"required,email"`
-		Password string `json:"password" binding:"required,min=6"`
-		Role     string `json:"role"`
+		Password string `json:"password" binding:"required"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -60,18 +59,12 @@ func CreateUserHandler(c *gin.Context) {
 		return
 	}
 
-	// Set default role if not provided
-	if input.Role == "" {
-		input.Role = "user"
-	}
-
-	// Validate role enum
-	if input.Role != "user" && input.Role != "admin" {
-		c.JSON(400, gin.H{"error": "role must be 'user' or 'admin'"})
+	if err := ValidatePassword(input.Password, input.Username, input.Email); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	hashedPassword, err := HashPassword(input.Password)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "failed to hash password"})
 		return
@@ -80,8 +73,10 @@ func CreateUserHandler(c *gin.Context) {
 	user := User{
 		Username:     input.Username,
 		Email:        input.Email,
-		PasswordHash: string(hashedPassword),
-		Role:         input.Role,
+		PasswordHash: hashedPassword,
+		// Self-registration always makes regular accounts; roles are
+		// assigned in the admin panel
+		Role: rbac.RoleUser,
 	}
 
 	if err := database.DB.Create(&user).Error; err != nil {
@@ -93,11 +88,16 @@ func CreateUserHandler(c *gin.Context) {
 		return
 	}
 
+	if OnRegistered != nil {
+		OnRegistered(&user)
+	}
+
 	c.JSON(201, gin.H{
-		"id":       user.ID,
-		"username": user.Username,
-		"email":    user.Email,
-		"role":     user.Role,
+		"id":             user.ID,
+		"username":       user.Username,
+		"email":          user.Email,
+		"role":           user.Role,
+		"email_verified": false,
 	})
 }
 
@@ -122,17 +122,59 @@ func GetUserHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, toResponse(&user))
 }
 
-func ListUsersHandler(c *gin.Context) {
-	var users []User
-	if err := database.DB.Order("id ASC").Find(&users).Error; err != nil {
+// ClearLockoutHandler resets a login throttle counter (account or IP)
+func ClearLockoutHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "invalid id"})
+		return
+	}
+
+	ct, err := throttle.ResetByID(uint(id))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.Redirect(http.StatusFound, "/admin/users")
+			return
+		}
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
-	c.HTML(http.StatusOK, "users.html", gin.H{"users": users})
+
+	log.Printf("login lockout: %s cleared by admin user %d", ct.Key, c.GetUint("user_id"))
+	audit.Record(c, "lockout.clear", "throttle_counter", ct.Key, ct, nil)
+	c.Redirect(http.StatusFound, "/admin/users")
+}
+
+// CanManageRole renders a 403 page unless the signed-in admin may assign
+// role, or manage accounts that have it (see rbac.CanAssign).
+func CanManageRole(c *gin.Context, role string) bool {
+	ok, err := rbac.CanAssign(c.GetStringSlice("permissions"), role)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return false
+	}
+	if !ok {
+		c.HTML(http.StatusForbidden, "error.html", gin.H{"error": "you cannot manage accounts with the " + role + " role"})
+		return false
+	}
+	return true
+}
+
+// assignableRoles lists the roles the signed-in admin may give out, for the
+// role select of the user form.
+func assignableRoles(c *gin.Context) []string {
+	perms := c.GetStringSlice("permissions")
+	var names []string
+	for _, name := range rbac.RoleNames() {
+		if ok, err := rbac.CanAssign(perms, name); err == nil && ok {
+			names = append(names, name)
+		}
+	}
+	return names
 }
 
 func NewUserFormHandler(c *gin.Context) {
-	c.HTML(http.StatusOK, "user_form.html", gin.H{"user": User{}, "action": "/admin/users", "method": "POST"})
+	c.HTML(http.StatusOK, "user_form.html", gin.H{"user": User{Role: rbac.RoleUser}, "roles": assignableRoles(c), "action": "/admin/users", "method": "POST"})
 }
 
 func CreateUserAdminHandler(c *gin.Context) {
@@ -141,7 +183,18 @@ func CreateUserAdminHandler(c *gin.Context) {
 	password := c.PostForm("password")
 	role := c.PostForm("role")
 	if role == "" {
-		role = "user"
+		role = rbac.RoleUser
+	}
+	if !rbac.RoleExists(role) {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "unknown role"})
+		return
+	}
+	if !CanManageRole(c, role) {
+		return
+	}
+	if err := ValidatePassword(password, username, email); err != nil {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": err.Error()})
+		return
 	}
 
 	hashed, err := HashPassword(password)
@@ -150,17 +203,21 @@ func CreateUserAdminHandler(c *gin.Context) {
 		return
 	}
 
+	// Accounts created by an admin are trusted as-is
+	now := time.Now()
 	user := User{
-		Username:     username,
-		Email:        email,
-		PasswordHash: hashed,
-		Role:         role,
+		Username:        username,
+		Email:           email,
+		PasswordHash:    hashed,
+		Role:            role,
+		EmailVerifiedAt: &now,
 	}
 
 	if err := database.DB.Create(&user).Error; err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(c, "user.create", "user", user.ID, nil, user)
 
 	c.Redirect(http.StatusFound, "/admin/users")
 }
@@ -183,7 +240,25 @@ func EditUserFormHandler(c *gin.Context) {
 		return
 	}
 
-	c.HTML(http.StatusOK, "user_form.html", gin.H{"user": user, "action": "/admin/users/" + idStr, "method": "POST"})
+	restriction, err := ActiveRestriction(user.ID)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	history, err := RestrictionHistory(user.ID)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	c.HTML(http.StatusOK, "user_form.html", gin.H{
+		"user":               user,
+		"roles":              assignableRoles(c),
+		"action":             "/admin/users/" + idStr,
+		"method":             "POST",
+		"restriction":        restriction,
+		"restrictionHistory": history,
+	})
 }
 
 func UpdateUserHandler(c *gin.Context) {
@@ -201,14 +276,38 @@ func UpdateUserHandler(c *gin.Context) {
 	}
 
 	username := c.PostForm("username")
-	email := c.PostForm("email")
+	email := strings.TrimSpace(c.PostForm("email"))
 	role := c.PostForm("role")
 	password := c.PostForm("password") // optional
 
+	if !ValidEmail(email) {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "invalid email"})
+		return
+	}
+	if !rbac.RoleExists(role) {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "unknown role"})
+		return
+	}
+	// Both the account's current role and the new one must be within the
+	// admin's own permissions
+	if !CanManageRole(c, user.Role) || !CanManageRole(c, role) {
+		return
+	}
+
+	before := user
 	user.Username = username
 	user.Email = email
 	user.Role = role
+	// A new address has to be confirmed again, like a self-service change
+	emailChanged := !strings.EqualFold(email, before.Email)
+	if emailChanged {
+		user.EmailVerifiedAt = nil
+	}
 	if password != "" {
+		if err := ValidatePassword(password, username, email); err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": err.Error()})
+			return
+		}
 		hashed, err := HashPassword(password)
 		if err != nil {
 			c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": "failed to hash password"})
@@ -221,6 +320,18 @@ func UpdateUserHandler(c *gin.Context) {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(c, "user.update", "user", user.ID, before, user)
+
+	if emailChanged && OnEmailChanged != nil {
+		OnEmailChanged(&user)
+	}
+	// Sessions started with the old password or permissions must not live on
+	if password != "" || role != before.Role {
+		if err := RevokeSessions(user.ID); err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": "user updated, but signing them out failed: " + err.Error()})
+			return
+		}
+	}
 
 	c.Redirect(http.StatusFound, "/admin/users")
 }
@@ -233,10 +344,24 @@ func DeleteUserHandler(c *gin.Context) {
 		return
 	}
 
-	if err := database.DB.Delete(&User{}, uint(id)).Error; err != nil {
+	var user User
+	if err := database.DB.First(&user, uint(id)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.Redirect(http.StatusFound, "/admin/users")
+			return
+		}
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	if !CanManageRole(c, user.Role) {
+		return
+	}
+
+	if err := DeleteAccount(&user, c.GetUint("user_id")); err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
 		return
 	}
+	audit.Record(c, "user.delete", "user", user.ID, user, nil)
 
 	c.Redirect(http.StatusFound, "/admin/users")
 }
@@ -0,0 +1,320 @@
+package users
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/audit"
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"github.com/Ponloe/cinemesh-core/internal/rbac"
+	"github.com/Ponloe/cinemesh-core/internal/throttle"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultUsersPerPage = 25
+	maxUsersPerPage     = 100
+)
+
+// userFilterKeys are the query parameters understood by the users page and
+// its JSON twin.
+var userFilterKeys = []string{"q", "role", "status", "from", "to"}
+
+var userSorts = map[string]bool{"id": true, "username": true, "email": true, "role": true, "created_at": true}
+
+// userListParams is a parsed users page request.
+type userListParams struct {
+	Page    int
+	PerPage int
+	Sort    string
+	Order   string
+}
+
+func parseUserListParams(c *gin.Context) userListParams {
+	p := userListParams{Sort: c.DefaultQuery("sort", "id"), Order: c.DefaultQuery("order", "asc")}
+	p.Page, _ = strconv.Atoi(c.DefaultQuery("page", "1"))
+	if p.Page < 1 {
+		p.Page = 1
+	}
+	p.PerPage, _ = strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultUsersPerPage)))
+	if p.PerPage < 1 || p.PerPage > maxUsersPerPage {
+		p.PerPage = defaultUsersPerPage
+	}
+	if !userSorts[p.Sort] {
+		p.Sort = "id"
+	}
+	if p.Order != "asc" && p.Order != "desc" {
+		p.Order = "asc"
+	}
+	return p
+}
+
+// filteredUsers applies the users page filters. q matches username and
+// email, status is active, suspended or banned, from/to are creation dates
+// (YYYY-MM-DD, to is inclusive).
+func filteredUsers(c *gin.Context) *gorm.DB {
+	q := database.DB.Model(&User{})
+
+	if s := strings.TrimSpace(c.Query("q")); s != "" {
+		like := "%" + s + "%"
+		q = q.Where("username ILIKE ? OR email ILIKE ?", like, like)
+	}
+	if role := c.Query("role"); role != "" {
+		q = q.Where("role = ?", role)
+	}
+	restricted := database.DB.Model(&Restriction{}).Scopes(activeScope).
+		Select("1").Where("user_restrictions.user_id = users.id")
+	switch status := c.Query("status"); status {
+	case "active":
+		q = q.Where("NOT EXISTS (?)", restricted)
+	case RestrictionSuspended, RestrictionBanned:
+		q = q.Where("EXISTS (?)", restricted.Where("kind = ?", status))
+	}
+	if from, err := time.ParseInLocation("2006-01-02", c.Query("from"), time.Local); err == nil {
+		q = q.Where("created_at >= ?", from)
+	}
+	if to, err := time.ParseInLocation("2006-01-02", c.Query("to"), time.Local); err == nil {
+		q = q.Where("created_at < ?", to.AddDate(0, 0, 1))
+	}
+	return q
+}
+
+// listUsers runs the filtered, sorted and paginated query.
+func listUsers(c *gin.Context, p userListParams) ([]User, int64, error) {
+	var total int64
+	if err := filteredUsers(c).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var users []User
+	err := filteredUsers(c).
+		Order(p.Sort + " " + p.Order).Order("id ASC").
+		Limit(p.PerPage).Offset((p.Page - 1) * p.PerPage).
+		Find(&users).Error
+	return users, total, err
+}
+
+// userQueryString keeps the active filters, plus the given extra parameters,
+// for sort and pagination links. It is already encoded, so it is marked safe
+// for href attributes.
+func userQueryString(c *gin.Context, extra ...string) template.URL {
+	v := url.Values{}
+	for _, k := range append(userFilterKeys, extra...) {
+		if s := c.Query(k); s != "" {
+			v.Set(k, s)
+		}
+	}
+	return template.URL(v.Encode())
+}
+
+func ListUsersHandler(c *gin.Context) {
+	p := parseUserListParams(c)
+	users, total, err := listUsers(c, p)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	// Login throttle state per account, plus any locked client IPs
+	keys := make([]string, len(users))
+	for i := range users {
+		keys[i] = throttle.AccountKey(users[i].Email)
+	}
+	counters, err := throttle.ForKeys(keys)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+	lockouts := make(map[uint]*throttle.Counter)
+	for i := range users {
+		if ct, ok := counters[throttle.AccountKey(users[i].Email)]; ok {
+			lockouts[users[i].ID] = ct
+		}
+	}
+	lockedIPs, err := throttle.LockedWithPrefix("ip:")
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	ids := make([]uint, len(users))
+	for i := range users {
+		ids[i] = users[i].ID
+	}
+	restrictions, err := ActiveRestrictions(ids)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	filters := gin.H{}
+	for _, k := range userFilterKeys {
+		filters[k] = c.Query(k)
+	}
+
+	c.HTML(http.StatusOK, "users.html", gin.H{
+		"users":        users,
+		"lockouts":     lockouts,
+		"lockedIPs":    lockedIPs,
+		"restrictions": restrictions,
+		"roles":        rbac.RoleNames(),
+		"filters":      filters,
+		"query":        userQueryString(c, "per_page"),
+		"pageQuery":    userQueryString(c, "per_page", "sort", "order"),
+		"sort":         p.Sort,
+		"order":        p.Order,
+		"total":        total,
+		"page":         p.Page,
+		"hasPrev":      p.Page > 1,
+		"hasNext":      int64(p.Page*p.PerPage) < total,
+	})
+}
+
+// AdminUserResponse is a user as listed to admins, with their moderation
+// status.
+type AdminUserResponse struct {
+	UserResponse
+	Status          string     `json:"status"`
+	RestrictedUntil *time.Time `json:"restricted_until,omitempty"`
+}
+
+// ListUsersJSONHandler is ListUsersHandler for scripts and admin tooling. It
+// takes the same query parameters.
+func ListUsersJSONHandler(c *gin.Context) {
+	p := parseUserListParams(c)
+	users, total, err := listUsers(c, p)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ids := make([]uint, len(users))
+	for i := range users {
+		ids[i] = users[i].ID
+	}
+	restrictions, err := ActiveRestrictions(ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	data := make([]AdminUserResponse, len(users))
+	for i := range users {
+		data[i] = AdminUserResponse{UserResponse: toResponse(&users[i]), Status: "active"}
+		if r, ok := restrictions[users[i].ID]; ok {
+			data[i].Status = r.Kind
+			data[i].RestrictedUntil = r.ExpiresAt
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": data,
+		"pagination": gin.H{
+			"page":       p.Page,
+			"limit":      p.PerPage,
+			"total":      total,
+			"totalPages": (total + int64(p.PerPage) - 1) / int64(p.PerPage),
+		},
+	})
+}
+
+// ================================
+// BULK ACTIONS
+// ================================
+
+// bulkUsers loads the users selected on the users page. The signed-in admin
+// is never part of a bulk action, nor is anyone whose role the admin could
+// not assign.
+func bulkUsers(c *gin.Context) ([]User, bool) {
+	var ids []uint
+	for _, s := range c.PostFormArray("user_ids") {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "invalid id " + s})
+			return nil, false
+		}
+		if uint(id) == c.GetUint("user_id") {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "bulk actions cannot include your own account"})
+			return nil, false
+		}
+		ids = append(ids, uint(id))
+	}
+	if len(ids) == 0 {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "no users selected"})
+		return nil, false
+	}
+
+	var users []User
+	if err := database.DB.Where("id IN ?", ids).Order("id ASC").Find(&users).Error; err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return nil, false
+	}
+	checked := map[string]bool{}
+	for _, u := range users {
+		if !checked[u.Role] {
+			if !CanManageRole(c, u.Role) {
+				return nil, false
+			}
+			checked[u.Role] = true
+		}
+	}
+	return users, true
+}
+
+// BulkRoleHandler moves the selected users to another role.
+func BulkRoleHandler(c *gin.Context) {
+	role := c.PostForm("role")
+	if !rbac.RoleExists(role) {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{"error": "unknown role"})
+		return
+	}
+	if !CanManageRole(c, role) {
+		return
+	}
+	users, ok := bulkUsers(c)
+	if !ok {
+		return
+	}
+
+	for i := range users {
+		before := users[i]
+		if before.Role == role {
+			continue
+		}
+		users[i].Role = role
+		if err := database.DB.Model(&users[i]).Update("role", role).Error; err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": fmt.Sprintf("user %d: %v", users[i].ID, err)})
+			return
+		}
+		audit.Record(c, "user.update", "user", users[i].ID, before, users[i])
+		if err := RevokeSessions(users[i].ID); err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": fmt.Sprintf("user %d: signing out failed: %v", users[i].ID, err)})
+			return
+		}
+	}
+	c.Redirect(http.StatusFound, "/admin/users")
+}
+
+// BulkDeleteHandler deletes the selected users, each with a deletion job
+// like the one users start themselves.
+func BulkDeleteHandler(c *gin.Context) {
+	users, ok := bulkUsers(c)
+	if !ok {
+		return
+	}
+
+	for i := range users {
+		if err := DeleteAccount(&users[i], c.GetUint("user_id")); err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": fmt.Sprintf("user %d: %v", users[i].ID, err)})
+			return
+		}
+		audit.Record(c, "user.delete", "user", users[i].ID, users[i], nil)
+	}
+	c.Redirect(http.StatusFound, "/admin/users")
+}
@@ -1,14 +1,58 @@
 package users
 
-import "time"
+import (
+	"net/mail"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"gorm.io/gorm"
+)
 
 type User struct {
-	ID           uint   `gorm:"primaryKey"`
-	Username     string `gorm:"size:50;unique;not null"`
-	Email        string `gorm:"size:100;unique;not null"`
-	PasswordHash string `gorm:"not null"`
-	AvatarURL    string
-	Role         string `gorm:"default:user"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID              uint   `gorm:"primaryKey"`
+	Username        string `gorm:"size:50;unique;not null"`
+	Email           string `gorm:"size:100;unique;not null"`
+	PasswordHash    string `gorm:"not null"`
+	AvatarURL       string
+	Role            string `gorm:"default:user"`
+	EmailVerifiedAt *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// OnRegistered runs after a self-registered account is created, e.g. to send
+// the verification email.
+var OnRegistered func(u *User)
+
+// ValidEmail reports whether email is a bare address that fits the email
+// column, without a display name or surrounding spaces.
+func ValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && len(email) <= 100
+}
+
+// OnEmailChanged runs after an admin changes a user's email, e.g. to send a
+// verification email to the new address.
+var OnEmailChanged func(u *User)
+
+// RevokeSessions signs a user out on every device. Admin password and role
+// changes go through it; it is set up by main since sessions live in the
+// auth package.
+var RevokeSessions func(userID uint) error
+
+// DeleteAccount erases an account together with its data in the ticketing
+// and forum services, in the background, on behalf of the admin adminID.
+// Admin deletions go through it; it is set up by main since the deletion job
+// lives in the privacy package.
+var DeleteAccount func(u *User, adminID uint) error
+
+// BackfillEmailVerification marks the accounts that existed before email
+// verification was introduced as verified, once. Otherwise
+// REQUIRE_EMAIL_VERIFICATION would lock every one of them out.
+func BackfillEmailVerification() error {
+	return database.RunOnce("users_backfill_email_verified", func(tx *gorm.DB) error {
+		return tx.Model(&User{}).
+			Where("email_verified_at IS NULL").
+			Update("email_verified_at", gorm.Expr("created_at")).Error
+	})
 }
@@ -0,0 +1,28 @@
+package users
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"ana@example.com", true},
+		{"+x@y.com", true},
+		{"", false},
+		{"not an address", false},
+		{" ana@example.com", false},
+		{"Ana <ana@example.com>", false},
+		{strings.Repeat("a", 90) + "@example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			if got := ValidEmail(tt.email); got != tt.want {
+				t.Errorf("ValidEmail(%q) = %v, want %v", tt.email, got, tt.want)
+			}
+		})
+	}
+}
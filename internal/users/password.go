@@ -0,0 +1,187 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashes are self-describing: bcrypt hashes start with "$2a$",
+// "$2b$" or "$2y$" and argon2id hashes use the PHC string format
+// "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>". The algorithm and cost
+// of new hashes come from the environment; older hashes keep verifying and
+// are upgraded on the next successful login (see NeedsRehash).
+
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+type argon2Params struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+func envUint(name string, def uint64) uint64 {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// hashAlgorithm is the algorithm for new hashes (PASSWORD_HASH).
+func hashAlgorithm() string {
+	if strings.EqualFold(os.Getenv("PASSWORD_HASH"), HashBcrypt) {
+		return HashBcrypt
+	}
+	return HashArgon2id
+}
+
+func currentArgon2Params() argon2Params {
+	threads := envUint("ARGON2_THREADS", 2)
+	if threads > 255 {
+		threads = 255
+	}
+	return argon2Params{
+		Memory:  uint32(envUint("ARGON2_MEMORY_KB", 64*1024)),
+		Time:    uint32(envUint("ARGON2_TIME", 3)),
+		Threads: uint8(threads),
+	}
+}
+
+func currentBcryptCost() int {
+	cost := int(envUint("BCRYPT_COST", uint64(bcrypt.DefaultCost)))
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return bcrypt.DefaultCost
+	}
+	return cost
+}
+
+var (
+	hashSlotsOnce sync.Once
+	hashSlots     chan struct{}
+)
+
+// acquireHashSlot waits until fewer than PASSWORD_HASH_CONCURRENCY hashes
+// (4 by default) are being computed. Each argon2id run holds
+// ARGON2_MEMORY_KB of memory, so an unbounded burst of logins could exhaust
+// it. Call the returned function when done.
+func acquireHashSlot() func() {
+	hashSlotsOnce.Do(func() {
+		hashSlots = make(chan struct{}, envUint("PASSWORD_HASH_CONCURRENCY", 4))
+	})
+	hashSlots <- struct{}{}
+	return func() { <-hashSlots }
+}
+
+// HashPassword hashes pw with the current algorithm and cost.
+func HashPassword(pw string) (string, error) {
+	defer acquireHashSlot()()
+
+	if hashAlgorithm() == HashBcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(pw), currentBcryptCost())
+		return string(b), err
+	}
+
+	p := currentArgon2Params()
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pw), salt, p.Time, p.Memory, p.Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword reports whether pw matches hash, in either format. Hashes
+// that can't match anything, such as the "!" of invited or anonymized
+// accounts, simply don't match.
+func VerifyPassword(hash, pw string) bool {
+	if !isBcrypt(hash) && !strings.HasPrefix(hash, "$argon2id$") {
+		return false
+	}
+	defer acquireHashSlot()()
+
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		p, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false
+		}
+		got := argon2.IDKey([]byte(pw), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(got, key) == 1
+	}
+	return false
+}
+
+// NeedsRehash reports whether a verified hash is weaker than, or uses a
+// different algorithm than, the current policy.
+func NeedsRehash(hash string) bool {
+	switch {
+	case isBcrypt(hash):
+		if hashAlgorithm() != HashBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < currentBcryptCost()
+	case strings.HasPrefix(hash, "$argon2id$"):
+		if hashAlgorithm() != HashArgon2id {
+			return true
+		}
+		p, _, _, err := decodeArgon2id(hash)
+		return err != nil || p != currentArgon2Params()
+	}
+	return false
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func decodeArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHashFormat
+	}
+	return p, salt, key, nil
+}
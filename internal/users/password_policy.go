@@ -0,0 +1,277 @@
+package users
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxPasswordBytes keeps passwords within what bcrypt accepts.
+const maxPasswordBytes = 72
+
+//go:embed breached_passwords.txt
+var builtinBreachedPasswords string
+
+// PolicyError is a password rejected by the password policy. Its message is
+// safe to show to the user.
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "password " + e.Reason
+}
+
+func minPasswordLength() int {
+	return int(envUint("PASSWORD_MIN_LENGTH", 8))
+}
+
+// minPasswordClasses is how many of lowercase, uppercase, digits and symbols
+// a password must mix (PASSWORD_MIN_CLASSES, 1 by default).
+func minPasswordClasses() int {
+	n := int(envUint("PASSWORD_MIN_CLASSES", 1))
+	if n > 4 {
+		n = 4
+	}
+	return n
+}
+
+// ValidatePassword checks a new password against the policy: length,
+// character classes, the account's own username or email, and the
+// breached-password list.
+func ValidatePassword(pw, username, email string) error {
+	if n := minPasswordLength(); utf8.RuneCountInString(pw) < n {
+		return &PolicyError{Reason: fmt.Sprintf("must be at least %d characters", n)}
+	}
+	if len(pw) > maxPasswordBytes {
+		return &PolicyError{Reason: fmt.Sprintf("must be at most %d bytes", maxPasswordBytes)}
+	}
+	if n := minPasswordClasses(); characterClasses(pw) < n {
+		return &PolicyError{Reason: fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", n)}
+	}
+
+	lower := strings.ToLower(pw)
+	if username != "" && lower == strings.ToLower(username) {
+		return &PolicyError{Reason: "must not be your username"}
+	}
+	if email != "" {
+		if local, _, _ := strings.Cut(strings.ToLower(email), "@"); lower == strings.ToLower(email) || lower == local {
+			return &PolicyError{Reason: "must not be your email address"}
+		}
+	}
+	breached, err := isBreached(pw)
+	if err != nil {
+		return fmt.Errorf("check breached passwords: %w", err)
+	}
+	if breached {
+		return &PolicyError{Reason: "is too common or has appeared in a data breach"}
+	}
+	return nil
+}
+
+func characterClasses(pw string) int {
+	var lower, upper, digit, other bool
+	for _, r := range pw {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, b := range []bool{lower, upper, digit, other} {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+// ================================
+// BREACHED PASSWORDS
+// ================================
+
+var (
+	builtinOnce     sync.Once
+	builtinBreached map[string]struct{} // upper-case hex SHA-1
+	breachedFile    *hashFile           // PASSWORD_BREACHED_LIST, if set
+)
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func loadBuiltinBreached() {
+	builtinBreached = map[string]struct{}{}
+	for _, line := range strings.Split(builtinBreachedPasswords, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		builtinBreached[sha1Hex(strings.ToLower(line))] = struct{}{}
+	}
+}
+
+// InitializeBreachedList opens the optional PASSWORD_BREACHED_LIST file.
+// It must hold upper-case SHA-1 hashes sorted by hash, one per line and
+// optionally followed by ":count", like the "ordered by hash" download of
+// Have I Been Pwned. The file is searched on disk and never read into
+// memory, so it can be of any size.
+func InitializeBreachedList() error {
+	builtinOnce.Do(loadBuiltinBreached)
+
+	path := os.Getenv("PASSWORD_BREACHED_LIST")
+	if path == "" {
+		return nil
+	}
+	hf, err := openHashFile(path)
+	if err != nil {
+		return fmt.Errorf("breached password list %s: %w", path, err)
+	}
+	breachedFile = hf
+	log.Printf("password policy: using breached password list %s (%d MB)", path, hf.size>>20)
+	return nil
+}
+
+func isBreached(pw string) (bool, error) {
+	builtinOnce.Do(loadBuiltinBreached)
+	for _, candidate := range []string{pw, strings.ToLower(pw)} {
+		hash := sha1Hex(candidate)
+		if _, ok := builtinBreached[hash]; ok {
+			return true, nil
+		}
+		if breachedFile == nil {
+			continue
+		}
+		found, err := breachedFile.contains(hash)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// hashFile is a sorted file of hash lines, searched in place.
+type hashFile struct {
+	f    *os.File
+	size int64
+}
+
+// hashFileSample is how many lines are checked when the file is opened.
+const hashFileSample = 1000
+
+func openHashFile(path string) (*hashFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Catch plaintext or unsorted files early; a wrong file would
+	// otherwise just never match
+	sc := bufio.NewScanner(f)
+	prev := ""
+	for i := 0; i < hashFileSample && sc.Scan(); i++ {
+		h := lineHash(sc.Text())
+		if len(h) != 40 {
+			f.Close()
+			return nil, fmt.Errorf("line %d is not a SHA-1 hash", i+1)
+		}
+		if _, err := hex.DecodeString(h); err != nil || h != strings.ToUpper(h) {
+			f.Close()
+			return nil, fmt.Errorf("line %d is not an upper-case SHA-1 hash", i+1)
+		}
+		if h < prev {
+			f.Close()
+			return nil, fmt.Errorf("line %d is out of order, the file must be sorted by hash", i+1)
+		}
+		prev = h
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &hashFile{f: f, size: info.Size()}, nil
+}
+
+// lineHash is the hash of a "HASH" or "HASH:count" line.
+func lineHash(line string) string {
+	h, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	return h
+}
+
+// contains binary-searches the file by byte offset. Each probe looks at the
+// first line that starts at or after the offset.
+func (hf *hashFile) contains(hash string) (bool, error) {
+	lo, hi := int64(0), hf.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := hf.lineAt(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		switch h := lineHash(line); {
+		case h == hash:
+			return true, nil
+		case h < hash:
+			lo = start + int64(len(line))
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineAt returns the first line starting at or after off, including its
+// newline, and where it starts. At the end of the file start is size.
+func (hf *hashFile) lineAt(off int64) (int64, string, error) {
+	start := off
+	if off > 0 {
+		// Skip the rest of the line off-1 belongs to
+		start = off - 1
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(hf.f, start, hf.size-start), 256)
+	if off > 0 {
+		skipped, err := r.ReadString('\n')
+		if err == io.EOF {
+			return hf.size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	if line == "" {
+		return hf.size, "", nil
+	}
+	return start, line, nil
+}
@@ -0,0 +1,128 @@
+package users
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		pw       string
+		username string
+		email    string
+		policy   bool // rejected by the policy
+	}{
+		{"acceptable", nil, "vivid-otter-lamp", "jane", "jane@example.com", false},
+		{"too short", nil, "a1b2c3", "", "", true},
+		{"length counts characters, not bytes", nil, "ééééééé€", "", "", false},
+		{"longer than 72 bytes", nil, strings.Repeat("x", 73), "", "", true},
+		{"configured minimum length", map[string]string{"PASSWORD_MIN_LENGTH": "20"}, "vivid-otter-lamp", "", "", true},
+		{"too few character classes", map[string]string{"PASSWORD_MIN_CLASSES": "3"}, "vividotterlamp", "", "", true},
+		{"enough character classes", map[string]string{"PASSWORD_MIN_CLASSES": "3"}, "Vivid-otter-lamp", "", "", false},
+		{"same as the username", nil, "JaneDoe1984", "janedoe1984", "", true},
+		{"same as the email", nil, "Jane@Example.com", "", "jane@example.com", true},
+		{"same as the email's local part", nil, "janedoe1984", "", "JaneDoe1984@example.com", true},
+		{"on the built-in breached list", nil, "123456789", "", "", true},
+		{"breached list ignores case", nil, "PASSWORD", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			err := ValidatePassword(tt.pw, tt.username, tt.email)
+			var pe *PolicyError
+			if got := errors.As(err, &pe); got != tt.policy {
+				t.Errorf("ValidatePassword() = %v, want policy error %v", err, tt.policy)
+			}
+			if err != nil && pe == nil {
+				t.Errorf("ValidatePassword() = %v, want no other error", err)
+			}
+		})
+	}
+}
+
+func writeHashFile(t *testing.T, lines []string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenHashFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		wantErr bool
+	}{
+		{"sorted hashes", []string{sha1Hex("a"), sha1Hex("b")}, false},
+		{"hashes with counts", []string{sha1Hex("a") + ":12"}, false},
+		{"plaintext", []string{"password"}, true},
+		{"lower-case hashes", []string{strings.ToLower(sha1Hex("a"))}, true},
+		{"unsorted", []string{"F" + sha1Hex("a")[1:], "0" + sha1Hex("a")[1:]}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hf, err := openHashFile(writeHashFile(t, tt.lines))
+			if hf != nil {
+				hf.f.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("openHashFile() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHashFileContains(t *testing.T) {
+	var lines []string
+	for i := 0; i < 500; i++ {
+		lines = append(lines, sha1Hex(strings.Repeat("p", i+1))+":"+strings.Repeat("9", i%7+1))
+	}
+	sort.Strings(lines)
+	hf, err := openHashFile(writeHashFile(t, lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hf.f.Close()
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{"first line", lineHash(lines[0]), true},
+		{"last line", lineHash(lines[len(lines)-1]), true},
+		{"middle line", lineHash(lines[250]), true},
+		{"second line", lineHash(lines[1]), true},
+		{"before the first line", strings.Repeat("0", 40), false},
+		{"after the last line", strings.Repeat("F", 40), false},
+		{"not listed", sha1Hex("not listed"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hf.contains(tt.hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("contains(%s) = %v, want %v", tt.hash, got, tt.want)
+			}
+		})
+	}
+
+	// Every listed hash must be found wherever it falls
+	for _, line := range lines {
+		if ok, err := hf.contains(lineHash(line)); err != nil || !ok {
+			t.Fatalf("contains(%s) = %v, %v", lineHash(line), ok, err)
+		}
+	}
+}
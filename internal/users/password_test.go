@@ -0,0 +1,93 @@
+package users
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapArgon2 keeps argon2id fast enough for tests.
+func cheapArgon2(t *testing.T) {
+	t.Setenv("ARGON2_MEMORY_KB", "1024")
+	t.Setenv("ARGON2_TIME", "1")
+	t.Setenv("ARGON2_THREADS", "1")
+}
+
+func mustBcrypt(t *testing.T, pw string, cost int) string {
+	t.Helper()
+	b, err := bcrypt.GenerateFromPassword([]byte(pw), cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestVerifyPassword(t *testing.T) {
+	cheapArgon2(t)
+	argon, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := mustBcrypt(t, "correct horse", bcrypt.MinCost)
+
+	tests := []struct {
+		name string
+		hash string
+		pw   string
+		want bool
+	}{
+		{"argon2id match", argon, "correct horse", true},
+		{"argon2id mismatch", argon, "correct horse ", false},
+		{"bcrypt match", bc, "correct horse", true},
+		{"bcrypt mismatch", bc, "Correct horse", false},
+		{"locked account", "!", "!", false},
+		{"empty hash", "", "", false},
+		{"truncated argon2id", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA", "correct horse", false},
+		{"wrong argon2 version", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5", "correct horse", false},
+		{"argon2i is not argon2id", "$argon2i$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$a2V5", "correct horse", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyPassword(tt.hash, tt.pw); got != tt.want {
+				t.Errorf("VerifyPassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	cheapArgon2(t)
+	argon, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakBcrypt := mustBcrypt(t, "correct horse", bcrypt.MinCost)
+	defaultBcrypt := mustBcrypt(t, "correct horse", bcrypt.DefaultCost)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		hash string
+		want bool
+	}{
+		{"argon2id with current params", nil, argon, false},
+		{"argon2id with more memory configured", map[string]string{"ARGON2_MEMORY_KB": "2048"}, argon, true},
+		{"argon2id with fewer passes configured", map[string]string{"ARGON2_TIME": "2"}, argon, true},
+		{"argon2id when bcrypt is configured", map[string]string{"PASSWORD_HASH": "bcrypt"}, argon, true},
+		{"bcrypt when argon2id is configured", nil, defaultBcrypt, true},
+		{"bcrypt at the configured cost", map[string]string{"PASSWORD_HASH": "bcrypt"}, defaultBcrypt, false},
+		{"bcrypt below the configured cost", map[string]string{"PASSWORD_HASH": "bcrypt"}, weakBcrypt, true},
+		{"bcrypt above the configured cost", map[string]string{"PASSWORD_HASH": "bcrypt", "BCRYPT_COST": "4"}, defaultBcrypt, false},
+		{"unknown format", nil, "!", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if got := NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
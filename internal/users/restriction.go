@@ -0,0 +1,137 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Ponloe/cinemesh-core/internal/database"
+	"gorm.io/gorm"
+)
+
+const (
+	RestrictionSuspended = "suspended"
+	RestrictionBanned    = "banned"
+)
+
+var ErrInvalidRestriction = errors.New("restriction must be suspended or banned")
+
+// Restriction suspends or bans an account, optionally until ExpiresAt. Rows
+// are kept after they expire or are lifted as the account's history.
+type Restriction struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"not null;index"`
+	Kind       string `gorm:"size:20;not null"`
+	Reason     string `gorm:"type:text"`
+	ActorID    uint
+	ExpiresAt  *time.Time
+	LiftedAt   *time.Time
+	LiftedByID *uint
+	CreatedAt  time.Time
+}
+
+func (Restriction) TableName() string {
+	return "user_restrictions"
+}
+
+// Active reports whether the restriction applies right now.
+func (r *Restriction) Active() bool {
+	return r.LiftedAt == nil && (r.ExpiresAt == nil || time.Now().Before(*r.ExpiresAt))
+}
+
+// Message is the user-facing explanation, e.g. for a refused login.
+func (r *Restriction) Message() string {
+	msg := "account " + r.Kind
+	if r.ExpiresAt != nil {
+		msg += " until " + r.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if r.Reason != "" {
+		msg += ": " + r.Reason
+	}
+	return msg
+}
+
+func activeScope(db *gorm.DB) *gorm.DB {
+	return db.Where("lifted_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", time.Now())
+}
+
+// ActiveRestriction returns the restriction currently applying to the user,
+// or nil. Bans win over suspensions.
+func ActiveRestriction(userID uint) (*Restriction, error) {
+	var r Restriction
+	err := database.DB.Scopes(activeScope).
+		Where("user_id = ?", userID).
+		Order("CASE kind WHEN 'banned' THEN 0 ELSE 1 END, created_at DESC").
+		First(&r).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &r, nil
+}
+
+// ActiveRestrictions maps user ids to their current restriction.
+func ActiveRestrictions(userIDs []uint) (map[uint]*Restriction, error) {
+	out := make(map[uint]*Restriction)
+	if len(userIDs) == 0 {
+		return out, nil
+	}
+
+	var rows []Restriction
+	if err := database.DB.Scopes(activeScope).
+		Where("user_id IN ?", userIDs).
+		Order("created_at ASC").
+		Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		r := &rows[i]
+		if cur, ok := out[r.UserID]; !ok || cur.Kind != RestrictionBanned || r.Kind == RestrictionBanned {
+			out[r.UserID] = r
+		}
+	}
+	return out, nil
+}
+
+// RestrictionHistory returns the user's restrictions, newest first.
+func RestrictionHistory(userID uint) ([]Restriction, error) {
+	var rows []Restriction
+	err := database.DB.Where("user_id = ?", userID).Order("created_at DESC").Find(&rows).Error
+	return rows, err
+}
+
+// Restrict suspends or bans a user. Any restriction already in place is
+// lifted and replaced.
+func Restrict(userID uint, kind, reason string, expiresAt *time.Time, actorID uint) (*Restriction, error) {
+	if kind != RestrictionSuspended && kind != RestrictionBanned {
+		return nil, ErrInvalidRestriction
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("expiry must be in the future")
+	}
+
+	r := Restriction{UserID: userID, Kind: kind, Reason: reason, ActorID: actorID, ExpiresAt: expiresAt}
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := liftAll(tx, userID, actorID); err != nil {
+			return err
+		}
+		return tx.Create(&r).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// LiftRestriction ends the user's current suspension or ban.
+func LiftRestriction(userID, actorID uint) error {
+	return liftAll(database.DB, userID, actorID)
+}
+
+func liftAll(tx *gorm.DB, userID, actorID uint) error {
+	return tx.Model(&Restriction{}).Scopes(activeScope).
+		Where("user_id = ?", userID).
+		Updates(map[string]interface{}{"lifted_at": time.Now(), "lifted_by_id": actorID}).Error
+}